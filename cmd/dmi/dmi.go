@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"github.com/abiosoft/ishell"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -15,26 +16,89 @@ type Client struct {
 	ZookeeperClient *dmi.ZkClient
 }
 
+const (
+	blobLayout  = "blob"  // one etcd key per tag name holding the whole TagValueIndex
+	valueLayout = "value" // one etcd key per tag value holding its node list
+)
+
+const maxSuggestions = 5
+
 func main() {
 	var file string
+	var layout string
+	var nodeTag string
+	var radix bool
+	var cache bool
+	var zkServers string
+	var zkAuth string
+	var zkReaders string
+	var namespace string
 
 	flag.StringVar(&file, "parse", "", "To parse a txt file.")
 	flag.StringVar(&file, "p", "", "To parse a txt file. (shorthand)")
+	flag.StringVar(&layout, "layout", blobLayout, "etcd storage layout of the tag values, blob or value.")
+	flag.BoolVar(&radix, "radix", false, "Migrate the tag-name trie in Zookeeper to the path-compressed layout.")
+	flag.StringVar(&zkServers, "zk", strings.Join(dmi.ZkServers, ","), "Comma separated addresses of the Zookeeper servers.")
+	flag.StringVar(&zkAuth, "zk-auth", "", "user:password to authenticate with Zookeeper, the trie znodes are then writable by this user only.")
+	flag.StringVar(&zkReaders, "zk-readers", "", "Comma separated user:password of the Zookeeper users allowed to read the trie, with -zk-auth.")
+	flag.StringVar(&namespace, "namespace", "", "Namespace to index the file into, the default namespace if empty.")
+	flag.BoolVar(&cache, "cache", false, "Mirror the tag-name trie in memory and answer tag-name searches from it.")
+	flag.StringVar(&nodeTag, "node-tag", "hostname", "Tag whose value names the node of a line. Lines without it are skipped.")
 
 	flag.Parse()
 
 	switch {
+	case cache && radix:
+		dmi.Out.Println("The -cache mirror serves the character trie only, it can't be used with -radix")
+		return
 	case file == "":
 		dmi.Out.Println("Can't start a node with null file")
 		return
+	case layout != blobLayout && layout != valueLayout:
+		dmi.Out.Printf("Unknown layout %v, use %v or %v\n", layout, blobLayout, valueLayout)
+		return
 	}
 
-	client := Start(file)
+	acl := dmi.WorldZkACL()
+	if zkAuth != "" {
+		var readers []string
+		if zkReaders != "" {
+			readers = strings.Split(zkReaders, ",")
+		}
+		var err error
+		if acl, err = dmi.DigestZkACL(zkAuth, []string{zkAuth}, readers); err != nil {
+			dmi.Out.Println(err)
+			return
+		}
+	}
+
+	registry, err := dmi.CreateNodeRegistry()
+	if err != nil {
+		dmi.Error.Printf("error while CreateNodeRegistry, err: %v\n", err)
+		return
+	}
+	defer registry.Close()
+
+	servers := strings.Split(zkServers, ",")
+	ns := dmi.Namespace(namespace)
+	client := Start(file, layout, nodeTag, radix, servers, acl, ns, registry)
+	if cache {
+		trieCache, err := dmi.NewNamespaceTrieCache(ns, acl, servers...)
+		if err != nil {
+			dmi.Error.Printf("error while NewNamespaceTrieCache, err: %v\n", err)
+		} else {
+			defer trieCache.Close()
+			if err := client.UseTrieCache(trieCache); err != nil {
+				dmi.Error.Printf("error while UseTrieCache, err: %v\n", err)
+			}
+		}
+	}
 
-	CLI(client)
+	CLI(client, layout, ns, registry)
 }
 
-func CLI(client *dmi.ZkClient) {
+// CLI runs the shell in the namespace the file was indexed into, which is deleted from etcd on quit
+func CLI(client *dmi.ZkClient, layout string, ns dmi.Namespace, registry *dmi.NodeRegistry) {
 	shell := ishell.New()
 
 	shell.AddCmd(&ishell.Cmd{
@@ -51,90 +115,85 @@ func CLI(client *dmi.ZkClient) {
 		},
 	})
 
+	var source dmi.IndexSource = dmi.NewEtcdIndexSource(client)
+	if layout == valueLayout {
+		source = dmi.NewEtcdPostingSource(client)
+	}
+
 	shell.AddCmd(&ishell.Cmd{
 		Name: "s",
 		Func: func(c *ishell.Context) {
-			timeBefore := time.Now()
-
-			if len(c.Args) != 1 {
-				c.Println("syntax error (usage: s	[regex])")
-				return
-			}
-			regex := c.Args[0]
-			tmp := strings.Split(regex, "=")
-			tagKey := tmp[0]
-			tagValue := tmp[1]
-			results, err := client.SearchTagName(tagKey)
-			if err != nil {
-				fmt.Errorf("error while SearchTagName, err: %v\n", err)
-			}
-
-			fmt.Printf("%-18s %-18s %-38s\n", "tagName", "tagValue", "nodeLists")
-			fmt.Printf("%-18s %-18s %-38s\n", "-------", "--------", "---------")
-
-			for _, v := range results {
-				treeb, err := dmi.GetIndex(v)
-				if err != nil {
-					fmt.Errorf(err.Error())
-				}
-				// convert bytes to TagValueIndex
-				treed := dmi.DecodeBytesToTagValueIndex(treeb)
-
-				data, err := treed.FindAllMatchedNodes(tagValue)
+			search(c, source, registry)
+		},
+	})
 
-				for _, nodePair := range data {
-					fmt.Printf("%-18s %-18s %-8v\n", v, nodePair.GetStr(), nodePair.GetNodeList())
-				}
-			}
+	shell.AddCmd(&ishell.Cmd{
+		Name: "search",
+		Func: func(c *ishell.Context) {
+			search(c, source, registry)
+		},
+	})
 
-			fmt.Printf("This search uses time: %d milliseconds\n", time.Now().Sub(timeBefore).Milliseconds())
+	shell.AddCmd(&ishell.Cmd{
+		Name: "count",
+		Func: func(c *ishell.Context) {
+			count(c, source)
 		},
 	})
 
 	shell.AddCmd(&ishell.Cmd{
-		Name: "search",
+		Name: "node",
 		Func: func(c *ishell.Context) {
-			timeBefore := time.Now()
+			showNode(c, client, registry)
+		},
+	})
 
-			if len(c.Args) != 1 {
-				c.Println("syntax error (usage: s	[regex])")
-				return
-			}
-			regex := c.Args[0]
-			tmp := strings.Split(regex, "=")
-			tagKey := tmp[0]
-			tagValue := tmp[1]
-			results, err := client.SearchTagName(tagKey)
-			if err != nil {
-				fmt.Errorf("error while SearchTagName, err: %v\n", err)
-			}
+	shell.AddCmd(&ishell.Cmd{
+		Name: "meta",
+		Func: func(c *ishell.Context) {
+			showMetadata(c, client)
+		},
+	})
 
-			fmt.Printf("%-18s %-18s %-38s\n", "tagName", "tagValue", "nodeLists")
-			fmt.Printf("%-18s %-18s %-38s\n", "-------", "--------", "---------")
+	shell.AddCmd(&ishell.Cmd{
+		Name: "describe",
+		Func: func(c *ishell.Context) {
+			describeTagName(c, client)
+		},
+	})
 
-			for _, v := range results {
-				treeb, err := dmi.GetIndex(v)
-				if err != nil {
-					fmt.Errorf(err.Error())
-				}
-				// convert bytes to TagValueIndex
-				treed := dmi.DecodeBytesToTagValueIndex(treeb)
+	shell.AddCmd(&ishell.Cmd{
+		Name: "use",
+		Func: func(c *ishell.Context) {
+			useNamespace(c, client)
+		},
+	})
 
-				data, err := treed.FindAllMatchedNodes(tagValue)
+	shell.AddCmd(&ishell.Cmd{
+		Name: "namespaces",
+		Func: func(c *ishell.Context) {
+			listNamespaces(c, client)
+		},
+	})
 
-				for _, nodePair := range data {
-					fmt.Printf("%-18s %-18s %-8v\n", v, nodePair.GetStr(), nodePair.GetNodeList())
-				}
-			}
+	shell.AddCmd(&ishell.Cmd{
+		Name: "ls",
+		Func: func(c *ishell.Context) {
+			listTagNames(c, client)
+		},
+	})
 
-			fmt.Printf("This search uses time: %d milliseconds\n", time.Now().Sub(timeBefore).Milliseconds())
+	shell.AddCmd(&ishell.Cmd{
+		Name: "drop",
+		Func: func(c *ishell.Context) {
+			dropNamespace(c, client)
 		},
 	})
 
 	shell.AddCmd(&ishell.Cmd{
 		Name: "q",
 		Func: func(c *ishell.Context) {
-			dmi.DeleteAll()
+			ns.DeleteIndexes()
 			shell.Close()
 		},
 	})
@@ -142,7 +201,7 @@ func CLI(client *dmi.ZkClient) {
 	shell.AddCmd(&ishell.Cmd{
 		Name: "quit",
 		Func: func(c *ishell.Context) {
-			dmi.DeleteAll()
+			ns.DeleteIndexes()
 			shell.Close()
 		},
 	})
@@ -150,10 +209,332 @@ func CLI(client *dmi.ZkClient) {
 	shell.Run()
 }
 
-func Start(file string) *dmi.ZkClient {
-	dmi.DeleteAll()
+// search evaluates a boolean query. A single tag_name=tag_value term prints every matched tag value,
+// a combined query prints the final node set. Nodes are printed by their names in the registry.
+func search(c *ishell.Context, source dmi.IndexSource, registry *dmi.NodeRegistry) {
+	timeBefore := time.Now()
+
+	// RawArgs keeps the quotes of quoted tag names and tag values
+	limit, args, err := parseLimit(c.RawArgs[1:])
+	if err != nil {
+		c.Println(err)
+		return
+	}
+	if len(args) == 0 {
+		c.Println("syntax error (usage: s	[--limit n] [query])")
+		return
+	}
+	query, err := dmi.ParseQuery(strings.Join(args, " "))
+	if err != nil {
+		c.Println(err)
+		return
+	}
+
+	if query.Op == dmi.QueryOpTerm {
+		var matches []dmi.TermMatch
+		if limit > 0 {
+			matches, err = query.Term.FindFirstMatchedNodes(source, limit)
+		} else {
+			matches, err = query.Term.FindAllMatchedNodes(source)
+		}
+		if err != nil {
+			c.Printf("error while searching %v, err: %v\n", query, err)
+			return
+		}
+
+		fmt.Printf("%-18s %-18s %-38s\n", "tagName", "tagValue", "nodeLists")
+		fmt.Printf("%-18s %-18s %-38s\n", "-------", "--------", "---------")
+
+		for _, match := range matches {
+			nodes, err := registry.FormatNodes(match.GetNodes())
+			if err != nil {
+				c.Printf("error while reading node names, err: %v\n", err)
+				return
+			}
+			fmt.Printf("%-18s %-18s %-8v\n", match.TagName, match.GetStr(), nodes)
+		}
+
+		if len(matches) == 0 {
+			suggest(c, query.Term, source)
+		}
+	} else {
+		nodes, err := query.Evaluate(source)
+		if err != nil {
+			c.Printf("error while searching %v, err: %v\n", query, err)
+			return
+		}
 
-	client, _ := dmi.CreateZkClient()
+		shown := nodes
+		if limit > 0 && nodes.Cardinality() > limit {
+			shown = dmi.NewBitmap()
+			nodes.ForEach(func(id uint32) bool {
+				shown.Add(id)
+				return shown.Cardinality() < limit
+			})
+		}
+
+		names, err := registry.FormatNodes(shown)
+		if err != nil {
+			c.Printf("error while reading node names, err: %v\n", err)
+			return
+		}
+
+		fmt.Printf("%-8s %-38s\n", "count", "nodeLists")
+		fmt.Printf("%-8s %-38s\n", "-----", "---------")
+		fmt.Printf("%-8d %-8v\n", nodes.Cardinality(), names)
+	}
+
+	fmt.Printf("This search uses time: %d milliseconds\n", time.Now().Sub(timeBefore).Milliseconds())
+}
+
+// parseLimit takes a leading --limit n or --limit=n off the arguments. A limit of 0 means no limit.
+func parseLimit(args []string) (limit int, rest []string, err error) {
+	if len(args) == 0 || !strings.HasPrefix(args[0], "--limit") {
+		return 0, args, nil
+	}
+	value, rest := strings.TrimPrefix(args[0], "--limit"), args[1:]
+	switch {
+	case strings.HasPrefix(value, "="):
+		value = value[1:]
+	case value == "" && len(rest) > 0:
+		value, rest = rest[0], rest[1:]
+	default:
+		return 0, nil, fmt.Errorf("syntax error (usage: --limit n)")
+	}
+	limit, err = strconv.Atoi(value)
+	if err != nil || limit <= 0 {
+		return 0, nil, fmt.Errorf("limit must be a positive number, got %q", value)
+	}
+	return limit, rest, nil
+}
+
+// count prints how many nodes match a query. A single tag_name=tag_value term is also counted per tag name.
+func count(c *ishell.Context, source dmi.IndexSource) {
+	timeBefore := time.Now()
+
+	if len(c.RawArgs) < 2 {
+		c.Println("syntax error (usage: count	[query])")
+		return
+	}
+	query, err := dmi.ParseQuery(strings.Join(c.RawArgs[1:], " "))
+	if err != nil {
+		c.Println(err)
+		return
+	}
+
+	if query.Op == dmi.QueryOpTerm {
+		counts, err := query.Term.Count(source)
+		if err != nil {
+			c.Printf("error while counting %v, err: %v\n", query, err)
+			return
+		}
+
+		fmt.Printf("%-18s %-10s %-10s\n", "tagName", "count", "distinct")
+		fmt.Printf("%-18s %-10s %-10s\n", "-------", "-----", "--------")
+
+		distinct := 0
+		for _, tagCount := range counts {
+			fmt.Printf("%-18s %-10d %-10d\n", tagCount.TagName, tagCount.Count, tagCount.Distinct)
+			distinct = tagCount.Distinct
+		}
+		// the nodes of several tag names may overlap, only then the node lists have to be merged
+		if len(counts) <= 1 {
+			fmt.Printf("%d distinct nodes match %v\n", distinct, query)
+			fmt.Printf("This count uses time: %d milliseconds\n", time.Now().Sub(timeBefore).Milliseconds())
+			return
+		}
+	}
+
+	nodes, err := query.Evaluate(source)
+	if err != nil {
+		c.Printf("error while counting %v, err: %v\n", query, err)
+		return
+	}
+	fmt.Printf("%d distinct nodes match %v\n", nodes.Cardinality(), query)
+
+	fmt.Printf("This count uses time: %d milliseconds\n", time.Now().Sub(timeBefore).Milliseconds())
+}
+
+// showNode prints all tags of a node, looked up in the reverse index of the namespace. The node is given by its name
+// or its ID.
+func showNode(c *ishell.Context, client *dmi.ZkClient, registry *dmi.NodeRegistry) {
+	if len(c.Args) != 1 {
+		c.Println("syntax error (usage: node	[name or id])")
+		return
+	}
+	id, found, err := registry.Lookup(c.Args[0])
+	if err != nil {
+		c.Printf("error while looking up node %v, err: %v\n", c.Args[0], err)
+		return
+	}
+	if !found {
+		n, err := strconv.ParseUint(c.Args[0], 10, 32)
+		if err != nil {
+			c.Printf("unknown node %v\n", c.Args[0])
+			return
+		}
+		id = uint32(n)
+	}
+
+	tags, err := client.Namespace().GetNodeTags(id)
+	if err != nil {
+		c.Printf("error while reading the tags of node %v, err: %v\n", c.Args[0], err)
+		return
+	}
+	if len(tags) == 0 {
+		c.Printf("node %v has no tags\n", c.Args[0])
+		return
+	}
+
+	fmt.Printf("%-18s %-18s\n", "tagName", "tagValue")
+	fmt.Printf("%-18s %-18s\n", "-------", "--------")
+
+	for _, tag := range tags {
+		fmt.Printf("%-18s %-18s\n", tag.Name, tag.Value)
+	}
+}
+
+// showMetadata prints the metadata of a tag name
+func showMetadata(c *ishell.Context, client *dmi.ZkClient) {
+	if len(c.Args) != 1 {
+		c.Println("syntax error (usage: meta	<tag name>)")
+		return
+	}
+	metadata, err := client.GetTagNameMetadata(c.Args[0])
+	if err != nil {
+		c.Printf("error while reading the metadata of %v, err: %v\n", c.Args[0], err)
+		return
+	}
+
+	firstSeen := "unknown"
+	if !metadata.FirstSeen.IsZero() {
+		firstSeen = metadata.FirstSeen.Local().Format(time.RFC3339)
+	}
+	valueType := string(metadata.ValueType)
+	if valueType == "" {
+		valueType = "unknown"
+	}
+	fmt.Printf("%-16s %v\n", "firstSeen", firstSeen)
+	fmt.Printf("%-16s %d\n", "nodes", metadata.Nodes)
+	fmt.Printf("%-16s %d\n", "distinctValues", metadata.DistinctValues)
+	fmt.Printf("%-16s %v\n", "valueType", valueType)
+	fmt.Printf("%-16s %v\n", "description", metadata.Description)
+}
+
+// describeTagName sets the description of a tag name to the rest of the line
+func describeTagName(c *ishell.Context, client *dmi.ZkClient) {
+	if len(c.Args) < 2 {
+		c.Println("syntax error (usage: describe	<tag name> <text>)")
+		return
+	}
+	description := strings.Join(c.Args[1:], " ")
+	err := client.UpdateTagNameMetadata(c.Args[0], func(metadata *dmi.TagNameMetadata) {
+		metadata.Description = description
+	})
+	if err != nil {
+		c.Printf("error while describing %v, err: %v\n", c.Args[0], err)
+	}
+}
+
+// useNamespace switches the shell to another namespace, the default namespace if none is given
+func useNamespace(c *ishell.Context, client *dmi.ZkClient) {
+	if len(c.Args) > 1 {
+		c.Println("syntax error (usage: use	[namespace])")
+		return
+	}
+	ns := dmi.DefaultNamespace
+	if len(c.Args) == 1 {
+		ns = dmi.Namespace(c.Args[0])
+	}
+	if err := client.Use(ns); err != nil {
+		c.Printf("error while switching to namespace %q, err: %v\n", ns, err)
+		return
+	}
+	c.Printf("using namespace %q\n", ns)
+}
+
+// listNamespaces prints all namespaces, marking the one in use
+func listNamespaces(c *ishell.Context, client *dmi.ZkClient) {
+	namespaces, err := client.Namespaces()
+	if err != nil {
+		c.Printf("error while listing namespaces, err: %v\n", err)
+		return
+	}
+	for _, ns := range append([]dmi.Namespace{dmi.DefaultNamespace}, namespaces...) {
+		mark := " "
+		if ns == client.Namespace() {
+			mark = "*"
+		}
+		fmt.Printf("%s %q\n", mark, ns)
+	}
+}
+
+// listTagNames prints all tag names of the namespace in use
+func listTagNames(c *ishell.Context, client *dmi.ZkClient) {
+	tagNames, err := client.ListTagNames()
+	if err != nil {
+		c.Printf("error while listing tag names, err: %v\n", err)
+		return
+	}
+	for _, tagName := range tagNames {
+		fmt.Println(tagName)
+	}
+	fmt.Printf("%d tag names in namespace %q\n", len(tagNames), client.Namespace())
+}
+
+// dropNamespace deletes a namespace, an empty name is the default namespace
+func dropNamespace(c *ishell.Context, client *dmi.ZkClient) {
+	if len(c.Args) != 1 {
+		c.Println("syntax error (usage: drop	<namespace>)")
+		return
+	}
+	ns := dmi.Namespace(c.Args[0])
+	if err := client.DeleteNamespace(ns); err != nil {
+		c.Printf("error while deleting namespace %q, err: %v\n", ns, err)
+		return
+	}
+	c.Printf("deleted namespace %q\n", ns)
+}
+
+// suggest prints the closest tag_name=tag_value pairs of a term that matched nothing
+func suggest(c *ishell.Context, term dmi.QueryTerm, source dmi.IndexSource) {
+	matches, err := term.Suggest(source)
+	if err != nil {
+		c.Printf("error while suggesting %v, err: %v\n", term.TagName, err)
+		return
+	}
+	// a range term matches many tag values of the same tag name, so print each suggestion once
+	printed := make(map[string]bool)
+	for _, match := range matches {
+		if len(printed) == maxSuggestions {
+			break
+		}
+		suggestion := &dmi.Query{Op: dmi.QueryOpTerm, Term: dmi.QueryTerm{TagName: match.TagName, TagValue: match.GetStr(), Range: term.Range}}
+		if !printed[suggestion.String()] {
+			printed[suggestion.String()] = true
+			fmt.Printf("did you mean %v? (distance %d)\n", suggestion, match.Distance())
+		}
+	}
+}
+
+// Start indexes every line of the file as the tags of one node. The node is named by the value of nodeTag, a line
+// without it is skipped, and its ID is taken from the registry, so the IDs do not depend on the order of the lines. The suffix trie of a tag-name trie that lacks one is built first, and with radix set, the tag-name
+// trie is migrated to the path-compressed layout. The file is indexed into the namespace ns, replacing its
+// indexes, while other namespaces are left alone.
+func Start(file string, layout string, nodeTag string, radix bool, zkServers []string, acl *dmi.ZkACL, ns dmi.Namespace, registry *dmi.NodeRegistry) *dmi.ZkClient {
+	ns.DeleteIndexes()
+
+	client, err := dmi.CreateZkClientWithACL(acl, zkServers...)
+	check(err)
+	check(client.Use(ns))
+	if err := client.BuildSuffixTrie(); err != nil {
+		dmi.Error.Printf("error while BuildSuffixTrie, err: %v\n", err)
+	}
+	if radix {
+		if err := client.MigrateToRadixTrie(); err != nil {
+			dmi.Error.Printf("error while MigrateToRadixTrie, err: %v\n", err)
+		}
+	}
 	readFile, err := os.Open(file)
 
 	check(err)
@@ -162,10 +543,29 @@ func Start(file string) *dmi.ZkClient {
 	fileScanner.Split(bufio.ScanLines)
 
 	m := make(map[string]*dmi.TagValueIndex)
-	node := 0
+	nodeTags := make(map[uint32][]dmi.Tag)
+	line := 0
 	for fileScanner.Scan() {
 		s := fileScanner.Text()
+		line++
 		tags := strings.Split(s, ",")
+
+		name := ""
+		for _, tag := range tags {
+			if tmp := strings.Split(tag, "="); tmp[0] == nodeTag && len(tmp) > 1 {
+				name = tmp[1]
+			}
+		}
+		if name == "" {
+			dmi.Error.Printf("line %d has no %v tag, skipping it\n", line, nodeTag)
+			continue
+		}
+		node, err := registry.Register(name)
+		if err != nil {
+			dmi.Error.Printf("error while registering node %v, err: %v\n", name, err)
+			continue
+		}
+
 		for _, tag := range tags {
 			tmp := strings.Split(tag, "=")
 			tagKey := tmp[0]
@@ -175,20 +575,34 @@ func Start(file string) *dmi.ZkClient {
 				client.AddTagName(tagKey)
 				m[tagKey] = dmi.NewTagValueIndex()
 			}
-			m[tagKey].AddTagValue(tagValue, uint32(node))
+			m[tagKey].AddTagValue(tagValue, node)
+			nodeTags[node] = append(nodeTags[node], dmi.Tag{Name: tagKey, Value: tagValue})
 		}
-		node++
 	}
 
 	for tagKey, tree := range m {
+		if err := client.UpdateTagNameStats(tagKey, tree); err != nil {
+			dmi.Error.Printf("error while UpdateTagNameStats %v, err: %v\n", tagKey, err)
+		}
+		if layout == valueLayout {
+			err := ns.PutIndexPostings(tagKey, tree)
+			if err != nil {
+				dmi.Error.Printf("error while PutIndexPostings %v, err: %v\n", tagKey, err)
+			}
+			continue
+		}
 		// convert TagValueIndex to bytes
 		treeb := dmi.EncodeTagValueIndexToBytes(tree)
-		err := dmi.PutIndex(tagKey, treeb)
+		err := ns.PutIndex(tagKey, treeb)
 		if err != nil {
-			fmt.Errorf(err.Error())
+			dmi.Error.Printf("error while PutIndex %v, err: %v\n", tagKey, err)
 		}
 	}
 
+	if err := ns.PutAllNodeTags(nodeTags); err != nil {
+		dmi.Error.Printf("error while PutAllNodeTags, err: %v\n", err)
+	}
+
 	readFile.Close()
 	return client
 }
@@ -201,8 +615,19 @@ func check(e error) {
 
 func printHelp(shell *ishell.Shell) {
 	shell.Println("Commands:")
-	shell.Println("s <regex>                       - return search answer")
-	shell.Println("search <regex>                  - return search answer")
+	shell.Println("s <query>                       - return search answer, e.g. s cpu=AMD AND region=East* AND NOT level=1")
+	shell.Println("                                  regular expressions go between slashes, e.g. s /cpu|gpu/=/AMD.*/")
+	shell.Println("                                  a ~ searches within an edit distance, e.g. s regoin~=EastUS~1")
+	shell.Println("                                  --limit n only prints the first n matches, e.g. s --limit 10 cpu=*")
+	shell.Println("search <query>                  - return search answer")
+	shell.Println("count <query>                   - return the number of matching nodes, e.g. count region=East*")
+	shell.Println("node <name or id>               - return all tags of a node")
+	shell.Println("meta <tag name>                 - return the metadata of a tag name")
+	shell.Println("describe <tag name> <text>      - set the description of a tag name")
+	shell.Println("use [namespace]                 - switch to a namespace, the default one if none is given")
+	shell.Println("namespaces                      - list all namespaces")
+	shell.Println("ls                              - list all tag names of the namespace")
+	shell.Println("drop <namespace>                - delete all tag names and indexes of a namespace")
 	shell.Println("q, quit                         - quit the program")
 	shell.Println("h, help                         - print out help")
 }
@@ -37,6 +37,8 @@ func main() {
 
 	for i := 0; i < sizeOfData; i++ {
 		var sb strings.Builder
+		// hostname: names the node of the line, see the -node-tag flag of the shell
+		sb.WriteString("hostname=node" + strconv.Itoa(i) + ",")
 		for j := 0; j < len(tagNameList)-1; j++ {
 			key := tagNameList[j]
 			sizeOfValList := len(tagMap[key])
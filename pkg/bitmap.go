@@ -0,0 +1,599 @@
+package pkg
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/bits"
+	"sort"
+)
+
+const (
+	arrayMaxSize = 4096         // containers with more values are stored as bitsets
+	bitsetWords  = 1 << 16 / 64 // number of uint64 words in a bitset container
+)
+
+const (
+	arrayContainer  = 0
+	bitsetContainer = 1
+)
+
+// Bitmap is a compressed set of node IDs in the style of roaring bitmaps. An ID is split into its high 16 bits,
+// which select a container, and its low 16 bits, which are stored in the container. A container is a sorted
+// array while it holds at most arrayMaxSize values and a bitset of 2^16 bits once it gets denser.
+//
+// The zero value and nil are empty bitmaps, but only a non-nil Bitmap can be modified.
+type Bitmap struct {
+	keys       []uint16 // sorted high 16 bits of the IDs
+	containers []*container
+}
+
+type container struct {
+	array  []uint16 // sorted low 16 bits, if bitset is nil
+	bitset []uint64
+	card   int
+}
+
+// NewBitmap returns a Bitmap holding the given IDs
+func NewBitmap(ids ...uint32) *Bitmap {
+	b := &Bitmap{}
+	for _, id := range ids {
+		b.Add(id)
+	}
+	return b
+}
+
+// Add inserts id and reports whether it was not in the Bitmap yet.
+func (b *Bitmap) Add(id uint32) bool {
+	hi, lo := uint16(id>>16), uint16(id)
+	i := b.index(hi)
+	if i == len(b.keys) || b.keys[i] != hi {
+		b.keys = append(b.keys, 0)
+		copy(b.keys[i+1:], b.keys[i:])
+		b.keys[i] = hi
+		b.containers = append(b.containers, nil)
+		copy(b.containers[i+1:], b.containers[i:])
+		b.containers[i] = &container{}
+	}
+	return b.containers[i].add(lo)
+}
+
+// Remove deletes id and reports whether it was in the Bitmap.
+func (b *Bitmap) Remove(id uint32) bool {
+	if b == nil {
+		return false
+	}
+	hi, lo := uint16(id>>16), uint16(id)
+	i := b.index(hi)
+	if i == len(b.keys) || b.keys[i] != hi || !b.containers[i].remove(lo) {
+		return false
+	}
+	if b.containers[i].card == 0 {
+		b.keys = append(b.keys[:i], b.keys[i+1:]...)
+		b.containers = append(b.containers[:i], b.containers[i+1:]...)
+	}
+	return true
+}
+
+// Contains reports whether id is in the Bitmap.
+func (b *Bitmap) Contains(id uint32) bool {
+	if b == nil {
+		return false
+	}
+	hi, lo := uint16(id>>16), uint16(id)
+	i := b.index(hi)
+	return i < len(b.keys) && b.keys[i] == hi && b.containers[i].contains(lo)
+}
+
+// Cardinality returns the number of IDs in the Bitmap.
+func (b *Bitmap) Cardinality() int {
+	if b == nil {
+		return 0
+	}
+	card := 0
+	for _, c := range b.containers {
+		card += c.card
+	}
+	return card
+}
+
+// IsEmpty reports whether the Bitmap holds no ID.
+func (b *Bitmap) IsEmpty() bool {
+	return b == nil || len(b.keys) == 0
+}
+
+// ForEach calls fn for every ID in ascending order until fn returns false.
+func (b *Bitmap) ForEach(fn func(id uint32) bool) {
+	if b == nil {
+		return
+	}
+	for i, c := range b.containers {
+		hi := uint32(b.keys[i]) << 16
+		if c.bitset == nil {
+			for _, lo := range c.array {
+				if !fn(hi | uint32(lo)) {
+					return
+				}
+			}
+			continue
+		}
+		for w, word := range c.bitset {
+			for word != 0 {
+				lo := uint32(w*64 + bits.TrailingZeros64(word))
+				if !fn(hi | lo) {
+					return
+				}
+				word &= word - 1
+			}
+		}
+	}
+}
+
+// ToArray returns the IDs in ascending order
+func (b *Bitmap) ToArray() []uint32 {
+	ids := make([]uint32, 0, b.Cardinality())
+	b.ForEach(func(id uint32) bool {
+		ids = append(ids, id)
+		return true
+	})
+	return ids
+}
+
+// Clone returns a deep copy of the Bitmap
+func (b *Bitmap) Clone() *Bitmap {
+	res := &Bitmap{}
+	if b == nil {
+		return res
+	}
+	res.keys = append([]uint16(nil), b.keys...)
+	res.containers = make([]*container, len(b.containers))
+	for i, c := range b.containers {
+		res.containers[i] = c.clone()
+	}
+	return res
+}
+
+// And returns the intersection of both Bitmaps
+func (b *Bitmap) And(o *Bitmap) *Bitmap {
+	res := &Bitmap{}
+	if b == nil || o == nil {
+		return res
+	}
+	for i, j := 0, 0; i < len(b.keys) && j < len(o.keys); {
+		switch {
+		case b.keys[i] < o.keys[j]:
+			i++
+		case b.keys[i] > o.keys[j]:
+			j++
+		default:
+			res.appendContainer(b.keys[i], b.containers[i].and(o.containers[j]))
+			i++
+			j++
+		}
+	}
+	return res
+}
+
+// Or returns the union of both Bitmaps
+func (b *Bitmap) Or(o *Bitmap) *Bitmap {
+	if b == nil {
+		return o.Clone()
+	}
+	if o == nil {
+		return b.Clone()
+	}
+	res := &Bitmap{}
+	i, j := 0, 0
+	for i < len(b.keys) && j < len(o.keys) {
+		switch {
+		case b.keys[i] < o.keys[j]:
+			res.appendContainer(b.keys[i], b.containers[i].clone())
+			i++
+		case b.keys[i] > o.keys[j]:
+			res.appendContainer(o.keys[j], o.containers[j].clone())
+			j++
+		default:
+			res.appendContainer(b.keys[i], b.containers[i].or(o.containers[j]))
+			i++
+			j++
+		}
+	}
+	for ; i < len(b.keys); i++ {
+		res.appendContainer(b.keys[i], b.containers[i].clone())
+	}
+	for ; j < len(o.keys); j++ {
+		res.appendContainer(o.keys[j], o.containers[j].clone())
+	}
+	return res
+}
+
+// AndNot returns the IDs of b that are not in o
+func (b *Bitmap) AndNot(o *Bitmap) *Bitmap {
+	res := &Bitmap{}
+	if b == nil {
+		return res
+	}
+	j := 0
+	for i, key := range b.keys {
+		for o != nil && j < len(o.keys) && o.keys[j] < key {
+			j++
+		}
+		if o == nil || j == len(o.keys) || o.keys[j] != key {
+			res.appendContainer(key, b.containers[i].clone())
+			continue
+		}
+		res.appendContainer(key, b.containers[i].andNot(o.containers[j]))
+	}
+	return res
+}
+
+// String returns the IDs as a comma separated string
+func (b *Bitmap) String() string {
+	return FormatNodeList(b.ToArray())
+}
+
+// MarshalBinary encodes the Bitmap as the number of containers followed by each container's key, type and
+// values. Array containers are stored as delta encoded uvarints, bitset containers as 1024 little endian words.
+func (b *Bitmap) MarshalBinary() ([]byte, error) {
+	if b == nil {
+		return appendUvarint(nil, 0), nil
+	}
+	buf := appendUvarint(nil, uint64(len(b.keys)))
+	for i, c := range b.containers {
+		buf = appendUvarint(buf, uint64(b.keys[i]))
+		if c.bitset == nil {
+			buf = append(buf, arrayContainer)
+			buf = appendUvarint(buf, uint64(c.card))
+			prev := uint16(0)
+			for _, lo := range c.array {
+				buf = appendUvarint(buf, uint64(lo-prev))
+				prev = lo
+			}
+			continue
+		}
+		buf = append(buf, bitsetContainer)
+		var word [8]byte
+		for _, w := range c.bitset {
+			binary.LittleEndian.PutUint64(word[:], w)
+			buf = append(buf, word[:]...)
+		}
+	}
+	return buf, nil
+}
+
+// UnmarshalBinary decodes a Bitmap written by MarshalBinary
+func (b *Bitmap) UnmarshalBinary(data []byte) error {
+	b.keys, b.containers = nil, nil
+	r := &byteReader{buf: data}
+	n := r.uvarint()
+	for i := uint64(0); i < n && r.err == nil; i++ {
+		key := r.uvarint()
+		if key > 0xffff || len(b.keys) > 0 && uint16(key) <= b.keys[len(b.keys)-1] {
+			return errCorruptBitmap
+		}
+		c := &container{}
+		switch r.byte() {
+		case arrayContainer:
+			card := r.uvarint()
+			if card == 0 || card > arrayMaxSize {
+				return errCorruptBitmap
+			}
+			c.array = make([]uint16, card)
+			prev := uint64(0)
+			for k := range c.array {
+				delta := r.uvarint()
+				if k > 0 && delta == 0 || prev+delta > 0xffff {
+					return errCorruptBitmap
+				}
+				prev += delta
+				c.array[k] = uint16(prev)
+			}
+			c.card = int(card)
+		case bitsetContainer:
+			c.bitset = make([]uint64, bitsetWords)
+			for k := range c.bitset {
+				c.bitset[k] = r.uint64()
+				c.card += bits.OnesCount64(c.bitset[k])
+			}
+			if c.card == 0 {
+				return errCorruptBitmap
+			}
+			c.normalize()
+		default:
+			return errCorruptBitmap
+		}
+		b.keys = append(b.keys, uint16(key))
+		b.containers = append(b.containers, c)
+	}
+	if r.err != nil || r.pos != len(data) {
+		return errCorruptBitmap
+	}
+	return nil
+}
+
+////////////////////////////////////   Inner Functions   //////////////////////////////////////////////////
+
+var errCorruptBitmap = errors.New("corrupt bitmap")
+
+func (b *Bitmap) index(hi uint16) int {
+	return sort.Search(len(b.keys), func(i int) bool { return b.keys[i] >= hi })
+}
+
+// cloneFor returns a copy of the Bitmap that only copies the container of id and shares all others, so id can be
+// added to or removed from the copy while readers keep using the original
+func (b *Bitmap) cloneFor(id uint32) *Bitmap {
+	res := &Bitmap{}
+	if b == nil {
+		return res
+	}
+	res.keys = append([]uint16(nil), b.keys...)
+	res.containers = append([]*container(nil), b.containers...)
+	if i := res.index(uint16(id >> 16)); i < len(res.keys) && res.keys[i] == uint16(id>>16) {
+		res.containers[i] = res.containers[i].clone()
+	}
+	return res
+}
+
+// appendContainer adds a container with a key larger than all existing ones, skipping empty containers
+func (b *Bitmap) appendContainer(key uint16, c *container) {
+	if c.card == 0 {
+		return
+	}
+	b.keys = append(b.keys, key)
+	b.containers = append(b.containers, c)
+}
+
+func (c *container) add(lo uint16) bool {
+	if c.bitset != nil {
+		w, bit := lo/64, uint64(1)<<(lo%64)
+		if c.bitset[w]&bit != 0 {
+			return false
+		}
+		c.bitset[w] |= bit
+		c.card++
+		return true
+	}
+	i := sort.Search(len(c.array), func(i int) bool { return c.array[i] >= lo })
+	if i < len(c.array) && c.array[i] == lo {
+		return false
+	}
+	c.array = append(c.array, 0)
+	copy(c.array[i+1:], c.array[i:])
+	c.array[i] = lo
+	c.card++
+	if c.card > arrayMaxSize {
+		c.toBitset()
+	}
+	return true
+}
+
+func (c *container) remove(lo uint16) bool {
+	if c.bitset != nil {
+		w, bit := lo/64, uint64(1)<<(lo%64)
+		if c.bitset[w]&bit == 0 {
+			return false
+		}
+		c.bitset[w] &^= bit
+		c.card--
+		if c.card <= arrayMaxSize {
+			c.toArray()
+		}
+		return true
+	}
+	i := sort.Search(len(c.array), func(i int) bool { return c.array[i] >= lo })
+	if i == len(c.array) || c.array[i] != lo {
+		return false
+	}
+	c.array = append(c.array[:i], c.array[i+1:]...)
+	c.card--
+	return true
+}
+
+func (c *container) contains(lo uint16) bool {
+	if c.bitset != nil {
+		return c.bitset[lo/64]&(uint64(1)<<(lo%64)) != 0
+	}
+	i := sort.Search(len(c.array), func(i int) bool { return c.array[i] >= lo })
+	return i < len(c.array) && c.array[i] == lo
+}
+
+func (c *container) clone() *container {
+	return &container{
+		array:  append([]uint16(nil), c.array...),
+		bitset: append([]uint64(nil), c.bitset...),
+		card:   c.card,
+	}
+}
+
+func (c *container) and(o *container) *container {
+	switch {
+	case c.bitset == nil && o.bitset == nil:
+		res := &container{}
+		for i, j := 0, 0; i < len(c.array) && j < len(o.array); {
+			switch {
+			case c.array[i] < o.array[j]:
+				i++
+			case c.array[i] > o.array[j]:
+				j++
+			default:
+				res.array = append(res.array, c.array[i])
+				i++
+				j++
+			}
+		}
+		res.card = len(res.array)
+		return res
+	case c.bitset == nil:
+		return c.filter(o, true)
+	case o.bitset == nil:
+		return o.filter(c, true)
+	}
+	res := &container{bitset: make([]uint64, bitsetWords)}
+	for w := range res.bitset {
+		res.bitset[w] = c.bitset[w] & o.bitset[w]
+		res.card += bits.OnesCount64(res.bitset[w])
+	}
+	res.normalize()
+	return res
+}
+
+func (c *container) or(o *container) *container {
+	if c.bitset == nil && o.bitset == nil && c.card+o.card <= arrayMaxSize {
+		res := &container{array: make([]uint16, 0, c.card+o.card)}
+		i, j := 0, 0
+		for i < len(c.array) && j < len(o.array) {
+			switch {
+			case c.array[i] < o.array[j]:
+				res.array = append(res.array, c.array[i])
+				i++
+			case c.array[i] > o.array[j]:
+				res.array = append(res.array, o.array[j])
+				j++
+			default:
+				res.array = append(res.array, c.array[i])
+				i++
+				j++
+			}
+		}
+		res.array = append(res.array, c.array[i:]...)
+		res.array = append(res.array, o.array[j:]...)
+		res.card = len(res.array)
+		return res
+	}
+	res := c.clone()
+	res.toBitset()
+	if o.bitset == nil {
+		for _, lo := range o.array {
+			res.bitset[lo/64] |= uint64(1) << (lo % 64)
+		}
+	} else {
+		for w := range res.bitset {
+			res.bitset[w] |= o.bitset[w]
+		}
+	}
+	res.card = 0
+	for _, word := range res.bitset {
+		res.card += bits.OnesCount64(word)
+	}
+	res.normalize()
+	return res
+}
+
+func (c *container) andNot(o *container) *container {
+	if c.bitset == nil {
+		return c.filter(o, false)
+	}
+	res := c.clone()
+	if o.bitset == nil {
+		for _, lo := range o.array {
+			w, bit := lo/64, uint64(1)<<(lo%64)
+			if res.bitset[w]&bit != 0 {
+				res.bitset[w] &^= bit
+				res.card--
+			}
+		}
+	} else {
+		res.card = 0
+		for w := range res.bitset {
+			res.bitset[w] &^= o.bitset[w]
+			res.card += bits.OnesCount64(res.bitset[w])
+		}
+	}
+	res.normalize()
+	return res
+}
+
+// filter returns the values of the array container c that are (or are not) contained in o
+func (c *container) filter(o *container, keep bool) *container {
+	res := &container{}
+	for _, lo := range c.array {
+		if o.contains(lo) == keep {
+			res.array = append(res.array, lo)
+		}
+	}
+	res.card = len(res.array)
+	return res
+}
+
+// normalize converts a bitset container that got sparse back into an array container
+func (c *container) normalize() {
+	if c.bitset != nil && c.card <= arrayMaxSize {
+		c.toArray()
+	}
+}
+
+func (c *container) toBitset() {
+	if c.bitset != nil {
+		return
+	}
+	c.bitset = make([]uint64, bitsetWords)
+	for _, lo := range c.array {
+		c.bitset[lo/64] |= uint64(1) << (lo % 64)
+	}
+	c.array = nil
+}
+
+func (c *container) toArray() {
+	array := make([]uint16, 0, c.card)
+	for w, word := range c.bitset {
+		for word != 0 {
+			array = append(array, uint16(w*64+bits.TrailingZeros64(word)))
+			word &= word - 1
+		}
+	}
+	c.array, c.bitset = array, nil
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], v)
+	return append(buf, tmp[:n]...)
+}
+
+// byteReader reads uvarints, bytes and fixed size integers, remembering the first error
+type byteReader struct {
+	buf []byte
+	pos int
+	err error
+}
+
+var errShortBuffer = errors.New("unexpected end of data")
+
+func (r *byteReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.buf[r.pos:])
+	if n <= 0 {
+		r.err = errShortBuffer
+		return 0
+	}
+	r.pos += n
+	return v
+}
+
+func (r *byteReader) byte() byte {
+	if r.err != nil || r.pos >= len(r.buf) {
+		r.err = errShortBuffer
+		return 0
+	}
+	r.pos++
+	return r.buf[r.pos-1]
+}
+
+func (r *byteReader) bytes(n uint64) []byte {
+	if r.err != nil || n > uint64(len(r.buf)-r.pos) {
+		r.err = errShortBuffer
+		return nil
+	}
+	r.pos += int(n)
+	return r.buf[r.pos-int(n) : r.pos]
+}
+
+func (r *byteReader) uint64() uint64 {
+	if r.err != nil || r.pos+8 > len(r.buf) {
+		r.err = errShortBuffer
+		return 0
+	}
+	r.pos += 8
+	return binary.LittleEndian.Uint64(r.buf[r.pos-8:])
+}
@@ -3,7 +3,31 @@ package pkg
 const (
 	ZkAddr          = "localhost:2181"
 	TagNameTriePath = "/TagNameTrie"
-	EtcdHost1       = "localhost:2379"
-	EtcdHost2       = "localhost:22379"
-	EtcdHost3       = "localhost:32379"
+	// TagNameSuffixTriePath holds the suffixes of all tag names, see ZkClient.AddTagName
+	TagNameSuffixTriePath = "/TagNameSuffixTrie"
+	// SuffixTrieDepth is the number of characters of every suffix of a tag name kept in the suffix Tries
+	SuffixTrieDepth = 3
+	// TagNameRadixTriePath and TagNameRadixSuffixTriePath hold the path-compressed Tries, see RadixTrieLayout
+	TagNameRadixTriePath       = "/TagNameRadixTrie"
+	TagNameRadixSuffixTriePath = "/TagNameRadixSuffixTrie"
+	EtcdHost1                  = "localhost:2379"
+	EtcdHost2                  = "localhost:22379"
+	EtcdHost3                  = "localhost:32379"
+	// IndexKeyPrefix prefixes the etcd keys of the blob layout, see IndexKey
+	IndexKeyPrefix = "index/"
+	// PostingKeyPrefix prefixes the etcd keys of the per-value layout, see PostingKey
+	PostingKeyPrefix = "postings/"
+	// NodeKeyPrefix prefixes the etcd keys of the node registry, see NodeRegistry
+	NodeKeyPrefix = "nodes/"
+	// NodeTagsKeyPrefix prefixes the etcd keys of the reverse index from a node to its tags, see NodeTagsKey
+	NodeTagsKeyPrefix = "nodetags/"
+	// NamespacesPath holds the Zookeeper roots of all namespaces but the DefaultNamespace, see Namespace
+	NamespacesPath = "/Namespaces"
+	// NamespaceKeyPrefix prefixes the etcd keys of all namespaces but the DefaultNamespace, see Namespace
+	NamespaceKeyPrefix = "namespaces/"
+	// SearchWorkers bounds the goroutines a single wildcard search traverses the Trie with
+	SearchWorkers = 16
 )
+
+// ZkServers are the addresses of the Zookeeper ensemble in zk_stack.yml, the one of ZkAddr first
+var ZkServers = []string{ZkAddr, "localhost:2182", "localhost:2183"}
@@ -2,6 +2,9 @@ package pkg
 
 import (
 	"context"
+	"fmt"
+	"net/url"
+	"strings"
 	"time"
 
 	clientv3 "go.etcd.io/etcd/client/v3"
@@ -20,8 +23,13 @@ func CreateClient() (*clientv3.Client, error) {
 	return cli, err
 }
 
-// PutIndex stores tagName and index as key-value pair in etcd
+// PutIndex is Namespace.PutIndex in the DefaultNamespace
 func PutIndex(tagName string, index []byte) error {
+	return DefaultNamespace.PutIndex(tagName, index)
+}
+
+// PutIndex stores tagName and index as key-value pair in etcd
+func (ns Namespace) PutIndex(tagName string, index []byte) error {
 	cli, err := CreateClient()
 	if err != nil {
 		return err
@@ -29,15 +37,26 @@ func PutIndex(tagName string, index []byte) error {
 	defer cli.Close()
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
-	_, err = cli.Put(ctx, tagName, string(index))
+	_, err = cli.Put(ctx, ns.IndexKey(tagName), string(index))
 	if err != nil {
 		return err
 	}
 	return err
 }
 
-// GetIndex returns index bytes array with the specified tagName
+// GetIndex is Namespace.GetIndex in the DefaultNamespace
 func GetIndex(tagName string) ([]byte, error) {
+	return DefaultNamespace.GetIndex(tagName)
+}
+
+// GetIndex returns index bytes array with the specified tagName. An index put before IndexKeyPrefix existed is read
+// from the bare tag name until MigrateIndexKeys moved it.
+func (ns Namespace) GetIndex(tagName string) ([]byte, error) {
+	return ns.getIndex(tagName, 0)
+}
+
+// getIndex is GetIndex as of an etcd revision, the latest one if rev is 0
+func (ns Namespace) getIndex(tagName string, rev int64) ([]byte, error) {
 	cli, err := CreateClient()
 	if err != nil {
 		return nil, err
@@ -45,16 +64,59 @@ func GetIndex(tagName string) ([]byte, error) {
 	defer cli.Close()
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
-	resp, err := cli.Get(ctx, tagName)
+	resp, err := cli.Get(ctx, ns.IndexKey(tagName), clientv3.WithRev(rev))
 	if err != nil {
 		return nil, err
 	}
-	var res []byte
 	for _, ev := range resp.Kvs {
-		res = ev.Value
-		break
+		return ev.Value, nil
 	}
-	return res, nil
+	res, _, err := ns.legacyIndex(ctx, cli, tagName, rev)
+	return res, err
+}
+
+// IndexKey is Namespace.IndexKey in the DefaultNamespace
+func IndexKey(tagName string) string {
+	return DefaultNamespace.IndexKey(tagName)
+}
+
+// IndexKey returns the etcd key holding the index of tagName in the blob layout. The tag name is escaped like in
+// PostingKey, so the index of a tag name like nodes/next never collides with a key of another layout or the node
+// registry.
+func (ns Namespace) IndexKey(tagName string) string {
+	return ns.KeyPrefix() + IndexKeyPrefix + url.PathEscape(tagName)
+}
+
+// reservedKeyPrefixes are the prefixes of all etcd keys but the indexes stored at the bare tag name, in key order
+var reservedKeyPrefixes = []string{IndexKeyPrefix, NamespaceKeyPrefix, NodeKeyPrefix, NodeTagsKeyPrefix, PostingKeyPrefix}
+
+// MigrateIndexKeys moves the indexes of the blob layout that were stored at the bare tag name, before
+// IndexKeyPrefix existed, to their IndexKey and returns how many it moved. Until then GetIndex reads them where they
+// are. Only the DefaultNamespace has such keys. Keys below reservedKeyPrefixes are left alone, so the index of a tag
+// name starting with one of them, which cannot be told apart from their keys, is not moved, and so are values that
+// do not decode to a TagValueIndex, which other programs stored. An index that was put at its IndexKey meanwhile is
+// not overwritten.
+func MigrateIndexKeys() (moved int, err error) {
+	cli, err := CreateClient()
+	if err != nil {
+		return 0, err
+	}
+	defer cli.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	key := "\x00"
+	for _, prefix := range reservedKeyPrefixes {
+		n, err := migrateIndexKeyRange(ctx, cli, key, prefix)
+		moved += n
+		if err != nil {
+			return moved, err
+		}
+		key = clientv3.GetPrefixRangeEnd(prefix)
+	}
+	// a range end of "\x00" is the end of the keyspace
+	n, err := migrateIndexKeyRange(ctx, cli, key, "\x00")
+	return moved + n, err
 }
 
 // DeleteAll deletes all key-value pairs in etcd
@@ -66,9 +128,420 @@ func DeleteAll() error {
 	defer cli.Close()
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
-	_, err = cli.Delete(ctx, string(0), clientv3.WithRange(string(255)))
+	_, err = cli.Delete(ctx, "\x00", clientv3.WithFromKey())
 	if err != nil {
 		return err
 	}
 	return nil
 }
+
+// DeleteAllIndexes deletes all key-value pairs in etcd except the node registry, so the nodes keep their IDs. The
+// indexes of all namespaces are deleted, see Namespace.DeleteIndexes for a single one.
+func DeleteAllIndexes() error {
+	cli, err := CreateClient()
+	if err != nil {
+		return err
+	}
+	defer cli.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err = cli.Txn(ctx).Then(
+		clientv3.OpDelete("\x00", clientv3.WithRange(NodeKeyPrefix)),
+		clientv3.OpDelete(clientv3.GetPrefixRangeEnd(NodeKeyPrefix), clientv3.WithFromKey()),
+	).Commit()
+	return err
+}
+
+// DeleteIndexes deletes the indexes and the reverse index of the namespace, leaving the other namespaces and the
+// node registry alone
+func (ns Namespace) DeleteIndexes() error {
+	cli, err := CreateClient()
+	if err != nil {
+		return err
+	}
+	defer cli.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	ops := []clientv3.Op{clientv3.OpDelete(ns.KeyPrefix(), clientv3.WithPrefix())}
+	if ns == DefaultNamespace {
+		// the keys of the DefaultNamespace have no namespace prefix, and indexes that MigrateIndexKeys did not move
+		// are at the bare tag name, so everything around the other namespaces and the node registry is deleted,
+		// NamespaceKeyPrefix sorts before NodeKeyPrefix
+		ops = []clientv3.Op{
+			clientv3.OpDelete("\x00", clientv3.WithRange(NamespaceKeyPrefix)),
+			clientv3.OpDelete(clientv3.GetPrefixRangeEnd(NamespaceKeyPrefix), clientv3.WithRange(NodeKeyPrefix)),
+			clientv3.OpDelete(clientv3.GetPrefixRangeEnd(NodeKeyPrefix), clientv3.WithFromKey()),
+		}
+	}
+	_, err = cli.Txn(ctx).Then(ops...).Commit()
+	return err
+}
+
+// DeleteIndex is Namespace.DeleteIndex in the DefaultNamespace
+func DeleteIndex(tagName string) error {
+	return DefaultNamespace.DeleteIndex(tagName)
+}
+
+// DeleteIndex deletes the index of tagName in both layouts, and drops its tags from the reverse index of the nodes
+// it held
+func (ns Namespace) DeleteIndex(tagName string) error {
+	nodes, err := ns.indexNodes(tagName)
+	if err != nil {
+		return err
+	}
+
+	cli, err := CreateClient()
+	if err != nil {
+		return err
+	}
+	defer cli.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ops := []clientv3.Op{
+		clientv3.OpDelete(ns.IndexKey(tagName)),
+		clientv3.OpDelete(ns.PostingKey(tagName, ""), clientv3.WithPrefix()),
+	}
+	// an index GetIndex still reads from the bare tag name
+	legacy, _, err := ns.legacyIndex(ctx, cli, tagName, 0)
+	if err != nil {
+		return err
+	}
+	if legacy != nil {
+		ops = append(ops, clientv3.OpDelete(tagName))
+	}
+	_, err = cli.Txn(ctx).Then(ops...).Commit()
+	if err != nil {
+		return err
+	}
+
+	nodes.ForEach(func(node uint32) bool {
+		err = ns.removeNodeTagName(node, tagName)
+		return err == nil
+	})
+	return err
+}
+
+// postingTxnOps is the number of operations batched into one etcd transaction, etcd's default limit is 128
+const postingTxnOps = 128
+
+// postingPageSize is the number of keys fetched per request while scanning postings
+const postingPageSize = 1000
+
+// PostingKey is Namespace.PostingKey in the DefaultNamespace
+func PostingKey(tagName, tagValue string) string {
+	return DefaultNamespace.PostingKey(tagName, tagValue)
+}
+
+// PostingKey returns the etcd key holding the node list of a single tag value in the per-value layout. The tag
+// name is escaped so it never contains the '/' that separates it from the tag value, while the tag value is
+// kept as is, so that all values sharing a prefix are one contiguous key range.
+func (ns Namespace) PostingKey(tagName, tagValue string) string {
+	return ns.KeyPrefix() + PostingKeyPrefix + url.PathEscape(tagName) + "/" + tagValue
+}
+
+// PutIndexPostings is Namespace.PutIndexPostings in the DefaultNamespace
+func PutIndexPostings(tagName string, index *TagValueIndex) error {
+	return DefaultNamespace.PutIndexPostings(tagName, index)
+}
+
+// PutIndexPostings stores every tag value of index under its own key, replacing all postings of tagName.
+// Unlike PutIndex the postings are written in several transactions, so readers may see a partial index.
+func (ns Namespace) PutIndexPostings(tagName string, index *TagValueIndex) error {
+	cli, err := CreateClient()
+	if err != nil {
+		return err
+	}
+	defer cli.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	_, err = cli.Delete(ctx, ns.PostingKey(tagName, ""), clientv3.WithPrefix())
+	if err != nil {
+		return err
+	}
+
+	var ops []clientv3.Op
+	for _, nodePair := range (&Node{Tree: index.Snapshot()}).getAllSubNodeList() {
+		nodes, _ := nodePair.nodeList.MarshalBinary()
+		ops = append(ops, clientv3.OpPut(ns.PostingKey(tagName, nodePair.str), string(nodes)))
+		if len(ops) == postingTxnOps {
+			if _, err = cli.Txn(ctx).Then(ops...).Commit(); err != nil {
+				return err
+			}
+			ops = ops[:0]
+		}
+	}
+	if len(ops) > 0 {
+		_, err = cli.Txn(ctx).Then(ops...).Commit()
+	}
+	return err
+}
+
+// AddPosting is Namespace.AddPosting in the DefaultNamespace
+func AddPosting(tagName, tagValue string, node uint32) error {
+	return DefaultNamespace.AddPosting(tagName, tagValue, node)
+}
+
+// AddPosting adds a node to a single tag value. Only the key of that tag value is read and written, guarded by
+// a compare-and-swap on its revision so that concurrent writers never lose an update. The tag is added to the
+// reverse index of the node afterwards.
+func (ns Namespace) AddPosting(tagName, tagValue string, node uint32) error {
+	err := updatePosting(ns.PostingKey(tagName, tagValue), func(nodes *Bitmap) bool {
+		return nodes.Add(node)
+	})
+	if err != nil {
+		return err
+	}
+	return ns.addNodeTag(node, Tag{Name: tagName, Value: tagValue})
+}
+
+// RemovePosting is Namespace.RemovePosting in the DefaultNamespace
+func RemovePosting(tagName, tagValue string, node uint32) error {
+	return DefaultNamespace.RemovePosting(tagName, tagValue, node)
+}
+
+// RemovePosting removes a node from a single tag value and deletes the key once no node is left. The tag is
+// removed from the reverse index of the node as well.
+func (ns Namespace) RemovePosting(tagName, tagValue string, node uint32) error {
+	err := updatePosting(ns.PostingKey(tagName, tagValue), func(nodes *Bitmap) bool {
+		return nodes.Remove(node)
+	})
+	if err != nil {
+		return err
+	}
+	return ns.removeNodeTag(node, Tag{Name: tagName, Value: tagValue})
+}
+
+// RemoveNodePostings is Namespace.RemoveNodePostings in the DefaultNamespace
+func RemoveNodePostings(node uint32) error {
+	return DefaultNamespace.RemoveNodePostings(node)
+}
+
+// RemoveNodePostings removes a node from the postings of all its tags, which are looked up in the reverse index,
+// and then drops the node from the reverse index.
+func (ns Namespace) RemoveNodePostings(node uint32) error {
+	tags, err := ns.GetNodeTags(node)
+	if err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		err := updatePosting(ns.PostingKey(tag.Name, tag.Value), func(nodes *Bitmap) bool {
+			return nodes.Remove(node)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return ns.DeleteNodeTags(node)
+}
+
+// GetPostings is Namespace.GetPostings in the DefaultNamespace
+func GetPostings(tagName, tagValuePrefix string) (*TagValueIndex, error) {
+	return DefaultNamespace.GetPostings(tagName, tagValuePrefix)
+}
+
+// GetPostings returns a TagValueIndex holding the tag values of tagName that start with tagValuePrefix, read
+// with range scans over the per-value layout. An empty prefix returns all tag values.
+func (ns Namespace) GetPostings(tagName, tagValuePrefix string) (*TagValueIndex, error) {
+	return ns.getPostings(tagName, tagValuePrefix, 0)
+}
+
+// getPostings is GetPostings as of an etcd revision, the latest one if rev is 0
+func (ns Namespace) getPostings(tagName, tagValuePrefix string, rev int64) (*TagValueIndex, error) {
+	cli, err := CreateClient()
+	if err != nil {
+		return nil, err
+	}
+	defer cli.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	tagKey := ns.PostingKey(tagName, "")
+	key, end := ns.PostingKey(tagName, tagValuePrefix), clientv3.GetPrefixRangeEnd(ns.PostingKey(tagName, tagValuePrefix))
+	index := NewTagValueIndex()
+	for {
+		resp, err := cli.Get(ctx, key, clientv3.WithRange(end), clientv3.WithLimit(postingPageSize), clientv3.WithRev(rev))
+		if err != nil {
+			return nil, err
+		}
+		for _, ev := range resp.Kvs {
+			nodes := NewBitmap()
+			if err := nodes.UnmarshalBinary(ev.Value); err != nil {
+				return nil, fmt.Errorf("posting %q: %w", ev.Key, err)
+			}
+			index.putNodeList(string(ev.Key[len(tagKey):]), nodes)
+		}
+		if !resp.More || len(resp.Kvs) == 0 {
+			return index, nil
+		}
+		key = string(resp.Kvs[len(resp.Kvs)-1].Key) + "\x00"
+	}
+}
+
+// rangeVersion returns the highest ModRevision of the keys in [key, end), or of key alone if end is empty, and how
+// many keys there are, as of the revision it returns too. The pair changes whenever the range does: a key put
+// meanwhile raises the highest ModRevision unless it is deleted again, and a range left with only keys that were
+// not put has fewer keys once one was deleted.
+func rangeVersion(key, end string) (modRevision, count, rev int64, err error) {
+	cli, err := CreateClient()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	defer cli.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	opts := []clientv3.OpOption{
+		clientv3.WithSort(clientv3.SortByModRevision, clientv3.SortDescend), clientv3.WithLimit(1), clientv3.WithKeysOnly(),
+	}
+	if end != "" {
+		opts = append(opts, clientv3.WithRange(end))
+	}
+	resp, err := cli.Get(ctx, key, opts...)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	for _, ev := range resp.Kvs {
+		modRevision = ev.ModRevision
+	}
+	return modRevision, resp.Count, resp.Header.Revision, nil
+}
+
+// updatePosting runs a read-modify-write of a single posting key until the compare-and-swap succeeds
+func updatePosting(key string, update func(nodes *Bitmap) bool) error {
+	cli, err := CreateClient()
+	if err != nil {
+		return err
+	}
+	defer cli.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for {
+		resp, err := cli.Get(ctx, key)
+		if err != nil {
+			return err
+		}
+		nodes, revision := NewBitmap(), int64(0)
+		for _, ev := range resp.Kvs {
+			if err := nodes.UnmarshalBinary(ev.Value); err != nil {
+				return fmt.Errorf("posting %q: %w", key, err)
+			}
+			revision = ev.ModRevision
+		}
+		if !update(nodes) {
+			return nil
+		}
+
+		op := clientv3.OpDelete(key)
+		if !nodes.IsEmpty() {
+			value, _ := nodes.MarshalBinary()
+			op = clientv3.OpPut(key, string(value))
+		}
+		// a missing key has a ModRevision of 0
+		txn, err := cli.Txn(ctx).If(clientv3.Compare(clientv3.ModRevision(key), "=", revision)).Then(op).Commit()
+		if err != nil {
+			return err
+		}
+		if txn.Succeeded {
+			return nil
+		}
+	}
+}
+
+// migrateIndexKeyRange moves the indexes stored at the bare tag names in [key, end) to their IndexKey, a page at a
+// time. A value that is not a TagValueIndex, or a key changed since it was read or whose IndexKey exists, is skipped.
+func migrateIndexKeyRange(ctx context.Context, cli *clientv3.Client, key, end string) (moved int, err error) {
+	for {
+		resp, err := cli.Get(ctx, key, clientv3.WithRange(end), clientv3.WithLimit(postingPageSize))
+		if err != nil {
+			return moved, err
+		}
+		for _, ev := range resp.Kvs {
+			if _, err := DecodeBytesToTagValueIndex(ev.Value); err != nil {
+				continue
+			}
+			tagName := string(ev.Key)
+			txn, err := cli.Txn(ctx).If(
+				clientv3.Compare(clientv3.ModRevision(tagName), "=", ev.ModRevision),
+				clientv3.Compare(clientv3.CreateRevision(IndexKey(tagName)), "=", 0),
+			).Then(
+				clientv3.OpPut(IndexKey(tagName), string(ev.Value)),
+				clientv3.OpDelete(tagName),
+			).Commit()
+			if err != nil {
+				return moved, err
+			}
+			if txn.Succeeded {
+				moved++
+			}
+		}
+		if !resp.More || len(resp.Kvs) == 0 {
+			return moved, nil
+		}
+		key = string(resp.Kvs[len(resp.Kvs)-1].Key) + "\x00"
+	}
+}
+
+// legacyIndexKey returns the key the index of tagName had before IndexKeyPrefix existed, which is the bare tag name
+// in the DefaultNamespace, unless the tag name starts with one of reservedKeyPrefixes
+func (ns Namespace) legacyIndexKey(tagName string) (string, bool) {
+	if ns != DefaultNamespace || tagName == "" {
+		return "", false
+	}
+	for _, prefix := range reservedKeyPrefixes {
+		if strings.HasPrefix(tagName, prefix) {
+			return "", false
+		}
+	}
+	return tagName, true
+}
+
+// legacyIndex returns the index at the legacyIndexKey of tagName as of an etcd revision, the latest one if rev is 0,
+// and its ModRevision. A value there that does not decode to a TagValueIndex was stored by another program and is
+// ignored.
+func (ns Namespace) legacyIndex(ctx context.Context, cli *clientv3.Client, tagName string, rev int64) ([]byte, int64, error) {
+	key, ok := ns.legacyIndexKey(tagName)
+	if !ok {
+		return nil, 0, nil
+	}
+	resp, err := cli.Get(ctx, key, clientv3.WithRev(rev))
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, ev := range resp.Kvs {
+		if _, err := DecodeBytesToTagValueIndex(ev.Value); err == nil {
+			return ev.Value, ev.ModRevision, nil
+		}
+	}
+	return nil, 0, nil
+}
+
+// indexNodes returns all nodes in the index of tagName, of both layouts
+func (ns Namespace) indexNodes(tagName string) (*Bitmap, error) {
+	nodes := NewBitmap()
+	postings, err := ns.GetPostings(tagName, "")
+	if err != nil {
+		return nil, err
+	}
+	data, err := ns.GetIndex(tagName)
+	if err != nil {
+		return nil, err
+	}
+	indexes := []*TagValueIndex{postings}
+	if data != nil {
+		index, err := DecodeBytesToTagValueIndex(data)
+		if err != nil {
+			return nil, err
+		}
+		indexes = append(indexes, index)
+	}
+
+	for _, index := range indexes {
+		for _, nodePair := range (&Node{Tree: index.Snapshot()}).getAllSubNodeList() {
+			nodes = nodes.Or(nodePair.nodeList)
+		}
+	}
+	return nodes, nil
+}
@@ -0,0 +1,75 @@
+package pkg
+
+import (
+	"unicode/utf8"
+)
+
+// DefaultFuzzyDistance is the maximum edit distance of a fuzzy search that does not give one
+const DefaultFuzzyDistance = 2
+
+// fuzzyMatcher matches the strings within a maximum Levenshtein distance of a term, counted in characters. A state
+// is the last row of the edit distance table between the term and the consumed string, so a branch of a trie is
+// pruned as soon as every entry of the row exceeds the maximum distance.
+type fuzzyMatcher struct {
+	term        []rune
+	maxDistance int
+}
+
+// fuzzyState is immutable, so the same state can be stepped into all children of a trie node
+type fuzzyState struct {
+	row     []int  // row[i] is the edit distance between the first i characters of the term and the consumed string
+	pending string // bytes of an incomplete UTF-8 encoded character
+}
+
+func newFuzzyMatcher(term string, maxDistance int) *fuzzyMatcher {
+	return &fuzzyMatcher{term: []rune(term), maxDistance: maxDistance}
+}
+
+func (m *fuzzyMatcher) start() matchState {
+	row := make([]int, len(m.term)+1)
+	for i := range row {
+		row[i] = i
+	}
+	return &fuzzyState{row: row}
+}
+
+func (m *fuzzyMatcher) step(state matchState, c byte) matchState {
+	s := state.(*fuzzyState)
+	pending := s.pending + string([]byte{c})
+	if !utf8.FullRuneInString(pending) {
+		return &fuzzyState{row: s.row, pending: pending}
+	}
+	r, _ := utf8.DecodeRuneInString(pending)
+
+	row := make([]int, len(s.row))
+	row[0] = s.row[0] + 1
+	best := row[0]
+	for i := 1; i < len(row); i++ {
+		cost := 1
+		if m.term[i-1] == r {
+			cost = 0
+		}
+		row[i] = minInt(minInt(s.row[i]+1, row[i-1]+1), s.row[i-1]+cost)
+		best = minInt(best, row[i])
+	}
+	if best > m.maxDistance {
+		return nil
+	}
+	return &fuzzyState{row: row}
+}
+
+func (m *fuzzyMatcher) accepts(state matchState) bool {
+	s := state.(*fuzzyState)
+	return s.pending == "" && s.row[len(s.row)-1] <= m.maxDistance
+}
+
+// distance returns the edit distance between the term and str
+func (m *fuzzyMatcher) distance(str string) int {
+	unbounded := &fuzzyMatcher{term: m.term, maxDistance: len(m.term) + len(str)}
+	state := unbounded.start()
+	for i := 0; i < len(str); i++ {
+		state = unbounded.step(state, str[i])
+	}
+	row := state.(*fuzzyState).row
+	return row[len(row)-1]
+}
@@ -0,0 +1,184 @@
+package pkg
+
+// globMatcher runs a pattern with *-wildcards and ?-wildcards as a set of pattern positions, so a Tree can be
+// walked one byte at a time without backtracking and every branch that cannot match is pruned early. A ?-wildcard
+// matches a whole UTF-8 character: while it consumes the continuation bytes of a multi-byte character the state
+// holds a pending position, see pendingPosition.
+type globMatcher struct {
+	pattern string
+}
+
+func newGlobMatcher(pattern string) *globMatcher {
+	return &globMatcher{pattern: pattern}
+}
+
+// literalPrefix returns the part of the pattern before its first wildcard. Every match starts with it.
+func (g *globMatcher) literalPrefix() string {
+	for i := 0; i < len(g.pattern); i++ {
+		if g.pattern[i] == ASTERISK_WILDCARD || g.pattern[i] == DOT_WILDCARD {
+			return g.pattern[:i]
+		}
+	}
+	return g.pattern
+}
+
+// suffixChunk picks the literal part of a pattern that starts with a wildcard to look up in a suffix index.
+// If the pattern ends with a literal part, that part is returned with anchored set, since every match must end
+// with it. Otherwise the longest literal part is returned, every match must contain it. An empty chunk means the
+// pattern has a literal prefix or no literal part at all, so the suffix index does not help.
+func (g *globMatcher) suffixChunk() (chunk string, anchored bool) {
+	if g.literalPrefix() != "" {
+		return "", false
+	}
+	start := 0
+	for i := 0; i <= len(g.pattern); i++ {
+		if i < len(g.pattern) && g.pattern[i] != ASTERISK_WILDCARD && g.pattern[i] != DOT_WILDCARD {
+			continue
+		}
+		if i == len(g.pattern) && start < i {
+			return g.pattern[start:], true
+		}
+		if i-start > len(chunk) {
+			chunk = g.pattern[start:i]
+		}
+		start = i + 1
+	}
+	return chunk, false
+}
+
+// start returns the positions reachable before any character is consumed.
+func (g *globMatcher) start() []int {
+	return g.closure(nil, 0)
+}
+
+// step consumes one byte and returns the positions reachable afterwards. An empty result means no string with the
+// consumed prefix can match.
+func (g *globMatcher) step(state []int, c byte) (next []int) {
+	for _, p := range state {
+		if p < 0 {
+			// a ?-wildcard in the middle of a character only consumes its continuation bytes
+			p, k := decodePendingPosition(p)
+			switch {
+			case c&0xC0 != 0x80:
+			case k == 1:
+				next = g.closure(next, p)
+			default:
+				next = insertPosition(next, pendingPosition(p, k-1))
+			}
+			continue
+		}
+		if p == len(g.pattern) {
+			continue
+		}
+		switch g.pattern[p] {
+		case ASTERISK_WILDCARD:
+			next = g.closure(next, p)
+		case DOT_WILDCARD:
+			if k := continuationBytes(c); k > 0 {
+				next = insertPosition(next, pendingPosition(p+1, k))
+			} else {
+				next = g.closure(next, p+1)
+			}
+		default:
+			if g.pattern[p] == c {
+				next = g.closure(next, p+1)
+			}
+		}
+	}
+	return next
+}
+
+// accepts reports whether the consumed string matches the whole pattern.
+func (g *globMatcher) accepts(state []int) bool {
+	return len(state) > 0 && state[len(state)-1] == len(g.pattern)
+}
+
+// matches reports whether s matches the whole pattern.
+func (g *globMatcher) matches(s string) bool {
+	state := g.start()
+	for i := 0; i < len(s) && len(state) > 0; i++ {
+		state = g.step(state, s[i])
+	}
+	return g.accepts(state)
+}
+
+// acceptsAll reports whether every extension of the consumed string matches, i.e. the rest of the pattern is
+// only *-wildcards.
+func (g *globMatcher) acceptsAll(state []int) bool {
+	for _, p := range state {
+		if p >= 0 && p < len(g.pattern) && g.onlyAsterisks(p) {
+			return true
+		}
+	}
+	return false
+}
+
+// literal returns the only character that can be consumed next, if the state allows exactly one.
+func (g *globMatcher) literal(state []int) (byte, bool) {
+	if len(state) != 1 || state[0] < 0 || state[0] == len(g.pattern) {
+		return 0, false
+	}
+	c := g.pattern[state[0]]
+	return c, c != ASTERISK_WILDCARD && c != DOT_WILDCARD
+}
+
+func (g *globMatcher) onlyAsterisks(p int) bool {
+	for ; p < len(g.pattern); p++ {
+		if g.pattern[p] != ASTERISK_WILDCARD {
+			return false
+		}
+	}
+	return true
+}
+
+// closure adds p to the sorted state, plus every position behind a run of *-wildcards starting at p,
+// since a *-wildcard may match zero characters.
+func (g *globMatcher) closure(state []int, p int) []int {
+	for {
+		state = insertPosition(state, p)
+		if p == len(g.pattern) || g.pattern[p] != ASTERISK_WILDCARD {
+			return state
+		}
+		p++
+	}
+}
+
+func insertPosition(state []int, p int) []int {
+	i := 0
+	for i < len(state) && state[i] < p {
+		i++
+	}
+	if i < len(state) && state[i] == p {
+		return state
+	}
+	state = append(state, 0)
+	copy(state[i+1:], state[i:])
+	state[i] = p
+	return state
+}
+
+// pendingPosition encodes the position behind a ?-wildcard that still has to consume k continuation bytes as a
+// negative number, so it sorts before every pattern position and is never mistaken for the accepting one
+func pendingPosition(p, k int) int {
+	return -(p*4 + k) - 1
+}
+
+func decodePendingPosition(pending int) (p, k int) {
+	v := -pending - 1
+	return v / 4, v % 4
+}
+
+// continuationBytes returns the number of continuation bytes that follow c if it starts a multi-byte UTF-8
+// character. A byte that cannot start one, like an ASCII character or a stray continuation byte, is a character of
+// its own.
+func continuationBytes(c byte) int {
+	switch {
+	case c&0xE0 == 0xC0:
+		return 1
+	case c&0xF0 == 0xE0:
+		return 2
+	case c&0xF8 == 0xF0:
+		return 3
+	}
+	return 0
+}
@@ -0,0 +1,175 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/crc32"
+)
+
+// Binary format of an encoded TagValueIndex, all integers are uvarints unless noted otherwise:
+//
+//	magic    4 bytes "DMIX"
+//	version  1 byte, currently 1
+//	root     node
+//	checksum 4 bytes big endian CRC-32C (Castagnoli) of everything before it
+//
+// A node is written depth-first as
+//
+//	flags    1 byte, bit 0 is set if the node ends a tag value
+//	nodes    only if the node ends a tag value: length, then the Bitmap of its NodeList. Sparse containers
+//	         are delta encoded uvarints, dense ones are bitsets (see Bitmap.MarshalBinary)
+//	count    number of SubNodes, followed by each SubNode as length, Str and its node
+//
+// Tag values are not stored, they are rebuilt from the Str of the SubNodes on the path from the root.
+const (
+	indexMagic         = "DMIX"
+	indexFormatVersion = 1
+	indexFlagIsEnd     = 1 << 0
+)
+
+var (
+	// ErrCorruptIndex is returned for blobs that are truncated, fail the checksum or are otherwise malformed
+	ErrCorruptIndex = errors.New("corrupt TagValueIndex blob")
+	// ErrUnsupportedIndexVersion is returned for blobs written by a newer version of the format
+	ErrUnsupportedIndexVersion = errors.New("unsupported TagValueIndex format version")
+)
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// EncodeTagValueIndexToBytes convert a TagValueIndex to byte array in the binary format described above
+func EncodeTagValueIndexToBytes(t *TagValueIndex) []byte {
+	buf := append([]byte(indexMagic), indexFormatVersion)
+	buf = t.Snapshot().appendNode(buf)
+	var checksum [4]byte
+	binary.BigEndian.PutUint32(checksum[:], crc32.Checksum(buf, castagnoliTable))
+	return append(buf, checksum[:]...)
+}
+
+// DecodeBytesToTagValueIndex convert byte array to a TagValueIndex. Blobs without the magic header are decoded
+// as the gob encoding used before the binary format existed.
+func DecodeBytesToTagValueIndex(s []byte) (*TagValueIndex, error) {
+	if !bytes.HasPrefix(s, []byte(indexMagic)) {
+		return decodeGobTagValueIndex(s)
+	}
+	if len(s) < len(indexMagic)+1+4 {
+		return nil, fmt.Errorf("%w: blob of %d bytes is too short", ErrCorruptIndex, len(s))
+	}
+	body, checksum := s[:len(s)-4], binary.BigEndian.Uint32(s[len(s)-4:])
+	if version := body[len(indexMagic)]; version != indexFormatVersion {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedIndexVersion, version)
+	}
+	if crc32.Checksum(body, castagnoliTable) != checksum {
+		return nil, fmt.Errorf("%w: checksum mismatch", ErrCorruptIndex)
+	}
+
+	r := &byteReader{buf: body, pos: len(indexMagic) + 1}
+	t, err := readNode(r, "")
+	if err != nil {
+		return nil, err
+	}
+	if r.pos != len(body) {
+		return nil, fmt.Errorf("%w: %d trailing bytes", ErrCorruptIndex, len(body)-r.pos)
+	}
+	return t.newLive(), nil
+}
+
+////////////////////////////////////   Inner Functions   //////////////////////////////////////////////////
+
+func (t *TagValueIndex) appendNode(buf []byte) []byte {
+	if !t.IsEnd {
+		buf = append(buf, 0)
+	} else {
+		buf = append(buf, indexFlagIsEnd)
+		nodes, _ := t.NodeList.MarshalBinary()
+		buf = appendUvarint(buf, uint64(len(nodes)))
+		buf = append(buf, nodes...)
+	}
+	buf = appendUvarint(buf, uint64(len(t.SubNodes)))
+	for _, sub_node := range t.SubNodes {
+		buf = appendUvarint(buf, uint64(len(sub_node.Str)))
+		buf = append(buf, sub_node.Str...)
+		buf = sub_node.Tree.appendNode(buf)
+	}
+	return buf
+}
+
+// readNode decodes the node of the tag value prefix data, checking the invariants the prefix Tree relies on
+func readNode(r *byteReader, data string) (*TagValueIndex, error) {
+	t := &TagValueIndex{}
+	flags := r.byte()
+	if flags&^indexFlagIsEnd != 0 {
+		return nil, fmt.Errorf("%w: unknown flags %#x", ErrCorruptIndex, flags)
+	}
+	if flags&indexFlagIsEnd != 0 {
+		t.IsEnd, t.Data = true, data
+		t.NodeList = NewBitmap()
+		if err := t.NodeList.UnmarshalBinary(r.bytes(r.uvarint())); err != nil || r.err != nil {
+			return nil, fmt.Errorf("%w: node list of %q", ErrCorruptIndex, data)
+		}
+	}
+
+	count := r.uvarint()
+	for i := uint64(0); i < count && r.err == nil; i++ {
+		str := string(r.bytes(r.uvarint()))
+		if r.err != nil {
+			break
+		}
+		if len(str) == 0 || len(t.SubNodes) > 0 && t.SubNodes[len(t.SubNodes)-1].Str[0] >= str[0] {
+			return nil, fmt.Errorf("%w: SubNodes of %q are not sorted", ErrCorruptIndex, data)
+		}
+		subtree, err := readNode(r, data+str)
+		if err != nil {
+			return nil, err
+		}
+		t.SubNodes = append(t.SubNodes, Node{Str: str, Tree: subtree})
+	}
+	if r.err != nil {
+		return nil, fmt.Errorf("%w: unexpected end of blob", ErrCorruptIndex)
+	}
+	t.recount()
+	return t, nil
+}
+
+// decodeGobTagValueIndex decodes the gob blobs written before the binary format, whose NodeList is either a
+// Bitmap or, for even older blobs, a plain []uint32.
+func decodeGobTagValueIndex(s []byte) (*TagValueIndex, error) {
+	p := &TagValueIndex{}
+	err := gob.NewDecoder(bytes.NewReader(s)).Decode(p)
+	if err == nil {
+		p.recountAll()
+		return p.newLive(), nil
+	}
+	legacy := legacyTagValueIndex{}
+	if gob.NewDecoder(bytes.NewReader(s)).Decode(&legacy) != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorruptIndex, err)
+	}
+	return legacy.toTagValueIndex().newLive(), nil
+}
+
+// legacyTagValueIndex is the gob layout of a TagValueIndex whose NodeList is a plain []uint32
+type legacyTagValueIndex struct {
+	SubNodes []legacyNode
+	NodeList []uint32
+	Data     string
+	IsEnd    bool
+}
+
+type legacyNode struct {
+	Str  string
+	Tree *legacyTagValueIndex
+}
+
+func (l *legacyTagValueIndex) toTagValueIndex() *TagValueIndex {
+	t := &TagValueIndex{Data: l.Data, IsEnd: l.IsEnd}
+	if len(l.NodeList) > 0 {
+		t.NodeList = NewBitmap(l.NodeList...)
+	}
+	for _, n := range l.SubNodes {
+		t.SubNodes = append(t.SubNodes, Node{Str: n.Str, Tree: n.Tree.toTagValueIndex()})
+	}
+	t.recount()
+	return t
+}
@@ -0,0 +1,183 @@
+package pkg
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// IndexSource gives queries access to the tag names and to the TagValueIndex of every tag name.
+type IndexSource interface {
+	// SearchTagName returns all tag names matching the *-wildcard and ?-wildcard pattern.
+	SearchTagName(pattern string) ([]string, error)
+	// SearchTagNameRegexp returns all tag names fully matching the regular expression in RE2 syntax.
+	SearchTagNameRegexp(expr string) ([]string, error)
+	// SearchTagNameFuzzy returns all tag names within an edit distance of tagName, ordered by distance.
+	SearchTagNameFuzzy(tagName string, maxDistance int) ([]FuzzyTagName, error)
+	// GetTagValueIndex returns the TagValueIndex of a tag name, or an empty one if the tag name is unknown.
+	// The index must hold at least the tag values starting with tagValuePrefix, sources that can read
+	// a part of the index use the prefix to skip the rest.
+	GetTagValueIndex(tagName, tagValuePrefix string) (*TagValueIndex, error)
+}
+
+// EtcdIndexSource searches tag names in the Zookeeper trie and loads each TagValueIndex as a single blob from etcd,
+// both in the namespace of the client. A decoded TagValueIndex is kept until its blob changes, so the suffix and
+// numeric indexes built on it by one query serve the next ones as well.
+type EtcdIndexSource struct {
+	zkClient *ZkClient
+	cache    indexCache
+}
+
+// NewEtcdIndexSource returns an IndexSource backed by Zookeeper and etcd
+func NewEtcdIndexSource(zkClient *ZkClient) *EtcdIndexSource {
+	return &EtcdIndexSource{zkClient: zkClient}
+}
+
+func (s *EtcdIndexSource) SearchTagName(pattern string) ([]string, error) {
+	return s.zkClient.SearchTagName(pattern)
+}
+
+func (s *EtcdIndexSource) SearchTagNameRegexp(expr string) ([]string, error) {
+	return s.zkClient.SearchTagNameRegexp(expr)
+}
+
+func (s *EtcdIndexSource) SearchTagNameFuzzy(tagName string, maxDistance int) ([]FuzzyTagName, error) {
+	return s.zkClient.SearchTagNameFuzzy(tagName, maxDistance)
+}
+
+func (s *EtcdIndexSource) GetTagValueIndex(tagName, tagValuePrefix string) (*TagValueIndex, error) {
+	ns := s.zkClient.Namespace()
+	return s.cache.get(ns.IndexKey(tagName), "", func(rev int64) (*TagValueIndex, error) {
+		treeb, err := ns.getIndex(tagName, rev)
+		if err != nil {
+			return nil, err
+		}
+		if treeb == nil {
+			return NewTagValueIndex(), nil
+		}
+		// convert bytes to TagValueIndex
+		return DecodeBytesToTagValueIndex(treeb)
+	})
+}
+
+// EtcdPostingSource searches tag names in the Zookeeper trie and reads the tag values from the per-value layout
+// of etcd, so a tag value prefix becomes a range scan instead of a read of the whole index. The TagValueIndex of a
+// range is kept until a key in the range changes, like in EtcdIndexSource.
+type EtcdPostingSource struct {
+	zkClient *ZkClient
+	cache    indexCache
+}
+
+// NewEtcdPostingSource returns an IndexSource backed by Zookeeper and the per-value layout of etcd
+func NewEtcdPostingSource(zkClient *ZkClient) *EtcdPostingSource {
+	return &EtcdPostingSource{zkClient: zkClient}
+}
+
+func (s *EtcdPostingSource) SearchTagName(pattern string) ([]string, error) {
+	return s.zkClient.SearchTagName(pattern)
+}
+
+func (s *EtcdPostingSource) SearchTagNameRegexp(expr string) ([]string, error) {
+	return s.zkClient.SearchTagNameRegexp(expr)
+}
+
+func (s *EtcdPostingSource) SearchTagNameFuzzy(tagName string, maxDistance int) ([]FuzzyTagName, error) {
+	return s.zkClient.SearchTagNameFuzzy(tagName, maxDistance)
+}
+
+func (s *EtcdPostingSource) GetTagValueIndex(tagName, tagValuePrefix string) (*TagValueIndex, error) {
+	ns := s.zkClient.Namespace()
+	key := ns.PostingKey(tagName, tagValuePrefix)
+	return s.cache.get(key, clientv3.GetPrefixRangeEnd(key), func(rev int64) (*TagValueIndex, error) {
+		return ns.getPostings(tagName, tagValuePrefix, rev)
+	})
+}
+
+// indexCache keeps the TagValueIndex loaded from a range of etcd keys, with the derived indexes searches built on
+// it, for as long as no key in the range changes. A lookup checks the range with one request that returns no values,
+// see rangeVersion. An empty range is not kept, its index is empty or still at the bare tag name, see GetIndex.
+// Entries are never evicted, a source holds at most the indexes of the tag names it was asked for.
+type indexCache struct {
+	mu      sync.Mutex
+	entries map[string]cachedIndex
+}
+
+type cachedIndex struct {
+	modRevision, count int64
+	index              *TagValueIndex
+}
+
+// get returns the index of the range [key, end), or of key alone if end is empty. An index that is missing or whose
+// range changed is loaded as of the revision the range was checked at, so the entry never claims a newer state
+// than the one it holds.
+func (c *indexCache) get(key, end string, load func(rev int64) (*TagValueIndex, error)) (*TagValueIndex, error) {
+	modRevision, count, rev, err := rangeVersion(key, end)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	c.mu.Unlock()
+	if ok && entry.modRevision == modRevision && entry.count == count {
+		return entry.index, nil
+	}
+
+	index, err := load(rev)
+	if err != nil {
+		return nil, err
+	}
+	if count == 0 {
+		return index, nil
+	}
+	c.mu.Lock()
+	if c.entries == nil {
+		c.entries = make(map[string]cachedIndex)
+	}
+	c.entries[key] = cachedIndex{modRevision: modRevision, count: count, index: index}
+	c.mu.Unlock()
+	return index, nil
+}
+
+// MapIndexSource is an in-memory IndexSource, e.g. for indexes that are still being built.
+type MapIndexSource map[string]*TagValueIndex
+
+func (m MapIndexSource) SearchTagName(pattern string) (results []string, err error) {
+	return m.searchTagName(newGlobMatcher(pattern).matches), nil
+}
+
+func (m MapIndexSource) SearchTagNameRegexp(expr string) (results []string, err error) {
+	re, err := newRegexpMatcher(expr)
+	if err != nil {
+		return nil, err
+	}
+	return m.searchTagName(re.matches), nil
+}
+
+func (m MapIndexSource) SearchTagNameFuzzy(tagName string, maxDistance int) ([]FuzzyTagName, error) {
+	if maxDistance < 0 {
+		return nil, fmt.Errorf("negative edit distance %d", maxDistance)
+	}
+	fuzzy := newFuzzyMatcher(tagName, maxDistance)
+	return fuzzyTagNames(fuzzy, m.searchTagName(func(s string) bool {
+		return fuzzy.distance(s) <= maxDistance
+	})), nil
+}
+
+func (m MapIndexSource) GetTagValueIndex(tagName, tagValuePrefix string) (*TagValueIndex, error) {
+	if tree, ok := m[tagName]; ok {
+		return tree, nil
+	}
+	return NewTagValueIndex(), nil
+}
+
+func (m MapIndexSource) searchTagName(matches func(string) bool) (results []string) {
+	for tagName := range m {
+		if matches(tagName) {
+			results = append(results, tagName)
+		}
+	}
+	sort.Strings(results)
+	return results
+}
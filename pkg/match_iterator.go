@@ -0,0 +1,143 @@
+package pkg
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+)
+
+// ErrInvalidCursor is returned for a cursor that was not returned by a MatchIterator
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// cursorVersion starts every cursor, so even the cursor after the empty tag value is not empty
+const cursorVersion = 1
+
+// MatchIterator streams the tag values matching a pattern in lexicographical order. It walks the prefix Tree with
+// an explicit stack, so only the path to the current tag value is held in memory, however many tag values match.
+// It iterates over a Snapshot, so modifications of the prefix Tree while it is iterated are not visible.
+type MatchIterator struct {
+	m        matcher
+	after    string // the last returned tag value, only greater ones are returned if hasAfter is set
+	hasAfter bool
+	stack    []matchFrame
+}
+
+// matchFrame is a Tree Node on the path to the current tag value
+type matchFrame struct {
+	tree   *TagValueIndex
+	state  matchState
+	prefix string
+	next   int // index of the next SubNode to visit, -1 while the Tree Node itself is not visited yet
+}
+
+// Iterate returns an iterator over the tag values matching the *-wildcard and ?-wildcard pattern. A non-empty
+// cursor, as returned by MatchIterator.Cursor, resumes right after the tag value it was taken at.
+func (t *TagValueIndex) Iterate(pattern string, cursor string) (*MatchIterator, error) {
+	return t.Snapshot().iterate(globAutomaton{newGlobMatcher(pattern)}, cursor)
+}
+
+// FindMatchedNodesPage returns up to limit tag values matching the pattern, starting after the cursor, in
+// lexicographical order. The returned cursor continues with the next page, it is empty after the last page.
+func (t *TagValueIndex) FindMatchedNodesPage(pattern string, cursor string, limit int) (nodeList []TagNodePair, next string, err error) {
+	it, err := t.Iterate(pattern, cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	for len(nodeList) < limit {
+		nodePair, ok := it.Next()
+		if !ok {
+			return nodeList, "", nil
+		}
+		nodeList = append(nodeList, nodePair)
+	}
+	next = it.Cursor()
+	if _, ok := it.Next(); !ok {
+		next = ""
+	}
+	return nodeList, next, nil
+}
+
+// Next returns the next matching tag value, or false once all of them were returned.
+func (it *MatchIterator) Next() (TagNodePair, bool) {
+	for len(it.stack) > 0 {
+		f := &it.stack[len(it.stack)-1]
+		if f.next < 0 {
+			f.next = 0
+			if f.tree.IsEnd && (!it.hasAfter || f.prefix > it.after) && it.m.accepts(f.state) {
+				it.after, it.hasAfter = f.tree.Data, true
+				return TagNodePair{
+					str:      f.tree.Data,
+					nodeList: f.tree.NodeList,
+				}, true
+			}
+			continue
+		}
+		if f.next == len(f.tree.SubNodes) {
+			it.stack = it.stack[:len(it.stack)-1]
+			continue
+		}
+
+		sub_node := f.tree.SubNodes[f.next]
+		f.next++
+		prefix := f.prefix + sub_node.Str
+		if it.hasAfter && prefix < it.after && !strings.HasPrefix(it.after, prefix) {
+			// every tag value of the subtree sorts before the cursor
+			continue
+		}
+		state := f.state
+		for i := 0; i < len(sub_node.Str) && state != nil; i++ {
+			state = it.m.step(state, sub_node.Str[i])
+		}
+		if state != nil {
+			it.stack = append(it.stack, matchFrame{tree: sub_node.Tree, state: state, prefix: prefix, next: -1})
+		}
+	}
+	return TagNodePair{}, false
+}
+
+// Cursor returns an opaque cursor to resume after the last returned tag value, or the cursor the iterator was
+// created with if Next did not return anything yet.
+func (it *MatchIterator) Cursor() string {
+	if !it.hasAfter {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString(append([]byte{cursorVersion}, it.after...))
+}
+
+////////////////////////////////////   Inner Functions   //////////////////////////////////////////////////
+
+func (t *TagValueIndex) iterate(m matcher, cursor string) (*MatchIterator, error) {
+	it := &MatchIterator{
+		m:     m,
+		stack: []matchFrame{{tree: t, state: m.start(), next: -1}},
+	}
+	if cursor != "" {
+		after, err := base64.RawURLEncoding.DecodeString(cursor)
+		if err != nil || len(after) == 0 || after[0] != cursorVersion {
+			return nil, ErrInvalidCursor
+		}
+		it.after, it.hasAfter = string(after[1:]), true
+	}
+	return it, nil
+}
+
+// globAutomaton adapts a globMatcher to the matcher interface
+type globAutomaton struct {
+	g *globMatcher
+}
+
+func (a globAutomaton) start() matchState {
+	return a.g.start()
+}
+
+func (a globAutomaton) step(state matchState, c byte) matchState {
+	next := a.g.step(state.([]int), c)
+	if len(next) == 0 {
+		return nil
+	}
+	return next
+}
+
+func (a globAutomaton) accepts(state matchState) bool {
+	return a.g.accepts(state.([]int))
+}
@@ -0,0 +1,43 @@
+package pkg
+
+import (
+	"net/url"
+	"strings"
+)
+
+// Namespace separates the tag names and indexes of teams sharing the Zookeeper ensemble and etcd. The Tries of a
+// namespace are below its own Zookeeper root, see ZkRoot, and its etcd keys below its own prefix, see KeyPrefix.
+// The node registry is shared by all namespaces, so a node has the same ID in each of them.
+type Namespace string
+
+// DefaultNamespace keeps its Tries and etcd keys where they were before namespaces existed, e.g. at
+// TagNameTriePath and below PostingKeyPrefix
+const DefaultNamespace Namespace = ""
+
+// ZkRoot returns the Zookeeper path the Tries of the namespace are below, which is empty for the DefaultNamespace
+func (ns Namespace) ZkRoot() string {
+	if ns == DefaultNamespace {
+		return ""
+	}
+	return JoinPath(NamespacesPath, EscapeZnodeName(string(ns)))
+}
+
+// KeyPrefix returns the prefix of all etcd keys of the namespace, which is empty for the DefaultNamespace
+func (ns Namespace) KeyPrefix() string {
+	if ns == DefaultNamespace {
+		return ""
+	}
+	return NamespaceKeyPrefix + url.PathEscape(string(ns)) + "/"
+}
+
+////////////////////////////////////   Inner Functions   //////////////////////////////////////////////////
+
+// trieRoot returns the path of a Trie root, like TagNameTriePath, in the namespace
+func (ns Namespace) trieRoot(root string) string {
+	return ns.ZkRoot() + root
+}
+
+// tagNameFromPath is GetTagNameFromPath for a znode of the character Trie of the namespace
+func (ns Namespace) tagNameFromPath(path string) string {
+	return GetTagNameFromPath(strings.TrimPrefix(path, ns.ZkRoot()))
+}
@@ -0,0 +1,213 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// NodeRegistry maps node names, like hostnames or instance IDs, to the uint32 node IDs stored in the NodeLists and
+// back. The mapping is kept in etcd below NodeKeyPrefix and survives DeleteAllIndexes, so a node keeps its ID when
+// the tags are ingested again, in any order. An ID is never reassigned, which lets every registry cache the names
+// it has seen.
+//
+// The etcd keys are
+//
+//	nodes/name/<name>  the decimal ID of the node
+//	nodes/id/<ID>      the name of the node
+//	nodes/next         the next unassigned ID
+type NodeRegistry struct {
+	cli *clientv3.Client
+
+	mu    sync.Mutex
+	ids   map[string]uint32
+	names map[uint32]string
+}
+
+// CreateNodeRegistry connects a NodeRegistry to etcd. Close it when done.
+func CreateNodeRegistry() (*NodeRegistry, error) {
+	cli, err := CreateClient()
+	if err != nil {
+		return nil, err
+	}
+	return &NodeRegistry{
+		cli:   cli,
+		ids:   make(map[string]uint32),
+		names: make(map[uint32]string),
+	}, nil
+}
+
+// Close closes the etcd connection of the registry
+func (r *NodeRegistry) Close() error {
+	return r.cli.Close()
+}
+
+// Register returns the ID of the node, assigning the next free ID if the node is new. Concurrent registrations
+// of the same name, from any process, get the same ID.
+func (r *NodeRegistry) Register(name string) (uint32, error) {
+	if id, ok := r.cached(name); ok {
+		return id, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	nameKey, nextKey := nodeNameKey(name), NodeKeyPrefix+"next"
+	for {
+		id, found, err := r.lookup(ctx, name)
+		if err != nil || found {
+			return id, err
+		}
+
+		resp, err := r.cli.Get(ctx, nextKey)
+		if err != nil {
+			return 0, err
+		}
+		next, revision := uint64(0), int64(0)
+		for _, ev := range resp.Kvs {
+			if next, err = strconv.ParseUint(string(ev.Value), 10, 32); err != nil {
+				return 0, fmt.Errorf("node registry %q: %w", nextKey, err)
+			}
+			revision = ev.ModRevision
+		}
+
+		// a missing key has a CreateRevision and a ModRevision of 0
+		id = uint32(next)
+		txn, err := r.cli.Txn(ctx).If(
+			clientv3.Compare(clientv3.CreateRevision(nameKey), "=", 0),
+			clientv3.Compare(clientv3.ModRevision(nextKey), "=", revision),
+		).Then(
+			clientv3.OpPut(nameKey, strconv.FormatUint(uint64(id), 10)),
+			clientv3.OpPut(nodeIDKey(id), name),
+			clientv3.OpPut(nextKey, strconv.FormatUint(next+1, 10)),
+		).Commit()
+		if err != nil {
+			return 0, err
+		}
+		if txn.Succeeded {
+			r.remember(name, id)
+			return id, nil
+		}
+	}
+}
+
+// Lookup returns the ID of a registered node
+func (r *NodeRegistry) Lookup(name string) (id uint32, found bool, err error) {
+	if id, ok := r.cached(name); ok {
+		return id, true, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return r.lookup(ctx, name)
+}
+
+// Names returns the names of the nodes in ascending order of their IDs. An ID that is not registered, e.g. of an
+// index written before the registry existed, is returned as the decimal number. Only the names that are not cached
+// yet are read from etcd.
+func (r *NodeRegistry) Names(nodes *Bitmap) ([]string, error) {
+	var missing []uint32
+	nodes.ForEach(func(id uint32) bool {
+		if _, ok := r.cachedName(id); !ok {
+			missing = append(missing, id)
+		}
+		return true
+	})
+	if err := r.fetch(missing); err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, nodes.Cardinality())
+	nodes.ForEach(func(id uint32) bool {
+		name, ok := r.cachedName(id)
+		if !ok {
+			name = strconv.FormatUint(uint64(id), 10)
+		}
+		names = append(names, name)
+		return true
+	})
+	return names, nil
+}
+
+// FormatNodes returns the names of the nodes as a comma separated string, like Bitmap.String does for the IDs
+func (r *NodeRegistry) FormatNodes(nodes *Bitmap) (string, error) {
+	names, err := r.Names(nodes)
+	if err != nil {
+		return "", err
+	}
+	return strings.Join(names, ", "), nil
+}
+
+////////////////////////////////////   Inner Functions   //////////////////////////////////////////////////
+
+func nodeNameKey(name string) string {
+	return NodeKeyPrefix + "name/" + name
+}
+
+func nodeIDKey(id uint32) string {
+	return NodeKeyPrefix + "id/" + strconv.FormatUint(uint64(id), 10)
+}
+
+func (r *NodeRegistry) lookup(ctx context.Context, name string) (uint32, bool, error) {
+	nameKey := nodeNameKey(name)
+	resp, err := r.cli.Get(ctx, nameKey)
+	if err != nil || len(resp.Kvs) == 0 {
+		return 0, false, err
+	}
+	id, err := strconv.ParseUint(string(resp.Kvs[0].Value), 10, 32)
+	if err != nil {
+		return 0, false, fmt.Errorf("node registry %q: %w", nameKey, err)
+	}
+	r.remember(name, uint32(id))
+	return uint32(id), true, nil
+}
+
+// fetch reads the names of the IDs into the cache, batching the reads into transactions like PutIndexPostings
+func (r *NodeRegistry) fetch(ids []uint32) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	for start := 0; start < len(ids); start += postingTxnOps {
+		end := start + postingTxnOps
+		if end > len(ids) {
+			end = len(ids)
+		}
+		ops := make([]clientv3.Op, 0, end-start)
+		for _, id := range ids[start:end] {
+			ops = append(ops, clientv3.OpGet(nodeIDKey(id)))
+		}
+		txn, err := r.cli.Txn(ctx).Then(ops...).Commit()
+		if err != nil {
+			return err
+		}
+		for i, resp := range txn.Responses {
+			for _, ev := range resp.GetResponseRange().Kvs {
+				r.remember(string(ev.Value), ids[start+i])
+			}
+		}
+	}
+	return nil
+}
+
+func (r *NodeRegistry) cached(name string) (uint32, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	id, ok := r.ids[name]
+	return id, ok
+}
+
+func (r *NodeRegistry) cachedName(id uint32) (string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	name, ok := r.names[id]
+	return name, ok
+}
+
+func (r *NodeRegistry) remember(name string, id uint32) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ids[name], r.names[id] = id, name
+}
@@ -0,0 +1,234 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// ErrCorruptNodeTags is returned for a value of the reverse index that cannot be decoded
+var ErrCorruptNodeTags = errors.New("corrupt node tags")
+
+// Tag is a single tag_name=tag_value pair of a node
+type Tag struct {
+	Name  string
+	Value string
+}
+
+// NodeTagsKey is Namespace.NodeTagsKey in the DefaultNamespace
+func NodeTagsKey(node uint32) string {
+	return DefaultNamespace.NodeTagsKey(node)
+}
+
+// NodeTagsKey returns the etcd key holding the tags of a node in the reverse index. The value is the number of tags
+// followed by the length and bytes of each tag name and tag value, all lengths are uvarints. Tags are sorted by
+// tag name and tag value.
+func (ns Namespace) NodeTagsKey(node uint32) string {
+	return ns.KeyPrefix() + NodeTagsKeyPrefix + strconv.FormatUint(uint64(node), 10)
+}
+
+// PutNodeTags is Namespace.PutNodeTags in the DefaultNamespace
+func PutNodeTags(node uint32, tags []Tag) error {
+	return DefaultNamespace.PutNodeTags(node, tags)
+}
+
+// PutNodeTags replaces all tags of a node in the reverse index
+func (ns Namespace) PutNodeTags(node uint32, tags []Tag) error {
+	return ns.PutAllNodeTags(map[uint32][]Tag{node: tags})
+}
+
+// PutAllNodeTags is Namespace.PutAllNodeTags in the DefaultNamespace
+func PutAllNodeTags(nodeTags map[uint32][]Tag) error {
+	return DefaultNamespace.PutAllNodeTags(nodeTags)
+}
+
+// PutAllNodeTags replaces the tags of many nodes in the reverse index, batched into transactions like
+// PutIndexPostings. A node without tags is dropped from the reverse index.
+func (ns Namespace) PutAllNodeTags(nodeTags map[uint32][]Tag) error {
+	cli, err := CreateClient()
+	if err != nil {
+		return err
+	}
+	defer cli.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	var ops []clientv3.Op
+	for node, tags := range nodeTags {
+		op := clientv3.OpDelete(ns.NodeTagsKey(node))
+		if len(tags) > 0 {
+			op = clientv3.OpPut(ns.NodeTagsKey(node), string(encodeNodeTags(tags)))
+		}
+		ops = append(ops, op)
+		if len(ops) == postingTxnOps {
+			if _, err = cli.Txn(ctx).Then(ops...).Commit(); err != nil {
+				return err
+			}
+			ops = ops[:0]
+		}
+	}
+	if len(ops) > 0 {
+		_, err = cli.Txn(ctx).Then(ops...).Commit()
+	}
+	return err
+}
+
+// GetNodeTags is Namespace.GetNodeTags in the DefaultNamespace
+func GetNodeTags(node uint32) ([]Tag, error) {
+	return DefaultNamespace.GetNodeTags(node)
+}
+
+// GetNodeTags returns the tags of a node sorted by tag name and tag value, or no tags for an unknown node
+func (ns Namespace) GetNodeTags(node uint32) ([]Tag, error) {
+	cli, err := CreateClient()
+	if err != nil {
+		return nil, err
+	}
+	defer cli.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	resp, err := cli.Get(ctx, ns.NodeTagsKey(node))
+	if err != nil || len(resp.Kvs) == 0 {
+		return nil, err
+	}
+	return decodeNodeTags(resp.Kvs[0].Value)
+}
+
+// DeleteNodeTags is Namespace.DeleteNodeTags in the DefaultNamespace
+func DeleteNodeTags(node uint32) error {
+	return DefaultNamespace.DeleteNodeTags(node)
+}
+
+// DeleteNodeTags drops a node from the reverse index
+func (ns Namespace) DeleteNodeTags(node uint32) error {
+	return ns.PutAllNodeTags(map[uint32][]Tag{node: nil})
+}
+
+////////////////////////////////////   Inner Functions   //////////////////////////////////////////////////
+
+// addNodeTag adds a tag to a node in the reverse index
+func (ns Namespace) addNodeTag(node uint32, tag Tag) error {
+	return ns.updateNodeTags(node, func(tags []Tag) ([]Tag, bool) {
+		if i := searchTag(tags, tag); i < len(tags) && tags[i] == tag {
+			return tags, false
+		}
+		return append(tags, tag), true
+	})
+}
+
+// removeNodeTag removes a tag from a node in the reverse index and drops the node once no tag is left
+func (ns Namespace) removeNodeTag(node uint32, tag Tag) error {
+	return ns.updateNodeTags(node, func(tags []Tag) ([]Tag, bool) {
+		i := searchTag(tags, tag)
+		if i == len(tags) || tags[i] != tag {
+			return tags, false
+		}
+		return append(tags[:i], tags[i+1:]...), true
+	})
+}
+
+// removeNodeTagName removes all tags with the tag name from a node in the reverse index
+func (ns Namespace) removeNodeTagName(node uint32, tagName string) error {
+	return ns.updateNodeTags(node, func(tags []Tag) ([]Tag, bool) {
+		var kept []Tag
+		for _, tag := range tags {
+			if tag.Name != tagName {
+				kept = append(kept, tag)
+			}
+		}
+		return kept, len(kept) < len(tags)
+	})
+}
+
+// updateNodeTags runs a read-modify-write of the tags of a node until the compare-and-swap succeeds, like
+// updatePosting
+func (ns Namespace) updateNodeTags(node uint32, update func(tags []Tag) ([]Tag, bool)) error {
+	cli, err := CreateClient()
+	if err != nil {
+		return err
+	}
+	defer cli.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	key := ns.NodeTagsKey(node)
+	for {
+		resp, err := cli.Get(ctx, key)
+		if err != nil {
+			return err
+		}
+		var tags []Tag
+		revision := int64(0)
+		for _, ev := range resp.Kvs {
+			if tags, err = decodeNodeTags(ev.Value); err != nil {
+				return fmt.Errorf("node tags %q: %w", key, err)
+			}
+			revision = ev.ModRevision
+		}
+		tags, changed := update(tags)
+		if !changed {
+			return nil
+		}
+
+		op := clientv3.OpDelete(key)
+		if len(tags) > 0 {
+			op = clientv3.OpPut(key, string(encodeNodeTags(tags)))
+		}
+		// a missing key has a ModRevision of 0
+		txn, err := cli.Txn(ctx).If(clientv3.Compare(clientv3.ModRevision(key), "=", revision)).Then(op).Commit()
+		if err != nil {
+			return err
+		}
+		if txn.Succeeded {
+			return nil
+		}
+	}
+}
+
+// searchTag returns the index of tag in the sorted tags, or where it would be inserted
+func searchTag(tags []Tag, tag Tag) int {
+	return sort.Search(len(tags), func(i int) bool {
+		return tags[i].Name > tag.Name || tags[i].Name == tag.Name && tags[i].Value >= tag.Value
+	})
+}
+
+// encodeNodeTags encodes the tags in the format described at NodeTagsKey, sorting them and dropping duplicates
+func encodeNodeTags(tags []Tag) []byte {
+	var sorted []Tag
+	for _, tag := range tags {
+		if i := searchTag(sorted, tag); i == len(sorted) || sorted[i] != tag {
+			sorted = append(sorted, Tag{})
+			copy(sorted[i+1:], sorted[i:])
+			sorted[i] = tag
+		}
+	}
+	buf := appendUvarint(nil, uint64(len(sorted)))
+	for _, tag := range sorted {
+		buf = appendUvarint(buf, uint64(len(tag.Name)))
+		buf = append(buf, tag.Name...)
+		buf = appendUvarint(buf, uint64(len(tag.Value)))
+		buf = append(buf, tag.Value...)
+	}
+	return buf
+}
+
+func decodeNodeTags(data []byte) ([]Tag, error) {
+	r := &byteReader{buf: data}
+	count := r.uvarint()
+	var tags []Tag
+	for i := uint64(0); i < count && r.err == nil; i++ {
+		name := string(r.bytes(r.uvarint()))
+		value := string(r.bytes(r.uvarint()))
+		tags = append(tags, Tag{Name: name, Value: value})
+	}
+	if r.err != nil || r.pos != len(data) {
+		return nil, ErrCorruptNodeTags
+	}
+	return tags, nil
+}
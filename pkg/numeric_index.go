@@ -0,0 +1,164 @@
+package pkg
+
+import (
+	"encoding/binary"
+	"math"
+	"strconv"
+)
+
+// numericKeySize is the length of the order-preserving prefix that encodes the number of a numeric tag value
+const numericKeySize = 8
+
+// NumericRange is an interval of numeric tag values. An unset bound leaves that side of the interval open.
+type NumericRange struct {
+	Min, Max                   float64
+	HasMin, HasMax             bool
+	MinInclusive, MaxInclusive bool
+}
+
+// Contains reports whether v lies in the range
+func (r NumericRange) Contains(v float64) bool {
+	switch {
+	case r.HasMin && (v < r.Min || v == r.Min && !r.MinInclusive):
+		return false
+	case r.HasMax && (v > r.Max || v == r.Max && !r.MaxInclusive):
+		return false
+	}
+	return true
+}
+
+// String returns the range in query syntax, e.g. ">5" or " in [1000,2000)"
+func (r NumericRange) String() string {
+	switch {
+	case r.HasMin && r.HasMax:
+		lo, hi := "(", ")"
+		if r.MinInclusive {
+			lo = "["
+		}
+		if r.MaxInclusive {
+			hi = "]"
+		}
+		return " in " + lo + formatNumericValue(r.Min) + "," + formatNumericValue(r.Max) + hi
+	case r.HasMin && r.MinInclusive:
+		return ">=" + formatNumericValue(r.Min)
+	case r.HasMin:
+		return ">" + formatNumericValue(r.Min)
+	case r.HasMax && r.MaxInclusive:
+		return "<=" + formatNumericValue(r.Max)
+	case r.HasMax:
+		return "<" + formatNumericValue(r.Max)
+	}
+	return " in (-inf,+inf)"
+}
+
+// FindNodesInRange returns every numeric tag value in the range, ordered by number. Tag values that are not
+// numbers never match. The lookup walks an ordered index of the numeric tag values and only descends into
+// subtrees that can hold numbers within the range.
+func (t *TagValueIndex) FindNodesInRange(r NumericRange) (nodeList []TagNodePair) {
+	t = t.Snapshot()
+	var lo, hi string
+	if r.HasMin {
+		lo = encodeNumericKey(r.Min)
+	}
+	if r.HasMax {
+		hi = encodeNumericKey(r.Max)
+	}
+	t.numericIndex().walkNumericRange("", lo, hi, func(key, tagValue string) {
+		if !r.Contains(decodeNumericKey(key)) {
+			return
+		}
+		if leaf := t.find(tagValue); leaf != nil {
+			nodeList = append(nodeList, TagNodePair{
+				str:      leaf.Data,
+				nodeList: leaf.NodeList,
+			})
+		}
+	})
+	return nodeList
+}
+
+////////////////////////////////////   Inner Functions   //////////////////////////////////////////////////
+
+// numericIndex returns the ordered index of the numeric tag values. It is a second prefix Tree whose keys are
+// the order-preserving encoding of the number followed by the tag value itself, so "7" and "07" both get a key.
+// The index is derived data: it is not encoded into blobs but built on first use and kept up to date afterwards.
+func (t *TagValueIndex) numericIndex() *TagValueIndex {
+	d := t.getDerived()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.numeric == nil {
+		d.numeric = &TagValueIndex{}
+		for _, nodePair := range (&Node{Tree: t}).getAllSubNodeList() {
+			if v, ok := parseNumericValue(nodePair.str); ok {
+				d.numeric.insert(encodeNumericKey(v) + nodePair.str)
+			}
+		}
+	}
+	return d.numeric
+}
+
+// withNumericValue returns a copy of the numeric index with or without the key of tagValue
+func (t *TagValueIndex) withNumericValue(tagValue string, present bool) *TagValueIndex {
+	v, ok := parseNumericValue(tagValue)
+	if !ok {
+		return t
+	}
+	key := encodeNumericKey(v) + tagValue
+	return t.withKey(key, key, nil, present)
+}
+
+// walkNumericRange visits the keys of the subtree in order. prefix is the key of the subtree, lo and hi are the
+// encoded bounds or empty if unbounded. A subtree is skipped once the number part of its prefix proves that all
+// of its keys lie outside of [lo, hi].
+func (t *TagValueIndex) walkNumericRange(prefix, lo, hi string, fn func(key, tagValue string)) {
+	n := minInt(len(prefix), numericKeySize)
+	if lo != "" && prefix[:n] < lo[:n] || hi != "" && prefix[:n] > hi[:n] {
+		return
+	}
+	if t.IsEnd && len(prefix) >= numericKeySize {
+		fn(prefix[:numericKeySize], t.Data[numericKeySize:])
+	}
+	for _, sub_node := range t.SubNodes {
+		sub_node.Tree.walkNumericRange(prefix+sub_node.Str, lo, hi, fn)
+	}
+}
+
+// parseNumericValue reports whether the tag value is a finite number
+func parseNumericValue(tagValue string) (float64, bool) {
+	v, err := strconv.ParseFloat(tagValue, 64)
+	if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+		return 0, false
+	}
+	return v, true
+}
+
+func formatNumericValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// encodeNumericKey maps a float64 to 8 bytes whose lexicographical order is the numerical order: the sign bit
+// is flipped for positive numbers and all bits are flipped for negative numbers.
+func encodeNumericKey(v float64) string {
+	if v == 0 {
+		v = 0 // -0 and +0 are the same number
+	}
+	bits := math.Float64bits(v)
+	if bits>>63 == 1 {
+		bits = ^bits
+	} else {
+		bits |= 1 << 63
+	}
+	var key [numericKeySize]byte
+	binary.BigEndian.PutUint64(key[:], bits)
+	return string(key[:])
+}
+
+func decodeNumericKey(key string) float64 {
+	bits := binary.BigEndian.Uint64([]byte(key[:numericKeySize]))
+	if bits>>63 == 1 {
+		bits &^= 1 << 63
+	} else {
+		bits = ^bits
+	}
+	return math.Float64frombits(bits)
+}
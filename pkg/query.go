@@ -0,0 +1,740 @@
+package pkg
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// QueryOp is the kind of a Query node
+type QueryOp int
+
+const (
+	QueryOpTerm QueryOp = iota // a single tag_name=tag_value pattern
+	QueryOpAnd                 // intersection of all children
+	QueryOpOr                  // union of all children
+	QueryOpNot                 // all nodes except the ones of the only child
+)
+
+// QueryTerm is a tag_name=tag_value pair, or a tag_name with a numeric range like level>5.
+// The tag name and tag value support *-wildcard and ?-wildcard, are regular expressions in RE2 syntax, or are
+// fuzzy and match everything within an edit distance.
+type QueryTerm struct {
+	TagName          string
+	TagValue         string
+	TagNameRegexp    bool          // TagName is a regular expression
+	TagValueRegexp   bool          // TagValue is a regular expression
+	TagNameDistance  int           // if positive, TagName is fuzzy and matches within this edit distance
+	TagValueDistance int           // if positive, TagValue is fuzzy and matches within this edit distance
+	Range            *NumericRange // if set, TagValue is ignored and the numeric tag values in the range match
+}
+
+// Query is a parsed boolean query like "cpu=AMD AND region=East* AND NOT level=1".
+// Leaves are terms, inner nodes combine the node sets of their children.
+type Query struct {
+	Op       QueryOp
+	Term     QueryTerm // only set for QueryOpTerm
+	Children []*Query
+}
+
+// TermMatch is a single tag value matched by a QueryTerm
+type TermMatch struct {
+	TagName         string
+	TagNameDistance int // edit distance to the searched tag name, only set for fuzzy tag names
+	TagNodePair
+}
+
+// Distance returns the edit distance of the tag name and the tag value together
+func (m *TermMatch) Distance() int {
+	return m.TagNameDistance + m.GetDistance()
+}
+
+// TagCount is the number of nodes a QueryTerm matches within a single tag name
+type TagCount struct {
+	TagName  string
+	Count    int // number of (tag value, node) pairs, see TagValueIndex.Count
+	Distinct int // number of distinct nodes, see TagValueIndex.CountDistinctNodes
+}
+
+// ParseQuery parses a boolean query. The grammar is, from lowest to highest precedence:
+//
+//	query := and { OR and }
+//	and   := not { AND not }
+//	not   := NOT not | '(' query ')' | term
+//	term  := pattern '=' pattern
+//	       | pattern ( '<' | '<=' | '>' | '>=' ) number
+//	       | pattern IN ( '[' | '(' ) number ',' number ( ']' | ')' )
+//	pattern := string [ '~' [ digits ] ] | '/' regexp '/'
+//
+// Keywords are case-insensitive. A string is either bare or double-quoted; quote it if it contains spaces,
+// parentheses, '=', '<' or '>', e.g. "cpu=\"Intel Xeon\"". Ranges compare tag values as numbers, e.g.
+// "level>5" or "resourceId in [1000,2000)". A regular expression in RE2 syntax is enclosed in slashes and has
+// to match the whole tag name or tag value, e.g. "/cpu|gpu/=/(AMD|Intel).*/"; write \/ for a slash inside it.
+// A '~' makes a string fuzzy, so it matches within an edit distance of DefaultFuzzyDistance or the given one,
+// e.g. "regoin~=EastUS~1". Wildcards have no meaning in fuzzy strings.
+func ParseQuery(query string) (*Query, error) {
+	p := &queryParser{input: query}
+	q, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpace()
+	if !p.eof() {
+		return nil, p.errorf("unexpected %q", p.input[p.pos:])
+	}
+	return q, nil
+}
+
+// EvaluateQuery parses a query and returns the set of nodes matching it.
+func EvaluateQuery(source IndexSource, query string) (*Bitmap, error) {
+	q, err := ParseQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	return q.Evaluate(source)
+}
+
+// Evaluate returns the set of nodes matching the query. Terms are looked up in the source, AND intersects,
+// OR unions and AND NOT subtracts their node lists. A NOT that is not part of an AND is taken relative to all
+// nodes of all tag names.
+func (q *Query) Evaluate(source IndexSource) (*Bitmap, error) {
+	e := &queryEvaluator{
+		source:  source,
+		indexes: make(map[string]*TagValueIndex),
+	}
+	return e.evaluate(q)
+}
+
+// FindAllMatchedNodes returns every tag value matched by the term, grouped by tag name.
+func (t QueryTerm) FindAllMatchedNodes(source IndexSource) ([]TermMatch, error) {
+	e := &queryEvaluator{
+		source:  source,
+		indexes: make(map[string]*TagValueIndex),
+	}
+	return e.matchTerm(t, 0)
+}
+
+// FindFirstMatchedNodes returns up to limit tag values matched by the term, in the order of FindAllMatchedNodes
+// except that tag values are always lexicographical. Wildcard patterns and regular expressions stream their tag
+// values and stop at the limit instead of collecting every match first.
+func (t QueryTerm) FindFirstMatchedNodes(source IndexSource, limit int) ([]TermMatch, error) {
+	if limit <= 0 {
+		return nil, fmt.Errorf("limit must be positive, got %d", limit)
+	}
+	e := &queryEvaluator{
+		source:  source,
+		indexes: make(map[string]*TagValueIndex),
+	}
+	return e.matchTerm(t, limit)
+}
+
+// Count returns how many nodes the term matches in every matching tag name. Wildcard patterns are answered from the
+// counts kept in the TagValueIndex, the other kinds of terms count their matches.
+func (t QueryTerm) Count(source IndexSource) ([]TagCount, error) {
+	e := &queryEvaluator{
+		source:  source,
+		indexes: make(map[string]*TagValueIndex),
+	}
+	return e.countTerm(t)
+}
+
+// Suggest returns the tag values within DefaultFuzzyDistance of the term, closest first, e.g. to correct a
+// misspelled term that matched nothing. Regular expressions and numeric ranges are kept as they are.
+func (t QueryTerm) Suggest(source IndexSource) ([]TermMatch, error) {
+	if !t.TagNameRegexp && t.TagNameDistance == 0 {
+		t.TagNameDistance = DefaultFuzzyDistance
+	}
+	if t.Range == nil && !t.TagValueRegexp && t.TagValueDistance == 0 {
+		t.TagValueDistance = DefaultFuzzyDistance
+	}
+	matches, err := t.FindAllMatchedNodes(source)
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(matches, func(i, j int) bool { return matches[i].Distance() < matches[j].Distance() })
+	return matches, nil
+}
+
+func (q *Query) String() string {
+	switch q.Op {
+	case QueryOpTerm:
+		tagName := quoteQueryPattern(q.Term.TagName, q.Term.TagNameRegexp, q.Term.TagNameDistance)
+		if q.Term.Range != nil {
+			return tagName + q.Term.Range.String()
+		}
+		return tagName + "=" + quoteQueryPattern(q.Term.TagValue, q.Term.TagValueRegexp, q.Term.TagValueDistance)
+	case QueryOpNot:
+		return "NOT " + q.Children[0].String()
+	}
+	op := " AND "
+	if q.Op == QueryOpOr {
+		op = " OR "
+	}
+	children := make([]string, len(q.Children))
+	for i, child := range q.Children {
+		children[i] = child.String()
+	}
+	return "(" + strings.Join(children, op) + ")"
+}
+
+// FormatNodeList returns the nodes as a comma separated string
+func FormatNodeList(nodes []uint32) string {
+	var sb strings.Builder
+	for i, v := range nodes {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		fmt.Fprintf(&sb, "%d", v)
+	}
+	return sb.String()
+}
+
+////////////////////////////////////   Inner Functions   //////////////////////////////////////////////////
+
+type queryParser struct {
+	input string
+	pos   int
+}
+
+func (p *queryParser) parseOr() (*Query, error) {
+	q, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("OR") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		q = combineQueries(QueryOpOr, q, right)
+	}
+	return q, nil
+}
+
+func (p *queryParser) parseAnd() (*Query, error) {
+	q, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("AND") {
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		q = combineQueries(QueryOpAnd, q, right)
+	}
+	return q, nil
+}
+
+func (p *queryParser) parseNot() (*Query, error) {
+	if p.keyword("NOT") {
+		q, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &Query{Op: QueryOpNot, Children: []*Query{q}}, nil
+	}
+
+	p.skipSpace()
+	if p.eof() {
+		return nil, p.errorf("unexpected end of query")
+	}
+	if p.input[p.pos] == '(' {
+		p.pos++
+		q, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		p.skipSpace()
+		if p.eof() || p.input[p.pos] != ')' {
+			return nil, p.errorf("missing ')'")
+		}
+		p.pos++
+		return q, nil
+	}
+	return p.parseTerm()
+}
+
+func (p *queryParser) parseTerm() (*Query, error) {
+	var term QueryTerm
+	var err error
+	term.TagName, term.TagNameRegexp, term.TagNameDistance, err = p.parsePattern("=<>")
+	if err != nil {
+		return nil, err
+	}
+
+	p.skipSpace()
+	switch {
+	case p.consume("<="):
+		term.Range = &NumericRange{HasMax: true, MaxInclusive: true}
+		term.Range.Max, err = p.parseNumber()
+	case p.consume("<"):
+		term.Range = &NumericRange{HasMax: true}
+		term.Range.Max, err = p.parseNumber()
+	case p.consume(">="):
+		term.Range = &NumericRange{HasMin: true, MinInclusive: true}
+		term.Range.Min, err = p.parseNumber()
+	case p.consume(">"):
+		term.Range = &NumericRange{HasMin: true}
+		term.Range.Min, err = p.parseNumber()
+	case p.consume("="):
+		p.skipSpace()
+		term.TagValue, term.TagValueRegexp, term.TagValueDistance, err = p.parsePattern("")
+	case p.keyword("IN"):
+		term.Range, err = p.parseInterval()
+	default:
+		return nil, p.errorf("expect tag_name=tag_value")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Query{Op: QueryOpTerm, Term: term}, nil
+}
+
+// parseInterval reads a numeric interval like [1000,2000) where brackets include and parentheses exclude a bound
+func (p *queryParser) parseInterval() (r *NumericRange, err error) {
+	r = &NumericRange{HasMin: true, HasMax: true}
+	p.skipSpace()
+	switch {
+	case p.consume("["):
+		r.MinInclusive = true
+	case !p.consume("("):
+		return nil, p.errorf("expect '[' or '('")
+	}
+	if r.Min, err = p.parseNumber(); err != nil {
+		return nil, err
+	}
+	p.skipSpace()
+	if !p.consume(",") {
+		return nil, p.errorf("expect ','")
+	}
+	if r.Max, err = p.parseNumber(); err != nil {
+		return nil, err
+	}
+	p.skipSpace()
+	switch {
+	case p.consume("]"):
+		r.MaxInclusive = true
+	case !p.consume(")"):
+		return nil, p.errorf("expect ']' or ')'")
+	}
+	return r, nil
+}
+
+func (p *queryParser) parseNumber() (float64, error) {
+	p.skipSpace()
+	s, err := p.parseString(",]")
+	if err != nil {
+		return 0, err
+	}
+	v, ok := parseNumericValue(s)
+	if !ok {
+		return 0, p.errorf("%q is not a number", s)
+	}
+	return v, nil
+}
+
+// consume skips the token if it comes next
+func (p *queryParser) consume(token string) bool {
+	if strings.HasPrefix(p.input[p.pos:], token) {
+		p.pos += len(token)
+		return true
+	}
+	return false
+}
+
+// parsePattern reads a regular expression enclosed in slashes, or a string like parseString that is followed by
+// an optional edit distance.
+func (p *queryParser) parsePattern(stop string) (s string, isRegexp bool, distance int, err error) {
+	if p.eof() || p.input[p.pos] != '/' {
+		if s, err = p.parseString(stop + "~"); err != nil {
+			return "", false, 0, err
+		}
+		distance, err = p.parseDistance()
+		return s, false, distance, err
+	}
+	var sb strings.Builder
+	for p.pos++; !p.eof(); p.pos++ {
+		switch c := p.input[p.pos]; {
+		case c == '/':
+			p.pos++
+			if strings.HasPrefix(p.input[p.pos:], "~") {
+				return "", false, 0, p.errorf("a regular expression cannot be fuzzy")
+			}
+			return sb.String(), true, 0, nil
+		case c == '\\' && p.pos+1 < len(p.input) && p.input[p.pos+1] == '/':
+			// other escapes belong to the regular expression and are kept as they are
+			p.pos++
+			sb.WriteByte('/')
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return "", false, 0, p.errorf("unterminated regular expression")
+}
+
+// parseDistance reads the edit distance of a fuzzy string like Intle~1, a bare '~' gives DefaultFuzzyDistance.
+// It returns 0 if the string is not fuzzy.
+func (p *queryParser) parseDistance() (int, error) {
+	if !p.consume("~") {
+		return 0, nil
+	}
+	start := p.pos
+	for !p.eof() && p.input[p.pos] >= '0' && p.input[p.pos] <= '9' {
+		p.pos++
+	}
+	if p.pos == start {
+		return DefaultFuzzyDistance, nil
+	}
+	distance, err := strconv.Atoi(p.input[start:p.pos])
+	if err != nil || distance == 0 {
+		return 0, p.errorf("invalid edit distance %q", p.input[start:p.pos])
+	}
+	return distance, nil
+}
+
+// parseString reads a double-quoted string, or a bare string up to a space, a parenthesis or one of stop.
+func (p *queryParser) parseString(stop string) (string, error) {
+	if !p.eof() && p.input[p.pos] == '"' {
+		var sb strings.Builder
+		for p.pos++; !p.eof(); p.pos++ {
+			switch c := p.input[p.pos]; c {
+			case '"':
+				p.pos++
+				return sb.String(), nil
+			case '\\':
+				p.pos++
+				if p.eof() {
+					return "", p.errorf("unterminated string")
+				}
+				sb.WriteByte(p.input[p.pos])
+			default:
+				sb.WriteByte(c)
+			}
+		}
+		return "", p.errorf("unterminated string")
+	}
+
+	start := p.pos
+	for !p.eof() && !isQueryDelimiter(p.input[p.pos]) && !strings.ContainsRune(stop, rune(p.input[p.pos])) {
+		p.pos++
+	}
+	if p.pos == start {
+		return "", p.errorf("expect a tag_name or tag_value")
+	}
+	return p.input[start:p.pos], nil
+}
+
+// keyword consumes the case-insensitive keyword if it is the next word.
+func (p *queryParser) keyword(word string) bool {
+	p.skipSpace()
+	end := p.pos + len(word)
+	if end > len(p.input) || !strings.EqualFold(p.input[p.pos:end], word) {
+		return false
+	}
+	if end < len(p.input) && !isQueryDelimiter(p.input[end]) {
+		return false
+	}
+	p.pos = end
+	return true
+}
+
+func (p *queryParser) skipSpace() {
+	for !p.eof() && isQuerySpace(p.input[p.pos]) {
+		p.pos++
+	}
+}
+
+func (p *queryParser) eof() bool {
+	return p.pos >= len(p.input)
+}
+
+func (p *queryParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("query syntax error at position %d: %s", p.pos, fmt.Sprintf(format, args...))
+}
+
+func isQueryDelimiter(c byte) bool {
+	return c == '(' || c == ')' || isQuerySpace(c)
+}
+
+// isQuerySpace only looks at ASCII spaces, so bytes of multi-byte UTF-8 characters are never split.
+func isQuerySpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\v' || c == '\f'
+}
+
+// combineQueries flattens chains like a AND b AND c into a single node
+func combineQueries(op QueryOp, left, right *Query) *Query {
+	if left.Op == op {
+		left.Children = append(left.Children, right)
+		return left
+	}
+	return &Query{Op: op, Children: []*Query{left, right}}
+}
+
+func quoteQueryPattern(s string, isRegexp bool, distance int) string {
+	switch {
+	case isRegexp:
+		return "/" + strings.ReplaceAll(s, "/", `\/`) + "/"
+	case distance > 0:
+		return quoteQueryString(s) + "~" + strconv.Itoa(distance)
+	}
+	return quoteQueryString(s)
+}
+
+func quoteQueryString(s string) string {
+	if s == "" || s[0] == '/' || strings.IndexFunc(s, func(r rune) bool {
+		return r == '"' || r == '=' || r == '~' || r == '<' || r == '>' || r == '\\' || r < 0x80 && isQueryDelimiter(byte(r))
+	}) >= 0 {
+		return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+	}
+	return s
+}
+
+// queryEvaluator caches every TagValueIndex loaded while evaluating a single query, keyed by tag name and
+// tag value prefix
+type queryEvaluator struct {
+	source   IndexSource
+	indexes  map[string]*TagValueIndex
+	universe *Bitmap
+}
+
+func (e *queryEvaluator) evaluate(q *Query) (*Bitmap, error) {
+	switch q.Op {
+	case QueryOpTerm:
+		matches, err := e.matchTerm(q.Term, 0)
+		if err != nil {
+			return nil, err
+		}
+		nodes := NewBitmap()
+		for _, match := range matches {
+			nodes = nodes.Or(match.nodeList)
+		}
+		return nodes, nil
+
+	case QueryOpOr:
+		nodes := NewBitmap()
+		for _, child := range q.Children {
+			childNodes, err := e.evaluate(child)
+			if err != nil {
+				return nil, err
+			}
+			nodes = nodes.Or(childNodes)
+		}
+		return nodes, nil
+
+	case QueryOpAnd:
+		// intersect the positive children first, so the negated ones are only subtracted from a small set
+		var nodes *Bitmap
+		first := true
+		for _, child := range q.Children {
+			if child.Op == QueryOpNot {
+				continue
+			}
+			childNodes, err := e.evaluate(child)
+			if err != nil {
+				return nil, err
+			}
+			if first {
+				nodes, first = childNodes, false
+			} else {
+				nodes = nodes.And(childNodes)
+			}
+			if nodes.IsEmpty() {
+				return nodes, nil
+			}
+		}
+		if first {
+			universe, err := e.allNodes()
+			if err != nil {
+				return nil, err
+			}
+			nodes = universe
+		}
+		for _, child := range q.Children {
+			if child.Op != QueryOpNot {
+				continue
+			}
+			childNodes, err := e.evaluate(child.Children[0])
+			if err != nil {
+				return nil, err
+			}
+			nodes = nodes.AndNot(childNodes)
+		}
+		return nodes, nil
+
+	case QueryOpNot:
+		universe, err := e.allNodes()
+		if err != nil {
+			return nil, err
+		}
+		childNodes, err := e.evaluate(q.Children[0])
+		if err != nil {
+			return nil, err
+		}
+		return universe.AndNot(childNodes), nil
+	}
+	return nil, fmt.Errorf("unknown query op %d", q.Op)
+}
+
+// matchTerm returns the tag values matched by the term, at most limit of them if limit is positive.
+func (e *queryEvaluator) matchTerm(t QueryTerm, limit int) (matches []TermMatch, err error) {
+	tagNames, tagNameDistances, err := e.searchTagName(t)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := ""
+	var re *regexpMatcher
+	switch {
+	case t.Range != nil, t.TagValueDistance > 0:
+	case t.TagValueRegexp:
+		if re, err = newRegexpMatcher(t.TagValue); err != nil {
+			return nil, err
+		}
+		prefix = re.literalPrefix()
+	default:
+		prefix = newGlobMatcher(t.TagValue).literalPrefix()
+	}
+
+	for _, tagName := range tagNames {
+		tree, err := e.index(tagName, prefix)
+		if err != nil {
+			return nil, err
+		}
+		var data []TagNodePair
+		switch {
+		case limit > 0 && t.Range == nil && t.TagValueDistance == 0:
+			var m matcher = globAutomaton{newGlobMatcher(t.TagValue)}
+			if re != nil {
+				m = re
+			}
+			it, _ := tree.iterate(m, "")
+			for len(matches)+len(data) < limit {
+				nodePair, ok := it.Next()
+				if !ok {
+					break
+				}
+				data = append(data, nodePair)
+			}
+		case t.Range != nil:
+			data = tree.FindNodesInRange(*t.Range)
+		case re != nil:
+			tree.findMatchedNodes(re, re.start(), &data)
+		case t.TagValueDistance > 0:
+			if data, err = tree.FindFuzzyMatchedNodes(t.TagValue, t.TagValueDistance); err != nil {
+				return nil, err
+			}
+		default:
+			if data, err = tree.FindAllMatchedNodes(t.TagValue); err != nil {
+				return nil, err
+			}
+		}
+		for _, nodePair := range data {
+			matches = append(matches, TermMatch{
+				TagName:         tagName,
+				TagNameDistance: tagNameDistances[tagName],
+				TagNodePair:     nodePair,
+			})
+		}
+		if limit > 0 && len(matches) >= limit {
+			return matches[:limit], nil
+		}
+	}
+	return matches, nil
+}
+
+func (e *queryEvaluator) countTerm(t QueryTerm) (counts []TagCount, err error) {
+	if t.Range != nil || t.TagValueRegexp || t.TagValueDistance > 0 {
+		matches, err := e.matchTerm(t, 0)
+		if err != nil {
+			return nil, err
+		}
+		var nodes *Bitmap
+		for i, match := range matches {
+			if i == 0 || match.TagName != matches[i-1].TagName {
+				counts = append(counts, TagCount{TagName: match.TagName})
+				nodes = NewBitmap()
+			}
+			nodes = nodes.Or(match.nodeList)
+			counts[len(counts)-1].Count += match.nodeList.Cardinality()
+			counts[len(counts)-1].Distinct = nodes.Cardinality()
+		}
+		return counts, nil
+	}
+
+	tagNames, _, err := e.searchTagName(t)
+	if err != nil {
+		return nil, err
+	}
+	for _, tagName := range tagNames {
+		tree, err := e.index(tagName, newGlobMatcher(t.TagValue).literalPrefix())
+		if err != nil {
+			return nil, err
+		}
+		count := TagCount{TagName: tagName}
+		if count.Count, err = tree.Count(t.TagValue); err != nil {
+			return nil, err
+		}
+		if count.Distinct, err = tree.CountDistinctNodes(t.TagValue); err != nil {
+			return nil, err
+		}
+		if count.Count > 0 {
+			counts = append(counts, count)
+		}
+	}
+	return counts, nil
+}
+
+// searchTagName returns the tag names matched by the term, and their edit distances if the tag name is fuzzy
+func (e *queryEvaluator) searchTagName(t QueryTerm) (tagNames []string, distances map[string]int, err error) {
+	switch {
+	case t.TagNameRegexp:
+		tagNames, err = e.source.SearchTagNameRegexp(t.TagName)
+	case t.TagNameDistance > 0:
+		fuzzyTagNames, err := e.source.SearchTagNameFuzzy(t.TagName, t.TagNameDistance)
+		if err != nil {
+			return nil, nil, err
+		}
+		distances = make(map[string]int)
+		for _, fuzzy := range fuzzyTagNames {
+			tagNames = append(tagNames, fuzzy.TagName)
+			distances[fuzzy.TagName] = fuzzy.Distance
+		}
+	default:
+		tagNames, err = e.source.SearchTagName(t.TagName)
+	}
+	return tagNames, distances, err
+}
+
+// index returns the TagValueIndex of tagName holding at least the tag values with the prefix. A full index
+// that was loaded before is reused for any prefix. The Snapshot is cached, so all terms of a query on the same tag
+// name see the same tag values even if the index is modified meanwhile.
+func (e *queryEvaluator) index(tagName, tagValuePrefix string) (*TagValueIndex, error) {
+	if tree, ok := e.indexes[tagName+"\x00"]; ok {
+		return tree, nil
+	}
+	key := tagName + "\x00" + tagValuePrefix
+	if tree, ok := e.indexes[key]; ok {
+		return tree, nil
+	}
+	tree, err := e.source.GetTagValueIndex(tagName, tagValuePrefix)
+	if err != nil {
+		return nil, err
+	}
+	tree = tree.Snapshot()
+	e.indexes[key] = tree
+	return tree, nil
+}
+
+// allNodes returns every node that carries at least one tag
+func (e *queryEvaluator) allNodes() (*Bitmap, error) {
+	if e.universe == nil {
+		universe, err := e.evaluate(&Query{Op: QueryOpTerm, Term: QueryTerm{TagName: "*", TagValue: "*"}})
+		if err != nil {
+			return nil, err
+		}
+		e.universe = universe
+	}
+	return e.universe, nil
+}
@@ -0,0 +1,159 @@
+package pkg
+
+import (
+	"regexp/syntax"
+	"sort"
+	"unicode/utf8"
+)
+
+// matchState is the state of a matcher after consuming a prefix of a string
+type matchState interface{}
+
+// matcher consumes a string one byte at a time, so a trie can be walked together with the matcher and every
+// branch is pruned as soon as no string below it can match.
+type matcher interface {
+	start() matchState
+	// step returns the state after consuming c, or nil if no string with the consumed prefix can match
+	step(state matchState, c byte) matchState
+	// accepts reports whether the consumed string matches
+	accepts(state matchState) bool
+}
+
+// regexpMatcher runs a compiled RE2 program as an NFA. A state is the set of instructions the program can be
+// in, so the automaton is never backtracked and walking a trie visits every node at most once.
+//
+// The expression has to match the whole string, as if it was written as ^(?:expr)$.
+type regexpMatcher struct {
+	prog *syntax.Prog
+}
+
+// regexpState is immutable, so the same state can be stepped into all children of a trie node
+type regexpState struct {
+	pcs     []uint32 // sorted instructions the program can be in, waiting for a rune or an empty-width assertion
+	prev    rune     // last consumed rune, -1 at the beginning of the string
+	pending string   // bytes of an incomplete UTF-8 encoded rune
+}
+
+// newRegexpMatcher compiles an expression in RE2 syntax, see https://golang.org/s/re2syntax
+func newRegexpMatcher(expr string) (*regexpMatcher, error) {
+	re, err := syntax.Parse(expr, syntax.Perl)
+	if err != nil {
+		return nil, err
+	}
+	prog, err := syntax.Compile(re.Simplify())
+	if err != nil {
+		return nil, err
+	}
+	return &regexpMatcher{prog: prog}, nil
+}
+
+// literalPrefix returns a prefix every match starts with
+func (m *regexpMatcher) literalPrefix() string {
+	prefix, _ := m.prog.Prefix()
+	return prefix
+}
+
+func (m *regexpMatcher) start() matchState {
+	return &regexpState{pcs: m.closure(nil, uint32(m.prog.Start), false, 0), prev: -1}
+}
+
+func (m *regexpMatcher) step(state matchState, c byte) matchState {
+	s := state.(*regexpState)
+	pending := s.pending + string([]byte{c})
+	if !utf8.FullRuneInString(pending) {
+		return &regexpState{pcs: s.pcs, prev: s.prev, pending: pending}
+	}
+	r, size := utf8.DecodeRuneInString(pending)
+	if size < len(pending) {
+		// an invalid byte sequence, which can never match a rune of the expression
+		return nil
+	}
+
+	var next []uint32
+	for _, pc := range m.resolve(s.pcs, s.prev, r) {
+		inst := &m.prog.Inst[pc]
+		if matchesRune(inst, r) {
+			next = m.closure(next, inst.Out, false, 0)
+		}
+	}
+	if len(next) == 0 {
+		return nil
+	}
+	return &regexpState{pcs: next, prev: r}
+}
+
+func (m *regexpMatcher) accepts(state matchState) bool {
+	s := state.(*regexpState)
+	if s.pending != "" {
+		return false
+	}
+	for _, pc := range m.resolve(s.pcs, s.prev, -1) {
+		if m.prog.Inst[pc].Op == syntax.InstMatch {
+			return true
+		}
+	}
+	return false
+}
+
+// matches reports whether the whole string matches
+func (m *regexpMatcher) matches(str string) bool {
+	state := m.start()
+	for i := 0; i < len(str) && state != nil; i++ {
+		state = m.step(state, str[i])
+	}
+	return state != nil && m.accepts(state)
+}
+
+////////////////////////////////////   Inner Functions   //////////////////////////////////////////////////
+
+// resolve evaluates the pending empty-width assertions between the runes prev and next (-1 for the
+// beginning or end of the string)
+func (m *regexpMatcher) resolve(pcs []uint32, prev, next rune) []uint32 {
+	flags := syntax.EmptyOpContext(prev, next)
+	var resolved []uint32
+	for _, pc := range pcs {
+		resolved = m.closure(resolved, pc, true, flags)
+	}
+	return resolved
+}
+
+// closure adds pc and every instruction reachable from it without consuming a rune to the sorted set. Empty-width
+// assertions are only followed if their context is known. Instructions that were visited before are already in
+// the set, so loops of empty matches like (a|)* terminate.
+func (m *regexpMatcher) closure(set []uint32, pc uint32, known bool, flags syntax.EmptyOp) []uint32 {
+	i := sort.Search(len(set), func(i int) bool { return set[i] >= pc })
+	if i < len(set) && set[i] == pc {
+		return set
+	}
+	set = append(set, 0)
+	copy(set[i+1:], set[i:])
+	set[i] = pc
+
+	inst := &m.prog.Inst[pc]
+	switch inst.Op {
+	case syntax.InstAlt, syntax.InstAltMatch:
+		set = m.closure(set, inst.Out, known, flags)
+		set = m.closure(set, inst.Arg, known, flags)
+	case syntax.InstCapture, syntax.InstNop:
+		set = m.closure(set, inst.Out, known, flags)
+	case syntax.InstEmptyWidth:
+		if known && syntax.EmptyOp(inst.Arg)&^flags == 0 {
+			set = m.closure(set, inst.Out, known, flags)
+		}
+	}
+	return set
+}
+
+func matchesRune(inst *syntax.Inst, r rune) bool {
+	switch inst.Op {
+	case syntax.InstRune:
+		return inst.MatchRune(r)
+	case syntax.InstRune1:
+		return r == inst.Rune[0]
+	case syntax.InstRuneAny:
+		return true
+	case syntax.InstRuneAnyNotNL:
+		return r != '\n'
+	}
+	return false
+}
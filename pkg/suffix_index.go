@@ -0,0 +1,108 @@
+package pkg
+
+import (
+	"sort"
+	"strings"
+)
+
+// suffixSeparator separates a suffix from its tag value in the keys of the suffix index
+const suffixSeparator = '\x00'
+
+// findSuffixMatchedNodes answers a pattern with a leading wildcard from the suffix index. Only the tag values
+// with a suffix starting with chunk, or equal to chunk if anchored, are visited and matched against the pattern.
+func (t *TagValueIndex) findSuffixMatchedNodes(g *globMatcher, chunk string, anchored bool) (nodeList []TagNodePair) {
+	prefix := chunk
+	if anchored {
+		prefix += string(suffixSeparator)
+	}
+	subtree := t.suffixIndex().findPrefix(prefix)
+	if subtree == nil {
+		return nil
+	}
+
+	// a tag value is found once for every suffix that contains chunk
+	seen := make(map[string]bool)
+	var tagValues []string
+	for _, nodePair := range (&Node{Tree: subtree}).getAllSubNodeList() {
+		for _, tagValue := range splitSuffixKey(nodePair.str) {
+			if !seen[tagValue] {
+				seen[tagValue] = true
+				tagValues = append(tagValues, tagValue)
+			}
+		}
+	}
+	sort.Strings(tagValues)
+
+	for _, tagValue := range tagValues {
+		if leaf := t.find(tagValue); leaf != nil && g.matches(tagValue) {
+			nodeList = append(nodeList, TagNodePair{
+				str:      leaf.Data,
+				nodeList: leaf.NodeList,
+			})
+		}
+	}
+	return nodeList
+}
+
+// suffixIndex returns the index of the suffixes of all tag values. It is a second prefix Tree whose keys are every
+// suffix of a tag value followed by suffixSeparator and the tag value itself, so the tag values containing a string
+// are the keys below it. Like the numeric index, it is derived data that is built on first use and kept up to date
+// afterwards.
+func (t *TagValueIndex) suffixIndex() *TagValueIndex {
+	d := t.getDerived()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.suffix == nil {
+		d.suffix = &TagValueIndex{}
+		for _, nodePair := range (&Node{Tree: t}).getAllSubNodeList() {
+			for i := 0; i < len(nodePair.str); i++ {
+				d.suffix.insert(suffixKey(nodePair.str, i))
+			}
+		}
+	}
+	return d.suffix
+}
+
+// withSuffixes returns a copy of the suffix index with or without the keys of every non-empty suffix of tagValue
+func (t *TagValueIndex) withSuffixes(tagValue string, present bool) *TagValueIndex {
+	for i := 0; i < len(tagValue); i++ {
+		key := suffixKey(tagValue, i)
+		t = t.withKey(key, key, nil, present)
+	}
+	return t
+}
+
+// suffixKey returns the key of the suffix of tagValue starting at i
+func suffixKey(tagValue string, i int) string {
+	return tagValue[i:] + string(suffixSeparator) + tagValue
+}
+
+// findPrefix returns the Tree Node below which all keys start with prefix, or nil if no key does.
+func (t *TagValueIndex) findPrefix(prefix string) *TagValueIndex {
+	for len(prefix) > 0 {
+		ix := sort.Search(len(t.SubNodes),
+			func(i int) bool { return t.SubNodes[i].Str[0] >= prefix[0] })
+		if ix == len(t.SubNodes) || t.SubNodes[ix].Str[0] != prefix[0] {
+			return nil
+		}
+		sub_node := t.SubNodes[ix]
+		m := matchingChars(sub_node.Str, prefix)
+		if m < len(sub_node.Str) && m < len(prefix) {
+			return nil
+		}
+		t, prefix = sub_node.Tree, prefix[m:]
+	}
+	return t
+}
+
+// splitSuffixKey returns the tag values a key of the suffix index can belong to. A key is the suffix, the
+// separator and the tag value, where the tag value ends with the suffix. That is unambiguous unless tag values
+// contain the separator themselves, then every valid split is returned and the caller checks the candidates.
+func splitSuffixKey(key string) (tagValues []string) {
+	for i := 0; i < len(key); i++ {
+		if key[i] == suffixSeparator && strings.HasSuffix(key[i+1:], key[:i]) {
+			tagValues = append(tagValues, key[i+1:])
+		}
+	}
+	return tagValues
+}
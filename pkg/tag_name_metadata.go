@@ -0,0 +1,207 @@
+package pkg
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/go-zookeeper/zk"
+)
+
+// ErrUnknownTagName is returned for the metadata of a tag name that is not in the Trie
+var ErrUnknownTagName = errors.New("unknown tag name")
+
+// ErrCorruptTagNameMetadata is returned for metadata that cannot be decoded
+var ErrCorruptTagNameMetadata = errors.New("corrupt tag name metadata")
+
+// TagValueType is the kind of the tag values of a tag name
+type TagValueType string
+
+const (
+	TagValueTypeUnknown TagValueType = ""        // no tag values were seen yet
+	TagValueTypeString  TagValueType = "string"  // no tag value is a number
+	TagValueTypeNumeric TagValueType = "numeric" // every tag value is a number, see FindNodesInRange
+	TagValueTypeMixed   TagValueType = "mixed"   // some tag values are numbers
+)
+
+// TagNameMetadata describes a tag name. It is the data of the eow znode that ends the tag name in the Trie, encoded
+// as JSON, so it is added and removed together with the tag name. A tag name added before metadata existed has the
+// zero metadata.
+type TagNameMetadata struct {
+	FirstSeen      time.Time    `json:"firstSeen"`             // when AddTagName first added the tag name
+	Nodes          int          `json:"nodes"`                 // number of nodes carrying the tag name
+	DistinctValues int          `json:"distinctValues"`        // number of distinct tag values
+	ValueType      TagValueType `json:"valueType,omitempty"`   // kind of the tag values
+	Description    string       `json:"description,omitempty"` // free-form, set by operators
+}
+
+// GetTagNameMetadata returns the metadata of a tag name, or ErrUnknownTagName if the tag name is not in the Trie
+func (zc *ZkClient) GetTagNameMetadata(tagName string) (TagNameMetadata, error) {
+	return zc.getMetadata(zc.Layout(), tagName)
+}
+
+// UpdateTagNameMetadata runs a read-modify-write of the metadata of a tag name, e.g. to set its Description. The
+// write checks the version of the eow znode and update runs again on the metadata a concurrent writer set.
+func (zc *ZkClient) UpdateTagNameMetadata(tagName string, update func(metadata *TagNameMetadata)) error {
+	return zc.updateMetadata(zc.Layout(), tagName, func(metadata *TagNameMetadata) bool {
+		update(metadata)
+		return true
+	})
+}
+
+// UpdateTagNameStats sets the number of nodes, the number of distinct tag values and the value type of a tag name
+// from its index. The metadata is not kept up to date by AddPosting and RemovePosting, it holds the stats of the
+// index last passed here.
+func (zc *ZkClient) UpdateTagNameStats(tagName string, index *TagValueIndex) error {
+	nodes, valueType := NewBitmap(), TagValueTypeUnknown
+	nodePairs := (&Node{Tree: index.Snapshot()}).getAllSubNodeList()
+	for _, nodePair := range nodePairs {
+		nodes = nodes.Or(nodePair.nodeList)
+		valueType = valueType.with(nodePair.str)
+	}
+	return zc.updateMetadata(zc.Layout(), tagName, func(metadata *TagNameMetadata) bool {
+		metadata.Nodes, metadata.DistinctValues, metadata.ValueType = nodes.Cardinality(), len(nodePairs), valueType
+		return true
+	})
+}
+
+////////////////////////////////////   Inner Functions   //////////////////////////////////////////////////
+
+// root returns the root of the Trie of the layout that holds the metadata
+func (l TrieLayout) root() string {
+	if l == RadixTrieLayout {
+		return TagNameRadixTriePath
+	}
+	return TagNameTriePath
+}
+
+// with returns the value type after another tag value was seen
+func (t TagValueType) with(tagValue string) TagValueType {
+	valueType := TagValueTypeString
+	if _, ok := parseNumericValue(tagValue); ok {
+		valueType = TagValueTypeNumeric
+	}
+	switch t {
+	case TagValueTypeUnknown, valueType:
+		return valueType
+	}
+	return TagValueTypeMixed
+}
+
+// stampFirstSeen sets the time a tag name was first added, unless it is set already. A tag name that a concurrent
+// RemoveTagName removed right after it was added is not stamped.
+func (zc *ZkClient) stampFirstSeen(tagName string) error {
+	now := time.Now().UTC()
+	err := zc.updateMetadata(zc.Layout(), tagName, func(metadata *TagNameMetadata) bool {
+		if !metadata.FirstSeen.IsZero() {
+			return false
+		}
+		metadata.FirstSeen = now
+		return true
+	})
+	if err == ErrUnknownTagName {
+		return nil
+	}
+	return err
+}
+
+// getMetadata returns the metadata of a tag name in the Trie of the layout
+func (zc *ZkClient) getMetadata(layout TrieLayout, tagName string) (metadata TagNameMetadata, err error) {
+	err = zc.retryConflicts(zc.trieRoot(layout.root()), func() error {
+		path, err := zc.tagNameEow(layout, tagName)
+		if err != nil {
+			return err
+		}
+		data, _, err := zc.zkConn.Get(path)
+		if err != nil {
+			return err
+		}
+		metadata, err = decodeTagNameMetadata(data)
+		return err
+	})
+	return metadata, err
+}
+
+// updateMetadata runs a read-modify-write of the metadata of a tag name in the Trie of the layout until the version
+// check of the eow znode succeeds, like updatePosting. A tag name whose znodes were pruned meanwhile is looked up
+// again.
+func (zc *ZkClient) updateMetadata(layout TrieLayout, tagName string, update func(metadata *TagNameMetadata) bool) error {
+	return zc.retryConflicts(zc.trieRoot(layout.root()), func() error {
+		path, err := zc.tagNameEow(layout, tagName)
+		if err != nil {
+			return err
+		}
+		data, stat, err := zc.zkConn.Get(path)
+		if err != nil {
+			return err
+		}
+		metadata, err := decodeTagNameMetadata(data)
+		if err != nil {
+			return err
+		}
+		if !update(&metadata) {
+			return nil
+		}
+		data, err = json.Marshal(metadata)
+		if err != nil {
+			return err
+		}
+		_, err = zc.zkConn.Set(path, data, stat.Version)
+		return err
+	})
+}
+
+// tagNameEow returns the path of the eow znode of a tag name in the Trie of the layout, or ErrUnknownTagName
+func (zc *ZkClient) tagNameEow(layout TrieLayout, tagName string) (string, error) {
+	parent := zc.trieRoot(layout.root())
+	if layout == RadixTrieLayout {
+		node := radixEdge{path: parent}
+		for rest := tagName; len(rest) > 0; {
+			edges, _, _, err := zc.radixEdges(node)
+			if err != nil {
+				return "", err
+			}
+			ix := searchRadixEdges(edges, rest[0])
+			if ix == len(edges) || !strings.HasPrefix(rest, edges[ix].label) {
+				return "", ErrUnknownTagName
+			}
+			node, rest = edges[ix], rest[len(edges[ix].label):]
+		}
+		parent = node.path
+	} else {
+		for i := 0; i < len(tagName); i++ {
+			parent = JoinPath(parent, EscapeZnodeName(tagName[i:i+1]))
+		}
+	}
+
+	path := JoinPath(parent, endOfWordNode)
+	exists, _, err := zc.zkConn.Exists(path)
+	if err != nil {
+		return "", err
+	}
+	if !exists {
+		if layout == RadixTrieLayout {
+			// unless the node of the tag name was pruned meanwhile, which the retry finds out
+			exists, _, err := zc.zkConn.Exists(parent)
+			if err != nil {
+				return "", err
+			}
+			if !exists {
+				return "", zk.ErrNoNode
+			}
+		}
+		return "", ErrUnknownTagName
+	}
+	return path, nil
+}
+
+func decodeTagNameMetadata(data []byte) (metadata TagNameMetadata, err error) {
+	if len(data) == 0 {
+		return metadata, nil
+	}
+	if err := json.Unmarshal(data, &metadata); err != nil {
+		return metadata, ErrCorruptTagNameMetadata
+	}
+	return metadata, nil
+}
@@ -1,18 +1,38 @@
 package pkg
 
 import (
-	"bytes"
-	"encoding/gob"
-	"log"
+	"fmt"
 	"sort"
-	"strconv"
+	"strings"
+	"sync"
 )
 
+// TagValueIndex is a prefix Tree of tag values. It is safe for concurrent use: the Tree Nodes are never modified
+// once they are reachable from the root, a modification copies the Tree Nodes on its path instead and then installs
+// the new root. Writers are serialized, readers work on a Snapshot and are never blocked by a writer.
 type TagValueIndex struct {
 	SubNodes []Node
-	NodeList []uint32
+	NodeList *Bitmap
 	Data     string
 	IsEnd    bool
+
+	count   int             // number of (tag value, node) pairs in the subtree, i.e. the sum of its NodeList sizes
+	derived *derivedIndexes // indexes derived from the tag values, only kept at the root
+	live    *liveIndex      // only set at the root of an index that can be modified, nil for a Snapshot
+}
+
+// liveIndex guards the root of a modifiable TagValueIndex
+type liveIndex struct {
+	writeMu sync.Mutex   // held by a writer for its whole modification
+	rootMu  sync.RWMutex // held while the root fields are read for a Snapshot or replaced by a writer
+}
+
+// derivedIndexes belong to one version of the root. They are built on first use by whichever reader needs them
+// and afterwards carried over to the next versions by the writers.
+type derivedIndexes struct {
+	mu      sync.Mutex
+	numeric *TagValueIndex // ordered index of the numeric tag values
+	suffix  *TagValueIndex // index of the suffixes of the tag values
 }
 
 type Node struct {
@@ -22,7 +42,8 @@ type Node struct {
 
 type TagNodePair struct {
 	str      string
-	nodeList []uint32
+	nodeList *Bitmap
+	distance int // edit distance to the searched tag value, only set by fuzzy searches
 }
 
 func (t *TagNodePair) GetStr() string {
@@ -30,89 +51,343 @@ func (t *TagNodePair) GetStr() string {
 }
 
 func (t *TagNodePair) GetNodeList() string {
-	var ret string
-	for _, v := range t.nodeList {
-		ret += strconv.Itoa(int(v)) + ", "
-	}
-	return ret[:len(ret)-2]
+	return t.nodeList.String()
+}
+
+// GetDistance returns the edit distance between the tag value and the searched one of a fuzzy search, 0 otherwise.
+func (t *TagNodePair) GetDistance() int {
+	return t.distance
+}
+
+// GetNodes returns the nodes of the tag value. The Bitmap is shared with the prefix Tree and must not be modified.
+func (t *TagNodePair) GetNodes() *Bitmap {
+	return t.nodeList
 }
 
 // New returns an empty prefix Tree.
 func NewTagValueIndex() *TagValueIndex {
-	return new(TagValueIndex)
+	return (&TagValueIndex{}).newLive()
 }
 
-// FindAllMatchedNodes searches the prefix Tree for all strings that uniquely matches the prefix.
-func (t *TagValueIndex) FindAllMatchedNodes(prefix string) (nodeList []TagNodePair, err error) {
-outerLoop:
-	for {
-		if len(prefix) == 0 {
-			if t.IsEnd {
-				nodeList = append(nodeList, TagNodePair{
-					str:      t.Data,
-					nodeList: t.NodeList,
-				})
-				return nodeList, nil
-			} else {
-				return []TagNodePair{}, nil
-			}
-		} else if prefix[0] == '*' {
-			if t.IsEnd {
-				nodeList = append(nodeList, TagNodePair{
-					str:      t.Data,
-					nodeList: t.NodeList,
-				})
-			}
-			for _, n := range t.SubNodes {
-				nodeList = append(nodeList, n.getAllSubNodeList()...)
-			}
-			return nodeList, nil
+// Snapshot returns an immutable view of the prefix Tree as it is now. Later modifications are not visible in it, so
+// a search or an iteration that needs several reads sees a consistent state. All read methods take a Snapshot
+// themselves, and calling Snapshot on a Snapshot returns it unchanged. A Snapshot cannot be modified.
+func (t *TagValueIndex) Snapshot() *TagValueIndex {
+	if t.live == nil {
+		return t
+	}
+	t.live.rootMu.RLock()
+	defer t.live.rootMu.RUnlock()
+	return &TagValueIndex{
+		SubNodes: t.SubNodes,
+		NodeList: t.NodeList,
+		Data:     t.Data,
+		IsEnd:    t.IsEnd,
+		count:    t.count,
+		derived:  t.derived,
+	}
+}
+
+// FindAllMatchedNodes searches the prefix Tree for all tag values that match the pattern. The pattern supports
+// the same *-wildcard and ?-wildcard as ZkClient.SearchTagName, anywhere in the pattern. Patterns with a leading
+// wildcard like "*US" or "*US*" are looked up in an index of the suffixes of the tag values, so only tag values
+// containing their literal part are visited. Results are returned in lexicographical order.
+func (t *TagValueIndex) FindAllMatchedNodes(pattern string) (nodeList []TagNodePair, err error) {
+	t = t.Snapshot()
+	g := newGlobMatcher(pattern)
+	if chunk, anchored := g.suffixChunk(); chunk != "" {
+		return t.findSuffixMatchedNodes(g, chunk, anchored), nil
+	}
+	t.walkGlobMatched(g, g.start(), func(n *TagValueIndex, whole bool) {
+		if whole {
+			nodeList = append(nodeList, (&Node{Tree: n}).getAllSubNodeList()...)
+		} else {
+			nodeList = append(nodeList, TagNodePair{
+				str:      n.Data,
+				nodeList: n.NodeList,
+			})
 		}
+	})
+	return nodeList, nil
+}
 
-		// Figure out which SubNodes to consider. use binary search for two candidate SubNodes
-		var start, stop int
+// Count returns the number of (tag value, node) pairs matching the pattern, i.e. the sum of the NodeList sizes of
+// all matching tag values. Every subtree keeps its count, so a subtree whose tag values all match, like the one
+// below "East" for "East*", is counted without visiting its tag values.
+func (t *TagValueIndex) Count(pattern string) (count int, err error) {
+	t = t.Snapshot()
+	g := newGlobMatcher(pattern)
+	if chunk, anchored := g.suffixChunk(); chunk != "" {
+		for _, nodePair := range t.findSuffixMatchedNodes(g, chunk, anchored) {
+			count += nodePair.nodeList.Cardinality()
+		}
+		return count, nil
+	}
+	t.walkGlobMatched(g, g.start(), func(n *TagValueIndex, whole bool) {
+		if whole {
+			count += n.count
+		} else {
+			count += n.NodeList.Cardinality()
+		}
+	})
+	return count, nil
+}
 
-		ix := sort.Search(len(t.SubNodes),
-			func(i int) bool { return t.SubNodes[i].Str >= prefix })
-		start, stop = maxInt(0, ix-1), minInt(ix, len(t.SubNodes)-1)
+// CountDistinctNodes returns the number of distinct nodes that carry a tag value matching the pattern. Unlike
+// Count, a node with several matching tag values is only counted once, so the node lists of all matching tag values
+// are merged: it costs as much as FindAllMatchedNodes, while Count answers wildcard patterns from the counts kept per
+// subtree. A pattern matching nothing returns before the merge.
+func (t *TagValueIndex) CountDistinctNodes(pattern string) (int, error) {
+	t = t.Snapshot()
+	if n, err := t.Count(pattern); err != nil || n == 0 {
+		return 0, err
+	}
+	data, err := t.FindAllMatchedNodes(pattern)
+	if err != nil {
+		return 0, err
+	}
+	nodes := NewBitmap()
+	for _, nodePair := range data {
+		nodes = nodes.Or(nodePair.nodeList)
+	}
+	return nodes.Cardinality(), nil
+}
 
-		// Perform the check on all candidate SubNodes.
-		for i := start; i <= stop; i++ {
-			cur_node := &t.SubNodes[i]
-			m := matchingChars(prefix, cur_node.Str)
-			switch {
-			case m == len(cur_node.Str):
-				// Full Node match, so proceed down subtree.
-				t, prefix = cur_node.Tree, prefix[m:]
-				continue outerLoop
-			case m == len(prefix)-1 && prefix[len(prefix)-1] == '*':
-				nodeList = cur_node.getAllSubNodeList()
-				return nodeList, nil
-			case m == len(prefix):
-				if t.IsEnd {
-					nodeList = cur_node.getAllSubNodeList()
-					return nodeList, nil
-				} else {
-					return []TagNodePair{}, nil
-				}
-			}
-		}
-		return nil, nil
+// FindRegexpMatchedNodes searches the prefix Tree for all tag values that fully match the regular expression in
+// RE2 syntax. The compiled automaton is walked along the Tree, so subtrees that cannot match are never visited.
+// Results are returned in lexicographical order.
+func (t *TagValueIndex) FindRegexpMatchedNodes(expr string) (nodeList []TagNodePair, err error) {
+	t = t.Snapshot()
+	m, err := newRegexpMatcher(expr)
+	if err != nil {
+		return nil, err
 	}
+	t.findMatchedNodes(m, m.start(), &nodeList)
+	return nodeList, nil
+}
+
+// FindFuzzyMatchedNodes searches the prefix Tree for all tag values within maxDistance insertions, deletions or
+// substitutions of characters from tagValue. Subtrees whose prefix is already too far away are never visited.
+// Results are ordered by distance, then lexicographically.
+func (t *TagValueIndex) FindFuzzyMatchedNodes(tagValue string, maxDistance int) (nodeList []TagNodePair, err error) {
+	t = t.Snapshot()
+	if maxDistance < 0 {
+		return nil, fmt.Errorf("negative edit distance %d", maxDistance)
+	}
+	m := newFuzzyMatcher(tagValue, maxDistance)
+	t.findMatchedNodes(m, m.start(), &nodeList)
+	for i := range nodeList {
+		nodeList[i].distance = m.distance(nodeList[i].str)
+	}
+	sort.SliceStable(nodeList, func(i, j int) bool { return nodeList[i].distance < nodeList[j].distance })
+	return nodeList, nil
 }
 
 // AddTagValue a string and single one NodeList to the prefix Tree.
 func (t *TagValueIndex) AddTagValue(tagValue string, nodeValue uint32) {
+	t.update(func(root *TagValueIndex) *TagValueIndex {
+		leaf := root.find(tagValue)
+		if leaf != nil && leaf.NodeList.Contains(nodeValue) {
+			return root
+		}
+		var nodes *Bitmap
+		if leaf != nil {
+			nodes = leaf.NodeList
+		}
+		nodes = nodes.cloneFor(nodeValue)
+		nodes.Add(nodeValue)
+		return root.withNodeList(tagValue, nodes)
+	})
+}
+
+// RemoveTagValue removes a single node from the NodeList of tagValue. A value whose NodeList becomes empty
+// is dropped from the prefix Tree. It reports whether the node was found.
+func (t *TagValueIndex) RemoveTagValue(tagValue string, nodeValue uint32) (removed bool) {
+	t.update(func(root *TagValueIndex) *TagValueIndex {
+		leaf := root.find(tagValue)
+		if leaf == nil || !leaf.NodeList.Contains(nodeValue) {
+			return root
+		}
+		nodes := leaf.NodeList.cloneFor(nodeValue)
+		removed = nodes.Remove(nodeValue)
+		return root.withNodeList(tagValue, nodes)
+	})
+	return removed
+}
+
+// DeleteTagValue drops tagValue and its whole NodeList from the prefix Tree.
+func (t *TagValueIndex) DeleteTagValue(tagValue string) (removed bool) {
+	t.update(func(root *TagValueIndex) *TagValueIndex {
+		if root.find(tagValue) == nil {
+			return root
+		}
+		removed = true
+		return root.withNodeList(tagValue, nil)
+	})
+	return removed
+}
+
+// RemoveNode removes a node from the NodeList of every tag value, e.g. when a host is decommissioned.
+// It returns the number of tag values the node was removed from.
+func (t *TagValueIndex) RemoveNode(nodeValue uint32) (removed int) {
+	t.update(func(root *TagValueIndex) *TagValueIndex {
+		var dropped []string
+		var next *TagValueIndex
+		next, removed = root.withoutNode(nodeValue, &dropped)
+		if removed == 0 {
+			return root
+		}
+		next.derived = root.derived
+		for _, tagValue := range dropped {
+			next.derived = next.derived.withTagValue(tagValue, false)
+		}
+		return next
+	})
+	return removed
+}
+
+////////////////////////////////////   Inner Functions   //////////////////////////////////////////////////
+
+// walkGlobMatched walks the subtree one character at a time, carrying the glob state along, and prunes every
+// SubNode whose Str leaves no position to match from. fn is called with whole set for a subtree whose tag values
+// all match, and with whole unset for a single matching tag value.
+func (t *TagValueIndex) walkGlobMatched(g *globMatcher, state []int, fn func(n *TagValueIndex, whole bool)) {
+	if g.acceptsAll(state) {
+		fn(t, true)
+		return
+	}
+	if t.IsEnd && g.accepts(state) {
+		fn(t, false)
+	}
+
+	subNodes := t.SubNodes
+	if c, ok := g.literal(state); ok {
+		// only one SubNode can start with a literal character, so use binary search for it.
+		ix := sort.Search(len(subNodes), func(i int) bool { return subNodes[i].Str[0] >= c })
+		if ix == len(subNodes) || subNodes[ix].Str[0] != c {
+			return
+		}
+		subNodes = subNodes[ix : ix+1]
+	}
+
+	for _, n := range subNodes {
+		next := state
+		for i := 0; i < len(n.Str) && len(next) > 0; i++ {
+			next = g.step(next, n.Str[i])
+		}
+		if len(next) > 0 {
+			n.Tree.walkGlobMatched(g, next, fn)
+		}
+	}
+}
+
+// findMatchedNodes walks the subtree with any matcher and prunes every SubNode the matcher dies on.
+func (t *TagValueIndex) findMatchedNodes(m matcher, state matchState, nodeList *[]TagNodePair) {
+	if t.IsEnd && m.accepts(state) {
+		*nodeList = append(*nodeList, TagNodePair{
+			str:      t.Data,
+			nodeList: t.NodeList,
+		})
+	}
+	for _, n := range t.SubNodes {
+		next := state
+		for i := 0; i < len(n.Str) && next != nil; i++ {
+			next = m.step(next, n.Str[i])
+		}
+		if next != nil {
+			n.Tree.findMatchedNodes(m, next, nodeList)
+		}
+	}
+}
+
+// newLive turns a root that is not published yet into a modifiable index
+func (t *TagValueIndex) newLive() *TagValueIndex {
+	t.live, t.derived = &liveIndex{}, &derivedIndexes{}
+	return t
+}
+
+// update runs change on a Snapshot of the root and installs the root it returns. change must not modify the Tree
+// Nodes it is given, but build the new root with the copy-on-write functions below.
+func (t *TagValueIndex) update(change func(root *TagValueIndex) *TagValueIndex) {
+	if t.live == nil {
+		panic("dmi: modifying a TagValueIndex snapshot")
+	}
+	t.live.writeMu.Lock()
+	defer t.live.writeMu.Unlock()
+	root := t.Snapshot()
+	next := change(root)
+	if next == root {
+		return
+	}
+
+	t.live.rootMu.Lock()
+	defer t.live.rootMu.Unlock()
+	t.SubNodes, t.NodeList, t.Data, t.IsEnd = next.SubNodes, next.NodeList, next.Data, next.IsEnd
+	t.count, t.derived = next.count, next.derived
+}
+
+// withNodeList returns a new root in which tagValue has the NodeList nodes, or is dropped if nodes is empty. The
+// derived indexes that are built already get the added or dropped tag value as well.
+func (t *TagValueIndex) withNodeList(tagValue string, nodes *Bitmap) *TagValueIndex {
+	existed, present := t.find(tagValue) != nil, !nodes.IsEmpty()
+	next := t.withKey(tagValue, tagValue, nodes, present)
+	next.derived = t.derived
+	if existed != present {
+		next.derived = t.derived.withTagValue(tagValue, present)
+	}
+	return next
+}
+
+// getDerived returns the derived indexes of the root. A prefix Tree that was not created by NewTagValueIndex or
+// decoded from a blob does not cache them.
+func (t *TagValueIndex) getDerived() *derivedIndexes {
+	if t.derived == nil {
+		return &derivedIndexes{}
+	}
+	return t.derived
+}
+
+// withTagValue returns the derived indexes of the next root version with tagValue added or removed. Indexes that
+// are not built yet stay unbuilt.
+func (d *derivedIndexes) withTagValue(tagValue string, present bool) *derivedIndexes {
+	d.mu.Lock()
+	next := &derivedIndexes{numeric: d.numeric, suffix: d.suffix}
+	d.mu.Unlock()
+	if next.numeric != nil {
+		next.numeric = next.numeric.withNumericValue(tagValue, present)
+	}
+	if next.suffix != nil {
+		next.suffix = next.suffix.withSuffixes(tagValue, present)
+	}
+	return next
+}
+
+func (n *Node) getAllSubNodeList() (data []TagNodePair) {
+	if n.Tree.IsEnd {
+		data = append(data, TagNodePair{
+			str:      n.Tree.Data,
+			nodeList: n.Tree.NodeList,
+		})
+	}
+	for _, subnode := range n.Tree.SubNodes {
+		data = append(data, subnode.getAllSubNodeList()...)
+	}
+	return data
+}
+
+// insert adds tagValue to the prefix Tree in place, splitting SubNodes as needed. It is only used to build a
+// prefix Tree that is not published yet. It returns the Tree Node of tagValue and whether tagValue is new.
+func (t *TagValueIndex) insert(tagValue string) (leaf *TagValueIndex, created bool) {
 	originTag := tagValue
 outerLoop:
 	for {
 
 		// consumed the entire string
 		if len(tagValue) == 0 {
+			created = !t.IsEnd
 			t.IsEnd = true
-			t.NodeList = append(t.NodeList, nodeValue)
 			t.Data = originTag
-			break outerLoop
+			return t, created
 		}
 
 		// FindAllMatchedNodes the lexicographical Node insertion point.
@@ -140,57 +415,173 @@ outerLoop:
 
 		// No split necessary, insert a new Node and subtree.
 		if splitNode == nil {
-			subtree := &TagValueIndex{NodeList: []uint32{nodeValue}, IsEnd: true, Data: originTag}
+			subtree := &TagValueIndex{IsEnd: true, Data: originTag}
 			t.SubNodes = append(t.SubNodes[:ix],
 				append([]Node{{tagValue, subtree}}, t.SubNodes[ix:]...)...)
-			break outerLoop
+			return subtree, true
 		}
 
 		// A split is necessary
 		s1, s2 := splitNode.Str[:splitIndex], splitNode.Str[splitIndex:]
 		child := &TagValueIndex{
 			SubNodes: []Node{{s2, splitNode.Tree}},
+			count:    splitNode.Tree.count,
 		}
 		splitNode.Str, splitNode.Tree = s1, child
 		t, tagValue = child, tagValue[splitIndex:]
 	}
 }
 
-// EncodeTagIndexToBytes convert a TagIndex struct to byte array
-func EncodeTagValueIndexToBytes(p interface{}) []byte {
-	buf := bytes.Buffer{}
-	enc := gob.NewEncoder(&buf)
-	err := enc.Encode(p)
-	if err != nil {
-		log.Fatal(err)
+// putNodeList sets the whole NodeList of tagValue, e.g. when a posting is read from the per-value layout.
+func (t *TagValueIndex) putNodeList(tagValue string, nodes *Bitmap) {
+	t.update(func(root *TagValueIndex) *TagValueIndex {
+		return root.withNodeList(tagValue, nodes)
+	})
+}
+
+// find returns the Tree Node of tagValue, or nil if tagValue is not in the prefix Tree.
+func (t *TagValueIndex) find(tagValue string) *TagValueIndex {
+	for len(tagValue) > 0 {
+		ix := sort.Search(len(t.SubNodes),
+			func(i int) bool { return t.SubNodes[i].Str[0] >= tagValue[0] })
+		if ix == len(t.SubNodes) || !strings.HasPrefix(tagValue, t.SubNodes[ix].Str) {
+			return nil
+		}
+		t, tagValue = t.SubNodes[ix].Tree, tagValue[len(t.SubNodes[ix].Str):]
+	}
+	if !t.IsEnd {
+		return nil
 	}
-	return buf.Bytes()
+	return t
 }
 
-// DecodeToTagIndex convert byte array to a TagIndex struct
-func DecodeBytesToTagValueIndex(s []byte) TagValueIndex {
-	p := TagValueIndex{}
-	dec := gob.NewDecoder(bytes.NewReader(s))
-	err := dec.Decode(&p)
-	if err != nil {
-		log.Fatal(err)
+// withKey returns a copy of the subtree in which key holds the tag value with its NodeList if present is set, or
+// no tag value otherwise. key is relative to the subtree. Only the Tree Nodes on the path are copied, the others are
+// shared with the subtree, and the copied path is compacted like after a removal.
+func (t *TagValueIndex) withKey(key, tagValue string, nodes *Bitmap, present bool) *TagValueIndex {
+	c := t.copy()
+	if len(key) == 0 {
+		if present {
+			c.IsEnd, c.NodeList, c.Data = true, nodes, tagValue
+		} else {
+			c.IsEnd, c.NodeList, c.Data = false, nil, ""
+		}
+		c.recount()
+		return c
 	}
-	return p
+
+	ix := sort.Search(len(c.SubNodes),
+		func(i int) bool { return c.SubNodes[i].Str[0] >= key[0] })
+	switch {
+	case ix < len(c.SubNodes) && c.SubNodes[ix].Str[0] == key[0]:
+		sub_node := c.SubNodes[ix]
+		m := matchingChars(sub_node.Str, key)
+		if m < len(sub_node.Str) {
+			if !present {
+				return t
+			}
+			// partial match, the copy gets a new Tree Node where key branches off.
+			sub_node = Node{sub_node.Str[:m], &TagValueIndex{
+				SubNodes: []Node{{sub_node.Str[m:], sub_node.Tree}},
+				count:    sub_node.Tree.count,
+			}}
+		}
+		c.SubNodes[ix] = Node{sub_node.Str, sub_node.Tree.withKey(key[m:], tagValue, nodes, present)}
+		c.compactSubNode(ix)
+	case !present:
+		return t
+	default:
+		c.SubNodes = append(c.SubNodes, Node{})
+		copy(c.SubNodes[ix+1:], c.SubNodes[ix:])
+		c.SubNodes[ix] = Node{key, (&TagValueIndex{}).withKey("", tagValue, nodes, present)}
+	}
+	c.recount()
+	return c
 }
 
-////////////////////////////////////   Inner Functions   //////////////////////////////////////////////////
+// withoutNode returns a copy of the subtree without the node in any NodeList and collects the tag values that got
+// dropped. Only the Tree Nodes on the paths to changed tag values are copied, the subtree itself is returned if
+// the node was not found.
+func (t *TagValueIndex) withoutNode(nodeValue uint32, dropped *[]string) (*TagValueIndex, int) {
+	var c *TagValueIndex
+	removed := 0
+	if t.IsEnd && t.NodeList.Contains(nodeValue) {
+		c = t.copy()
+		c.NodeList = t.NodeList.cloneFor(nodeValue)
+		c.NodeList.Remove(nodeValue)
+		removed++
+		if c.NodeList.IsEmpty() {
+			*dropped = append(*dropped, t.Data)
+			c.IsEnd, c.NodeList, c.Data = false, nil, ""
+		}
+	}
+	for i, sub_node := range t.SubNodes {
+		subtree, n := sub_node.Tree.withoutNode(nodeValue, dropped)
+		if n == 0 {
+			continue
+		}
+		if c == nil {
+			c = t.copy()
+		}
+		c.SubNodes[i].Tree = subtree
+		removed += n
+	}
+	if c == nil {
+		return t, 0
+	}
+	for i := 0; i < len(c.SubNodes); {
+		if !c.compactSubNode(i) {
+			i++
+		}
+	}
+	c.recount()
+	return c, removed
+}
 
-func (n *Node) getAllSubNodeList() (data []TagNodePair) {
-	if n.Tree.IsEnd {
-		data = append(data, TagNodePair{
-			str:      n.Tree.Data,
-			nodeList: n.Tree.NodeList,
-		})
+// copy returns a copy of the Tree Node with its own SubNodes, which can be changed without affecting readers of
+// the Tree Node.
+func (t *TagValueIndex) copy() *TagValueIndex {
+	return &TagValueIndex{
+		SubNodes: append([]Node(nil), t.SubNodes...),
+		NodeList: t.NodeList,
+		Data:     t.Data,
+		IsEnd:    t.IsEnd,
+		count:    t.count,
 	}
-	for _, subnode := range n.Tree.SubNodes {
-		data = append(data, subnode.getAllSubNodeList()...)
+}
+
+// recount sets the count of the Tree Node from its NodeList and the counts of its SubNodes.
+func (t *TagValueIndex) recount() {
+	t.count = t.NodeList.Cardinality()
+	for _, sub_node := range t.SubNodes {
+		t.count += sub_node.Tree.count
 	}
-	return data
+}
+
+// recountAll sets the counts of the whole subtree, e.g. after decoding a blob that does not hold them.
+func (t *TagValueIndex) recountAll() {
+	for _, sub_node := range t.SubNodes {
+		sub_node.Tree.recountAll()
+	}
+	t.recount()
+}
+
+// compactSubNode prunes SubNodes[i] if it became an empty leaf, or merges it with its only child.
+// It returns true if SubNodes[i] was removed.
+func (t *TagValueIndex) compactSubNode(i int) bool {
+	sub_node := &t.SubNodes[i]
+	if sub_node.Tree.IsEnd {
+		return false
+	}
+	switch len(sub_node.Tree.SubNodes) {
+	case 0:
+		t.SubNodes = append(t.SubNodes[:i], t.SubNodes[i+1:]...)
+		return true
+	case 1:
+		child := sub_node.Tree.SubNodes[0]
+		sub_node.Str, sub_node.Tree = sub_node.Str+child.Str, child.Tree
+	}
+	return false
 }
 
 func minInt(a, b int) int {
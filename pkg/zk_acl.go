@@ -0,0 +1,60 @@
+package pkg
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/go-zookeeper/zk"
+)
+
+// ZkACL is the authentication of a Zookeeper connection and the ACLs of the znodes created through it
+type ZkACL struct {
+	// Digest is the "user:password" the connection authenticates with, none if empty
+	Digest string
+	// Root is the ACL of the roots of the Tries, like TagNameTriePath
+	Root []zk.ACL
+	// Trie is the ACL of the znodes of the Tries
+	Trie []zk.ACL
+}
+
+// WorldZkACL lets anyone do anything, which is how the Tries were always created
+func WorldZkACL() *ZkACL {
+	world := zk.WorldACL(zk.PermAll)
+	return &ZkACL{Root: world, Trie: world}
+}
+
+// DigestZkACL authenticates with digest and creates znodes that only the writers may modify and the readers may
+// read, all given as "user:password"
+func DigestZkACL(digest string, writers []string, readers []string) (*ZkACL, error) {
+	var trie []zk.ACL
+	for _, users := range []struct {
+		credentials []string
+		perms       int32
+	}{
+		{credentials: writers, perms: zk.PermAll},
+		{credentials: readers, perms: zk.PermRead},
+	} {
+		for _, credentials := range users.credentials {
+			i := strings.Index(credentials, ":")
+			if i < 0 {
+				return nil, fmt.Errorf("zookeeper credentials %q are not user:password", credentials)
+			}
+			user, password := credentials[:i], credentials[i+1:]
+			trie = append(trie, zk.DigestACL(users.perms, user, password)...)
+		}
+	}
+	if len(trie) == 0 {
+		return nil, fmt.Errorf("no zookeeper writers or readers")
+	}
+	return &ZkACL{Digest: digest, Root: trie, Trie: trie}, nil
+}
+
+////////////////////////////////////   Inner Functions   //////////////////////////////////////////////////
+
+// authenticate adds the digest of the ACL to the connection, which re-sends it on every reconnect
+func (a *ZkACL) authenticate(zkConn *zk.Conn) error {
+	if a.Digest == "" {
+		return nil
+	}
+	return zkConn.AddAuth("digest", []byte(a.Digest))
+}
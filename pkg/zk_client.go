@@ -2,6 +2,8 @@ package pkg
 
 import (
 	"fmt"
+	"sort"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-zookeeper/zk"
@@ -9,233 +11,775 @@ import (
 
 const endOfWordNode = "eow"
 
+// suffixTrieReady is the data of TagNameSuffixTriePath once it holds the suffixes of every tag name, see
+// BuildSuffixTrie
+const suffixTrieReady = "ready"
+
 const ASTERISK_WILDCARD = '*' // matches zero or more characters
 const DOT_WILDCARD = '?'      // matches any single character
 
-// ConnectZk sets up a zookeeper connection
-func ConnectZk(zkAddr string) (*zk.Conn, error) {
-	conn, _, err := zk.Connect([]string{zkAddr}, 1*time.Second)
+// ConnectZk sets up a zookeeper connection to any of the given servers of an ensemble
+func ConnectZk(zkAddrs ...string) (*zk.Conn, error) {
+	conn, _, err := zk.Connect(zkAddrs, 1*time.Second)
 	return conn, err
 }
 
 func InitTagNameTriePath(zkConn *zk.Conn) (err error) {
-	exists, _, err := zkConn.Exists(TagNameTriePath)
-	if err != nil {
-		return err
-	}
+	return initTagNameTriePath(zkConn, DefaultNamespace, zk.WorldACL(zk.PermAll))
+}
 
-	if !exists {
-		_, err = zkConn.Create(TagNameTriePath, nil, 0, zk.WorldACL(zk.PermAll))
+func initTagNameTriePath(zkConn *zk.Conn, ns Namespace, acl []zk.ACL) (err error) {
+	if ns != DefaultNamespace {
+		// anyone may add a namespace, and delete one once its Tries are gone, which the ACL of its root guards
+		err = createRoot(zkConn, NamespacesPath, nil, zk.WorldACL(zk.PermRead|zk.PermCreate|zk.PermDelete))
 		if err != nil {
 			return err
 		}
+		if err = createRoot(zkConn, ns.ZkRoot(), nil, acl); err != nil {
+			return err
+		}
+	}
+	exists, _, err := zkConn.Exists(ns.trieRoot(TagNameTriePath))
+	if err != nil {
+		return err
 	}
+	if err = createRoot(zkConn, ns.trieRoot(TagNameTriePath), nil, acl); err != nil {
+		return err
+	}
+	// the suffix Trie of a new Trie holds every tag name from the start, the one of an existing Trie may lack the tag
+	// names added before it existed until BuildSuffixTrie ran
+	var data []byte
+	if !exists {
+		data = []byte(suffixTrieReady)
+	}
+	return createRoot(zkConn, ns.trieRoot(TagNameSuffixTriePath), data, acl)
+}
 
-	return nil
+// createRoot creates a root znode unless it exists. Zookeeper checks the permission to create below the parent
+// before whether the znode exists, so a client that may only read would fail with zk.ErrNoAuth on an existing root.
+func createRoot(zkConn *zk.Conn, path string, data []byte, acl []zk.ACL) error {
+	exists, _, err := zkConn.Exists(path)
+	if err != nil || exists {
+		return err
+	}
+	_, err = zkConn.Create(path, data, 0, acl)
+	if err == zk.ErrNodeExists {
+		return nil
+	}
+	return err
 }
 
 type ZkClient struct {
 	zkConn *zk.Conn
+	acl    *ZkACL
+	ns     atomic.Value // Namespace of the Tries, see Use
+	layout int32        // TrieLayout, accessed atomically since a migration switches it
+	suffix int32        // 1 once the suffix Trie of the namespace is known to be ready, see BuildSuffixTrie
+	cache  atomic.Value // *TrieCache answering the searches, see UseTrieCache
 }
 
-func CreateZkClient() (*ZkClient, error) {
-	zkConn, err := ConnectZk(ZkAddr)
+// CreateZkClient connects a client to the Zookeeper servers, or to ZkServers if none are given. The connection
+// moves to another server when one fails, and the client keeps working after its session expired, see
+// watchSession.
+func CreateZkClient(zkAddrs ...string) (*ZkClient, error) {
+	return CreateZkClientWithACL(WorldZkACL(), zkAddrs...)
+}
+
+// CreateZkClientWithACL is CreateZkClient for a client that authenticates and creates znodes as the ACL says
+func CreateZkClientWithACL(acl *ZkACL, zkAddrs ...string) (*ZkClient, error) {
+	if len(zkAddrs) == 0 {
+		zkAddrs = ZkServers
+	}
+	zkConn, events, err := zk.Connect(zkAddrs, 1*time.Second)
 	if err != nil {
 		return nil, err
 	}
 
 	client := &ZkClient{
 		zkConn: zkConn,
+		acl:    acl,
+	}
+	err = acl.authenticate(zkConn)
+	if err == nil {
+		err = client.initSession()
 	}
-
-	rootlock, err := CreateDistLock("", zkConn)
 	if err != nil {
+		zkConn.Close()
 		return nil, err
 	}
-	rootlock.Acquire()
-	InitTagNameTriePath(zkConn)
-	rootlock.Release()
+	go client.watchSession(events)
 
 	return client, nil
 }
 
+// Close closes the Zookeeper connection of the client
+func (zc *ZkClient) Close() {
+	zc.zkConn.Close()
+}
+
+// Namespace returns the namespace the client works in, the DefaultNamespace unless Use switched it
+func (zc *ZkClient) Namespace() Namespace {
+	ns, _ := zc.ns.Load().(Namespace)
+	return ns
+}
+
+// Use switches the client to a namespace, creating its Tries if it is new and detecting its layout. It must not be
+// called while other calls of the client are running, which would work in either namespace.
+func (zc *ZkClient) Use(ns Namespace) error {
+	zc.ns.Store(ns)
+	zc.setLayout(CharTrieLayout)
+	return zc.initSession()
+}
+
+// Namespaces returns the namespaces whose Tries exist, without the DefaultNamespace, in lexicographical order
+func (zc *ZkClient) Namespaces() ([]Namespace, error) {
+	children, _, err := zc.zkConn.Children(NamespacesPath)
+	if err == zk.ErrNoNode {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	namespaces := make([]Namespace, 0, len(children))
+	for _, child := range children {
+		namespaces = append(namespaces, Namespace(UnescapeZnodeName(child)))
+	}
+	sort.Slice(namespaces, func(i, j int) bool { return namespaces[i] < namespaces[j] })
+	return namespaces, nil
+}
+
+// ListTagNames returns all tag names of the namespace of the client in lexicographical order
+func (zc *ZkClient) ListTagNames() ([]string, error) {
+	return zc.SearchTagName(string(ASTERISK_WILDCARD))
+}
+
+// DeleteNamespace deletes the Tries and the etcd keys of a namespace. Clients still using it must Use it again
+// before adding tag names, the client itself does so if it is in the namespace.
+func (zc *ZkClient) DeleteNamespace(ns Namespace) error {
+	roots := []string{ns.ZkRoot()}
+	if ns == DefaultNamespace {
+		roots = []string{TagNameTriePath, TagNameSuffixTriePath, TagNameRadixTriePath, TagNameRadixSuffixTriePath}
+	}
+	for _, root := range roots {
+		err := DeleteZkRoot(root, zc.zkConn)
+		if err != nil && err != zk.ErrNoNode {
+			return err
+		}
+	}
+	if err := ns.DeleteIndexes(); err != nil {
+		return err
+	}
+
+	if ns == zc.Namespace() {
+		return zc.Use(ns)
+	}
+	return nil
+}
+
+// AddTagName adds the tag name to the Trie, and the first SuffixTrieDepth characters of each of its suffixes to the
+// suffix Trie. Such a suffix ends with an eow node whose children are the tag names having it, so searches with a
+// leading *-wildcard like "*ing" or "*US*" only visit the branch of their literal part, while a tag name of length L
+// adds at most L*SuffixTrieDepth znodes. The first AddTagName of a tag name sets its FirstSeen.
+//
+// Lock crabbing down the path of the tag name was asked for, and deliberately replaced by lock-free writes: Zookeeper
+// creates and deletes every znode atomically, so concurrent writers only have to tolerate existing nodes and retry a
+// path pruned under them, see addToTrie.
 func (zc *ZkClient) AddTagName(tagName string) error {
-	parent := TagNameTriePath
-	parentLock, err := CreateDistLock(parent, zc.zkConn)
+	err := zc.addTagName(tagName)
 	if err != nil {
 		return err
 	}
-	parentLock.Acquire()
+	return zc.stampFirstSeen(tagName)
+}
 
-	for i := 0; i < len(tagName); i++ {
-		character := tagName[i]
-		curPath := parent + fmt.Sprintf("/%c", character)
+func (zc *ZkClient) addTagName(tagName string) error {
+	if zc.Layout() == RadixTrieLayout {
+		return zc.addTagNameRadix(tagName)
+	}
 
-		exists, _, err := zc.zkConn.Exists(curPath)
+	err := zc.addToTrie(zc.trieRoot(TagNameTriePath), tagName, endOfWordNode)
+	if err != nil {
+		return err
+	}
+
+	for _, suffix := range suffixPrefixes(tagName) {
+		err = zc.addToTrie(zc.trieRoot(TagNameSuffixTriePath), suffix, endOfWordNode, EscapeZnodeName(tagName))
+		if err == zk.ErrNoNode {
+			// BuildSuffixTrie deleted the suffix Trie to build it again, its search finds the tag name
+			break
+		}
 		if err != nil {
-			parentLock.Release()
 			return err
 		}
-		if !exists {
-			_, err = zc.zkConn.Create(curPath, nil, 0, zk.WorldACL(zk.PermAll))
+	}
+
+	return zc.addMigratedTagName(tagName)
+}
+
+// BuildSuffixTrie fills the suffix Trie of a Trie whose tag names were added before the suffix Trie existed, or
+// while it kept whole suffixes, and marks it ready. Until then searches with a leading wildcard walk the whole Trie.
+// It does nothing if the suffix Trie is ready. Tag names added meanwhile are added to the suffix Trie by AddTagName,
+// but RemoveTagName must not run at the same time, nor two BuildSuffixTrie.
+func (zc *ZkClient) BuildSuffixTrie() error {
+	ready, err := zc.suffixTrieReady()
+	if err != nil || ready {
+		return err
+	}
+
+	root := zc.trieRoot(TagNameSuffixTriePath)
+	err = DeleteZkRoot(root, zc.zkConn)
+	if err != nil && err != zk.ErrNoNode {
+		return err
+	}
+	_, err = zc.zkConn.Create(root, nil, 0, zc.acl.Root)
+	if err != nil {
+		return err
+	}
+
+	g := newGlobMatcher("*")
+	tagNames, err := zc.searchTagNameMatching(zc.trieRoot(TagNameTriePath), globAutomaton{g}, g.start())
+	if err != nil {
+		return err
+	}
+	for _, tagName := range tagNames {
+		for _, suffix := range suffixPrefixes(tagName) {
+			err := zc.addToTrie(root, suffix, endOfWordNode, EscapeZnodeName(tagName))
 			if err != nil {
-				parentLock.Release()
 				return err
 			}
 		}
+	}
 
-		// Fine-grained Locking: lock-crabbing
-		// release parentLock after childLock is acquired
-		childLock, err := CreateDistLock(curPath, zc.zkConn)
-		if err != nil {
-			parentLock.Release()
-			return err
-		}
-		err = childLock.Acquire()
-		if err != nil {
-			parentLock.Release()
-			return err
-		}
-		err = parentLock.Release()
+	_, err = zc.zkConn.Set(root, []byte(suffixTrieReady), -1)
+	if err != nil {
+		return err
+	}
+	atomic.StoreInt32(&zc.suffix, 1)
+	return nil
+}
+
+// RemoveTagName removes the tag name from the Tries of both layouts, pruning the nodes that no longer lead to any
+// tag name, and deletes its index from etcd. Like AddTagName it takes no locks instead of the requested lock
+// crabbing: Zookeeper refuses to delete a znode with children, so a concurrent AddTagName of a tag name sharing a
+// prefix is never lost, see removeFromTrie.
+func (zc *ZkClient) RemoveTagName(tagName string) error {
+	err := zc.removeFromTrie(zc.trieRoot(TagNameTriePath), tagName, endOfWordNode)
+	if err != nil {
+		return err
+	}
+	for _, suffix := range suffixPrefixes(tagName) {
+		err = zc.removeFromTrie(zc.trieRoot(TagNameSuffixTriePath), suffix, endOfWordNode, EscapeZnodeName(tagName))
 		if err != nil {
-			childLock.Release()
 			return err
 		}
-
-		parent = curPath
-		parentLock = childLock
 	}
 
-	defer parentLock.Release()
-
-	exists, _, err := zc.zkConn.Exists(JoinPath(parent, endOfWordNode))
+	err = zc.removeRadix(zc.trieRoot(TagNameRadixTriePath), tagName, endOfWordNode)
 	if err != nil {
 		return err
 	}
-
-	if !exists {
-		_, err = zc.zkConn.Create(JoinPath(parent, endOfWordNode), nil, 0, zk.WorldACL(zk.PermAll))
+	for _, suffix := range suffixPrefixes(tagName) {
+		err = zc.removeRadix(zc.trieRoot(TagNameRadixSuffixTriePath), suffix, endOfWordNode, EscapeZnodeName(tagName))
 		if err != nil {
 			return err
 		}
 	}
 
-	return nil
+	return zc.Namespace().DeleteIndex(tagName)
 }
 
+// SearchTagName returns the tag names matching the *-wildcard and ?-wildcard pattern. Searches take no locks, a
+// node pruned by RemoveTagName while it is read holds no tag name anymore.
 func (zc *ZkClient) SearchTagName(regexp string) (results []string, err error) {
-	return zc.searchTagNameFromParent(TagNameTriePath, nil, regexp)
-}
-
-// A recursive function that supports *-wildcard and ?-wildcard search in a Trie data structure
-func (zc *ZkClient) searchTagNameFromParent(parent string, parentLock *DistLock, regexp string) (results []string, err error) {
-	if parentLock == nil {
-		parentLock, err = CreateDistLock(parent, zc.zkConn)
+	g := newGlobMatcher(regexp)
+	if results, ok := zc.searchCache(globAutomaton{g}); ok {
+		return results, nil
+	}
+	if err := zc.syncTrie(); err != nil {
+		return results, err
+	}
+	chunk, anchored := g.suffixChunk()
+	switch {
+	case zc.Layout() == RadixTrieLayout && chunk != "":
+		tagNames, err := zc.searchRadixSuffix(chunk, anchored)
 		if err != nil {
 			return results, err
 		}
-		parentLock.Acquire()
+		return matchSuffixTagNames(g, tagNames), nil
+	case zc.Layout() == RadixTrieLayout:
+		return zc.searchRadixTrie(zc.trieRoot(TagNameRadixTriePath), globAutomaton{g})
+	case chunk != "":
+		ready, err := zc.suffixTrieReady()
+		if err != nil {
+			return results, err
+		}
+		if ready {
+			return zc.searchTagNameBySuffix(regexp, chunk, anchored)
+		}
 	}
+	return zc.searchTagNameFromParent(zc.trieRoot(TagNameTriePath), regexp, newSearchPool(SearchWorkers))
+}
 
+// A recursive function that supports *-wildcard and ?-wildcard search in a Trie data structure. The children of a
+// wildcard are traversed in parallel on the pool, and their results are merged in the order of the children.
+func (zc *ZkClient) searchTagNameFromParent(parent string, regexp string, pool *searchPool) (results []string, err error) {
 	if len(regexp) == 0 {
 		exists, _, err := zc.zkConn.Exists(JoinPath(parent, endOfWordNode))
 		if exists {
-			results = append(results, GetTagNameFromPath(parent))
+			results = append(results, zc.Namespace().tagNameFromPath(parent))
 		}
-		parentLock.Release()
 		return results, err
 	}
 
 	character := regexp[0]
 	switch character {
 	case ASTERISK_WILDCARD:
-		children, _, err := zc.zkConn.Children(parent)
+		children, err := zc.trieChildren(parent)
 		if err != nil {
-			parentLock.Release()
 			return results, err
 		}
 
-		wildCardIsEmptyResults, err := zc.searchTagNameFromParent(parent, parentLock, regexp[1:])
+		wildCardIsEmptyResults, err := zc.searchTagNameFromParent(parent, regexp[1:], pool)
 		if err != nil {
-			parentLock.Release()
 			return results, err
 		}
-		results = append(results, wildCardIsEmptyResults...)
+		wildCardMatchesResults, err := pool.searchChildren(children, func(child string) ([]string, error) {
+			return zc.searchTagNameFromParent(JoinPath(parent, child), regexp, pool)
+		})
+		if err != nil {
+			return results, err
+		}
+		return append(wildCardIsEmptyResults, wildCardMatchesResults...), nil
 
-		for _, child := range children {
-			// future improvement: goroutine
-			if child == lockParentNode || child == endOfWordNode {
-				continue
-			}
+	case DOT_WILDCARD:
+		children, err := zc.trieChildren(parent)
+		if err != nil {
+			return results, err
+		}
 
-			curPath := JoinPath(parent, child)
-			wildCardMatchesResults, err := zc.searchTagNameFromParent(curPath, nil, regexp)
-			if err != nil {
-				parentLock.Release()
-				return results, err
-			}
-			results = append(results, wildCardMatchesResults...)
+		return pool.searchChildren(children, func(child string) ([]string, error) {
+			return zc.searchRestOfCharacter(JoinPath(parent, child), znodeCharacterLength(child)-1, regexp[1:], pool)
+		})
+
+	default:
+		curPath := JoinPath(parent, EscapeZnodeName(regexp[:1]))
+		exists, _, err := zc.zkConn.Exists(curPath)
+		if err != nil || !exists {
+			return results, err
 		}
 
-		// for wildcards, we will not release parentLock until all children are traversed
-		parentLock.Release()
+		return zc.searchTagNameFromParent(curPath, regexp[1:], pool)
+	}
+}
 
-	case DOT_WILDCARD:
-		children, _, err := zc.zkConn.Children(parent)
-		if err != nil {
-			parentLock.Release()
+// searchRestOfCharacter continues a ?-wildcard that matched the first byte of a multi-byte UTF-8 character below
+// parent, descending through the k continuation bytes that are left before the rest of the pattern is searched
+func (zc *ZkClient) searchRestOfCharacter(parent string, k int, regexp string, pool *searchPool) (results []string, err error) {
+	if k <= 0 {
+		return zc.searchTagNameFromParent(parent, regexp, pool)
+	}
+	children, err := zc.trieChildren(parent)
+	if err != nil {
+		return results, err
+	}
+	var continuations []string
+	for _, child := range children {
+		if character := UnescapeZnodeName(child); len(character) == 1 && character[0]&0xC0 == 0x80 {
+			continuations = append(continuations, child)
+		}
+	}
+	return pool.searchChildren(continuations, func(child string) ([]string, error) {
+		return zc.searchRestOfCharacter(JoinPath(parent, child), k-1, regexp, pool)
+	})
+}
+
+// znodeCharacterLength returns the length of the UTF-8 character that the byte of a znode of the character Trie
+// starts
+func znodeCharacterLength(name string) int {
+	character := UnescapeZnodeName(name)
+	if len(character) == 0 {
+		return 1
+	}
+	return continuationBytes(character[0]) + 1
+}
+
+// trieChildren returns the znode names of the child characters of a Trie Node sorted by character, without its eow
+// node and the lock node of Tries written by earlier versions
+func (zc *ZkClient) trieChildren(parent string) ([]string, error) {
+	children, _, err := zc.zkConn.Children(parent)
+	if err == zk.ErrNoNode {
+		// pruned by RemoveTagName
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var characters []string
+	for _, child := range children {
+		if child != lockParentNode && child != endOfWordNode {
+			characters = append(characters, child)
+		}
+	}
+	sort.Slice(characters, func(i, j int) bool {
+		return UnescapeZnodeName(characters[i]) < UnescapeZnodeName(characters[j])
+	})
+	return characters, nil
+}
+
+// searchTagNameBySuffix answers a pattern with a leading wildcard from the suffix Trie. It walks down the
+// characters of chunk, collects the tag names having that suffix (anchored) or a suffix starting with it, and
+// matches them against the whole pattern.
+func (zc *ZkClient) searchTagNameBySuffix(pattern string, chunk string, anchored bool) (results []string, err error) {
+	chunk = suffixTrieChunk(chunk, anchored)
+	parent := zc.trieRoot(TagNameSuffixTriePath)
+	for i := 0; i < len(chunk); i++ {
+		parent = JoinPath(parent, EscapeZnodeName(chunk[i:i+1]))
+		exists, _, err := zc.zkConn.Exists(parent)
+		if err != nil || !exists {
 			return results, err
 		}
+	}
 
-		for _, child := range children {
-			// future improvement: goroutine
-			if child == lockParentNode || child == endOfWordNode {
-				continue
-			}
+	var tagNames []string
+	if anchored {
+		tagNames, err = zc.suffixTagNames(parent)
+	} else {
+		tagNames, err = zc.collectSuffixTagNames(parent)
+	}
+	if err != nil {
+		return results, err
+	}
+	return matchSuffixTagNames(newGlobMatcher(pattern), tagNames), nil
+}
 
-			curPath := JoinPath(parent, child)
-			childResults, err := zc.searchTagNameFromParent(curPath, nil, regexp[1:])
-			if err != nil {
-				parentLock.Release()
-				return results, err
-			}
+// suffixPrefixes returns the first SuffixTrieDepth characters of every suffix of a tag name, which are what the
+// suffix Tries keep
+func suffixPrefixes(tagName string) []string {
+	suffixes := make([]string, len(tagName))
+	for i := range suffixes {
+		end := i + SuffixTrieDepth
+		if end > len(tagName) {
+			end = len(tagName)
+		}
+		suffixes[i] = tagName[i:end]
+	}
+	return suffixes
+}
 
-			results = append(results, childResults...)
+// suffixTrieChunk shortens a chunk to the SuffixTrieDepth characters a suffix Trie keeps, its last ones if it is
+// anchored. A suffix that is cut there ends with an eow node too, so the tag names found are only candidates for
+// the whole pattern.
+func suffixTrieChunk(chunk string, anchored bool) string {
+	switch {
+	case len(chunk) <= SuffixTrieDepth:
+		return chunk
+	case anchored:
+		return chunk[len(chunk)-SuffixTrieDepth:]
+	}
+	return chunk[:SuffixTrieDepth]
+}
+
+// matchSuffixTagNames returns the distinct tag names found in a suffix Trie that match the whole pattern, sorted
+func matchSuffixTagNames(g *globMatcher, tagNames []string) (results []string) {
+	seen := make(map[string]bool)
+	for _, tagName := range tagNames {
+		if !seen[tagName] && g.matches(tagName) {
+			seen[tagName] = true
+			results = append(results, tagName)
 		}
+	}
+	sort.Strings(results)
+	return results
+}
 
-		// for wildcards, we will not release parentLock until all children are traversed
-		parentLock.Release()
+// collectSuffixTagNames returns the tag names of all suffixes in the subtree of the suffix Trie
+func (zc *ZkClient) collectSuffixTagNames(parent string) (tagNames []string, err error) {
+	tagNames, err = zc.suffixTagNames(parent)
+	if err != nil {
+		return tagNames, err
+	}
 
-	default:
-		curPath := JoinPath(parent, string(character))
-		exists, _, err := zc.zkConn.Exists(curPath)
+	children, err := zc.trieChildren(parent)
+	if err != nil {
+		return tagNames, err
+	}
+	for _, child := range children {
+		childTagNames, err := zc.collectSuffixTagNames(JoinPath(parent, child))
 		if err != nil {
-			parentLock.Release()
-			return results, err
+			return tagNames, err
 		}
+		tagNames = append(tagNames, childTagNames...)
+	}
+	return tagNames, nil
+}
 
+// suffixTagNames returns the tag names whose suffix ends at a node of the suffix Trie
+func (zc *ZkClient) suffixTagNames(path string) (tagNames []string, err error) {
+	tagNames, err = zc.eowTagNames(JoinPath(path, endOfWordNode))
+	if err == zk.ErrNoNode {
+		return tagNames, nil
+	}
+	return tagNames, err
+}
+
+// eowTagNames returns the tag names below the eow node of a suffix, failing with zk.ErrNoNode if there is none
+func (zc *ZkClient) eowTagNames(eow string) (tagNames []string, err error) {
+	children, _, err := zc.zkConn.Children(eow)
+	if err != nil {
+		return tagNames, err
+	}
+	for _, child := range children {
+		tagNames = append(tagNames, UnescapeZnodeName(child))
+	}
+	return tagNames, nil
+}
+
+// FuzzyTagName is a tag name found by a fuzzy search, with its edit distance to the searched one
+type FuzzyTagName struct {
+	TagName  string
+	Distance int
+}
+
+// SearchTagNameFuzzy returns all tag names within maxDistance insertions, deletions or substitutions of
+// characters from tagName, ordered by distance. Branches of the Trie that are already too far away are skipped.
+func (zc *ZkClient) SearchTagNameFuzzy(tagName string, maxDistance int) (results []FuzzyTagName, err error) {
+	if maxDistance < 0 {
+		return nil, fmt.Errorf("negative edit distance %d", maxDistance)
+	}
+	m := newFuzzyMatcher(tagName, maxDistance)
+	tagNames, err := zc.searchTrieMatching(m)
+	if err != nil {
+		return nil, err
+	}
+	return fuzzyTagNames(m, tagNames), nil
+}
+
+// SearchTagNameRegexp returns all tag names that fully match the regular expression in RE2 syntax. The compiled
+// automaton is walked along the Trie, so only branches that can still lead to a match are visited.
+func (zc *ZkClient) SearchTagNameRegexp(expr string) (results []string, err error) {
+	m, err := newRegexpMatcher(expr)
+	if err != nil {
+		return nil, err
+	}
+	return zc.searchTrieMatching(m)
+}
+
+// searchTrieMatching walks the tag-name Trie of the client's layout together with a matcher
+func (zc *ZkClient) searchTrieMatching(m matcher) (results []string, err error) {
+	if results, ok := zc.searchCache(m); ok {
+		return results, nil
+	}
+	if err := zc.syncTrie(); err != nil {
+		return results, err
+	}
+	if zc.Layout() == RadixTrieLayout {
+		return zc.searchRadixTrie(zc.trieRoot(TagNameRadixTriePath), m)
+	}
+	return zc.searchTagNameMatching(zc.trieRoot(TagNameTriePath), m, m.start())
+}
+
+// A recursive function that walks the Trie together with a matcher, state is the matcher state after the
+// characters on the path to parent
+func (zc *ZkClient) searchTagNameMatching(parent string, m matcher, state matchState) (results []string, err error) {
+	if m.accepts(state) {
+		exists, _, err := zc.zkConn.Exists(JoinPath(parent, endOfWordNode))
+		if err != nil {
+			return results, err
+		}
 		if exists {
-			childLock, err := CreateDistLock(curPath, zc.zkConn)
-			if err != nil {
-				parentLock.Release()
-				return results, err
+			results = append(results, zc.Namespace().tagNameFromPath(parent))
+		}
+	}
+
+	children, err := zc.trieChildren(parent)
+	if err != nil {
+		return results, err
+	}
+
+	for _, child := range children {
+		character := UnescapeZnodeName(child)
+		next := state
+		for i := 0; i < len(character) && next != nil; i++ {
+			next = m.step(next, character[i])
+		}
+		if next == nil {
+			continue
+		}
+
+		childResults, err := zc.searchTagNameMatching(JoinPath(parent, child), m, next)
+		if err != nil {
+			return results, err
+		}
+		results = append(results, childResults...)
+	}
+
+	return results, nil
+}
+
+// fuzzyTagNames attaches the distance to every tag name found by a fuzzy search and orders them by it
+func fuzzyTagNames(m *fuzzyMatcher, tagNames []string) []FuzzyTagName {
+	results := make([]FuzzyTagName, len(tagNames))
+	for i, tagName := range tagNames {
+		results[i] = FuzzyTagName{TagName: tagName, Distance: m.distance(tagName)}
+	}
+	sort.SliceStable(results, func(i, j int) bool { return results[i].Distance < results[j].Distance })
+	return results
+}
+
+// addToTrie adds the characters of word below root, and then the path of leaf nodes below the last character. It
+// takes no locks: every node is created unless it exists, and writers sharing a prefix share its nodes. A tag name
+// is found once its eow node exists, which is created after its characters. If RemoveTagName pruned a node before
+// its child was created, the path is created again from root.
+func (zc *ZkClient) addToTrie(root string, word string, leaf ...string) error {
+	return zc.retryConflicts(root, func() error {
+		parent := root
+		for i := 0; i < len(word); i++ {
+			parent = JoinPath(parent, EscapeZnodeName(word[i:i+1]))
+			if err := zc.createNode(parent); err != nil {
+				return err
 			}
+		}
 
-			// Fine-grained Locking: lock-crabbing
-			// release parentLock after childLock is acquired
-			childLock.Acquire()
-			parentLock.Release()
+		for _, child := range leaf {
+			parent = JoinPath(parent, child)
+			if err := zc.createNode(parent); err != nil {
+				return err
+			}
+		}
 
-			childResults, err := zc.searchTagNameFromParent(curPath, childLock, regexp[1:])
-			if err != nil {
-				return results, err
+		return nil
+	})
+}
+
+// removeFromTrie deletes the path of leaf nodes below the characters of word, and then every node up to root that
+// no longer has children. Zookeeper refuses to delete a node with children, so a node on the path of another tag
+// name, or one a concurrent addToTrie just added a child to, stops the pruning.
+func (zc *ZkClient) removeFromTrie(root string, word string, leaf ...string) error {
+	path := []string{root}
+	for i := 0; i < len(word); i++ {
+		path = append(path, JoinPath(path[len(path)-1], EscapeZnodeName(word[i:i+1])))
+	}
+	for _, child := range leaf {
+		path = append(path, JoinPath(path[len(path)-1], child))
+	}
+
+	for i := len(path) - 1; i > 0; i-- {
+		err := zc.zkConn.Delete(path[i], -1)
+		if err == zk.ErrNotEmpty {
+			return nil
+		}
+		if err != nil && err != zk.ErrNoNode {
+			return err
+		}
+	}
+	return nil
+}
+
+// initSession creates the roots of the Tries and detects the layout, when the client is created and again on every
+// session after an expired one
+func (zc *ZkClient) initSession() error {
+	atomic.StoreInt32(&zc.suffix, 0)
+	err := initTagNameTriePath(zc.zkConn, zc.Namespace(), zc.acl.Root)
+	if err != nil {
+		return err
+	}
+
+	ready, err := zc.radixTrieReady()
+	if err != nil {
+		return err
+	}
+	if ready {
+		zc.setLayout(RadixTrieLayout)
+	}
+	return nil
+}
+
+// watchSession follows the session events of the connection until it is closed. zk.Conn establishes a new session
+// by itself once the old one expired, but the ensemble may have lost the Tries or finished a migration meanwhile, so
+// the client initializes the new session like a new client. A failed initialization is retried on the next session.
+func (zc *ZkClient) watchSession(events <-chan zk.Event) {
+	expired := false
+	for ev := range events {
+		if ev.Type != zk.EventSession {
+			continue
+		}
+		switch ev.State {
+		case zk.StateExpired:
+			Error.Printf("zookeeper session expired, server: %v\n", ev.Server)
+			expired = true
+		case zk.StateHasSession:
+			if !expired {
+				continue
+			}
+			if err := zc.initSession(); err != nil {
+				Error.Printf("error while initializing the zookeeper session, err: %v\n", err)
+				continue
 			}
+			expired = false
+		}
+	}
+}
+
+// createNode creates an empty znode, a znode that exists already was created by a concurrent writer
+func (zc *ZkClient) createNode(path string) error {
+	_, err := zc.zkConn.Create(path, nil, 0, zc.acl.Trie)
+	if err == zk.ErrNodeExists {
+		return nil
+	}
+	return err
+}
 
-			results = append(results, childResults...)
+// retryConflicts runs a read or write of the Trie below root until it does not conflict with a concurrent writer.
+// A node that was pruned fails a read or write below it with zk.ErrNoNode, while whatever was read before is a
+// consistent part of the Trie. A write to the radix Trie fails the version check of a node whose edges changed,
+// and starts over.
+func (zc *ZkClient) retryConflicts(root string, fn func() error) error {
+	for {
+		err := fn()
+		switch err {
+		case zk.ErrBadVersion, zk.ErrNodeExists, zk.ErrNotEmpty:
+			continue
+		case zk.ErrNoNode:
+			// unless root itself is gone
+			exists, _, existsErr := zc.zkConn.Exists(root)
+			if existsErr != nil {
+				return existsErr
+			}
+			if exists {
+				continue
+			}
 		}
+		return err
+	}
+}
+
+// trieRoot returns the path of a Trie root, like TagNameTriePath, in the namespace of the client
+func (zc *ZkClient) trieRoot(root string) string {
+	return zc.Namespace().trieRoot(root)
+}
 
-		parentLock.Release()
+// suffixTrieReady reports whether the suffix Trie holds every tag name, see BuildSuffixTrie. Once it does, it is not
+// read again.
+func (zc *ZkClient) suffixTrieReady() (bool, error) {
+	if atomic.LoadInt32(&zc.suffix) == 1 {
+		return true, nil
 	}
+	data, _, err := zc.zkConn.Get(zc.trieRoot(TagNameSuffixTriePath))
+	if err != nil {
+		return false, err
+	}
+	if string(data) != suffixTrieReady {
+		return false, nil
+	}
+	atomic.StoreInt32(&zc.suffix, 1)
+	return true, nil
+}
 
-	return results, err
+// syncTrie brings the Zookeeper server of the client up to date with the leader. Searches take no locks, whose
+// creation used to do that, and without it a search could miss a tag name another client added just before.
+func (zc *ZkClient) syncTrie() error {
+	_, err := zc.zkConn.Sync(zc.trieRoot(TagNameTriePath))
+	return err
 }
@@ -0,0 +1,512 @@
+package pkg
+
+import (
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/go-zookeeper/zk"
+)
+
+// TrieLayout is the layout of the tag-name Trie in Zookeeper
+type TrieLayout int32
+
+const (
+	// CharTrieLayout has one znode per character of a tag name below TagNameTriePath
+	CharTrieLayout TrieLayout = iota
+	// RadixTrieLayout is path-compressed: a znode below TagNameRadixTriePath holds a whole edge label, and an edge
+	// is split when a new tag name branches off inside it, see radixEdge. Every change to the edges of a znode bumps
+	// its data version, checking it is the version the edges were read at, so concurrent writers conflict and start
+	// over instead of adding two edges with the same first character.
+	RadixTrieLayout
+)
+
+func (l TrieLayout) String() string {
+	if l == RadixTrieLayout {
+		return "radix"
+	}
+	return "char"
+}
+
+const (
+	// radixEdgePrefix starts the znode name of every edge of the radix Trie, followed by the path escaped label, so
+	// a label never collides with the lock and eow znodes
+	radixEdgePrefix = "+"
+	// radixTrieReady is the data of TagNameRadixTriePath once a migration finished
+	radixTrieReady = "ready"
+	// charTrieMigrated is the data of TagNameTriePath once a migration started, from then on tag names added to the
+	// character Trie are added to the radix Trie as well
+	charTrieMigrated = "migrated"
+)
+
+// Layout returns the layout of the tag-name Trie the client reads and writes
+func (zc *ZkClient) Layout() TrieLayout {
+	return TrieLayout(atomic.LoadInt32(&zc.layout))
+}
+
+// MigrateToRadixTrie copies all tag names of the character Trie, with their metadata, into the radix Trie and
+// switches the client to it. Other clients switch on their next AddTagName, new clients start with the radix Trie
+// right away. The character Trie is left in place for clients that only search; delete it with DeleteZkRoot once
+// all of them switched.
+//
+// A migration that failed is started over by calling MigrateToRadixTrie again, but two migrations must not run at
+// the same time.
+func (zc *ZkClient) MigrateToRadixTrie() error {
+	ready, err := zc.radixTrieReady()
+	if err != nil {
+		return err
+	}
+	if ready {
+		zc.setLayout(RadixTrieLayout)
+		return nil
+	}
+
+	for _, root := range []string{zc.trieRoot(TagNameRadixTriePath), zc.trieRoot(TagNameRadixSuffixTriePath)} {
+		err := DeleteZkRoot(root, zc.zkConn)
+		if err != nil && err != zk.ErrNoNode {
+			return err
+		}
+		_, err = zc.zkConn.Create(root, nil, 0, zc.acl.Root)
+		if err != nil {
+			return err
+		}
+	}
+
+	// every AddTagName that finishes after the marker is set adds to the radix Trie itself, every one that
+	// finished before is found by the search below
+	_, err = zc.zkConn.Set(zc.trieRoot(TagNameTriePath), []byte(charTrieMigrated), -1)
+	if err != nil {
+		return err
+	}
+	g := newGlobMatcher("*")
+	tagNames, err := zc.searchTagNameMatching(zc.trieRoot(TagNameTriePath), globAutomaton{g}, g.start())
+	if err != nil {
+		return err
+	}
+	for _, tagName := range tagNames {
+		if err := zc.addTagNameRadix(tagName); err != nil {
+			return err
+		}
+		if err := zc.migrateMetadata(tagName); err != nil {
+			return err
+		}
+	}
+
+	_, err = zc.zkConn.Set(zc.trieRoot(TagNameRadixTriePath), []byte(radixTrieReady), -1)
+	if err != nil {
+		return err
+	}
+	zc.setLayout(RadixTrieLayout)
+	return nil
+}
+
+////////////////////////////////////   Inner Functions   //////////////////////////////////////////////////
+
+func (zc *ZkClient) setLayout(layout TrieLayout) {
+	atomic.StoreInt32(&zc.layout, int32(layout))
+}
+
+// radixTrieReady reports whether a migration to the radix Trie finished
+func (zc *ZkClient) radixTrieReady() (bool, error) {
+	data, _, err := zc.zkConn.Get(zc.trieRoot(TagNameRadixTriePath))
+	if err == zk.ErrNoNode {
+		return false, nil
+	}
+	return string(data) == radixTrieReady, err
+}
+
+// addMigratedTagName adds a tag name that was just added to the character Trie to the radix Trie as well, if a
+// migration started. The client switches to the radix Trie once the migration finished.
+func (zc *ZkClient) addMigratedTagName(tagName string) error {
+	data, _, err := zc.zkConn.Get(zc.trieRoot(TagNameTriePath))
+	if err != nil || string(data) != charTrieMigrated {
+		return err
+	}
+	if err := zc.addTagNameRadix(tagName); err != nil {
+		return err
+	}
+	ready, err := zc.radixTrieReady()
+	if ready {
+		zc.setLayout(RadixTrieLayout)
+	}
+	return err
+}
+
+// migrateMetadata copies the metadata of a tag name from the character Trie to the radix Trie. A tag name removed
+// meanwhile is skipped.
+func (zc *ZkClient) migrateMetadata(tagName string) error {
+	metadata, err := zc.getMetadata(CharTrieLayout, tagName)
+	if err == ErrUnknownTagName || err == nil && metadata == (TagNameMetadata{}) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	err = zc.updateMetadata(RadixTrieLayout, tagName, func(radixMetadata *TagNameMetadata) bool {
+		*radixMetadata = metadata
+		return true
+	})
+	if err == ErrUnknownTagName {
+		return nil
+	}
+	return err
+}
+
+// addTagNameRadix adds the tag name to the radix Trie, and its suffixes to the radix suffix Trie like AddTagName
+func (zc *ZkClient) addTagNameRadix(tagName string) error {
+	err := zc.insertRadix(zc.trieRoot(TagNameRadixTriePath), tagName, endOfWordNode)
+	if err != nil {
+		return err
+	}
+
+	for _, suffix := range suffixPrefixes(tagName) {
+		err := zc.insertRadix(zc.trieRoot(TagNameRadixSuffixTriePath), suffix, endOfWordNode, EscapeZnodeName(tagName))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// insertRadix adds word below root, splitting an edge if word branches off inside it, and then the path of leaf
+// nodes below the node of word. It starts over from root whenever a concurrent writer changed a node it read.
+func (zc *ZkClient) insertRadix(root string, word string, leaf ...string) error {
+	return zc.retryConflicts(root, func() error {
+		return zc.tryInsertRadix(root, word, leaf...)
+	})
+}
+
+func (zc *ZkClient) tryInsertRadix(root string, word string, leaf ...string) error {
+	node := radixEdge{path: root}
+	for len(word) > 0 {
+		edges, _, version, err := zc.radixEdges(node)
+		if err != nil {
+			return err
+		}
+
+		ix := searchRadixEdges(edges, word[0])
+		if ix == len(edges) || edges[ix].label[0] != word[0] {
+			// no edge shares a character with word, so the rest of word becomes a single edge
+			bump, err := zc.radixBump(node.path, version)
+			if err != nil {
+				return err
+			}
+			node = radixEdge{path: JoinPath(node.path, radixEdgeName(word))}
+			err = zc.multi(bump, &zk.CreateRequest{Path: node.path, Acl: zc.acl.Trie})
+			if err != nil {
+				return err
+			}
+			break
+		}
+
+		edge := edges[ix]
+		m := matchingChars(edge.label, word)
+		if m < len(edge.label) {
+			if edge, err = zc.splitRadixEdge(edge, m); err != nil {
+				return err
+			}
+		}
+		node, word = edge, word[m:]
+	}
+
+	for _, child := range leaf {
+		node.path = JoinPath(node.path, child)
+		if err := zc.createNode(node.path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeRadix deletes the path of leaf nodes below the node of word, and then every edge up to root that no longer
+// has children, bumping the version of its parent like any other change to the edges. An edge left as the only one
+// below its parent is not merged into it, inserts and searches do not rely on the edges being compressed.
+func (zc *ZkClient) removeRadix(root string, word string, leaf ...string) error {
+	err := zc.retryConflicts(root, func() error {
+		return zc.tryRemoveRadix(root, word, leaf...)
+	})
+	if err == zk.ErrNoNode {
+		// there is no radix Trie
+		return nil
+	}
+	return err
+}
+
+func (zc *ZkClient) tryRemoveRadix(root string, word string, leaf ...string) error {
+	node := radixEdge{path: root}
+	var path []string
+	for rest := word; len(rest) > 0; {
+		edges, _, _, err := zc.radixEdges(node)
+		if err != nil {
+			return err
+		}
+		ix := searchRadixEdges(edges, rest[0])
+		if ix == len(edges) || !strings.HasPrefix(rest, edges[ix].label) {
+			// word is not in the Trie
+			return nil
+		}
+		node, rest = edges[ix], rest[len(edges[ix].label):]
+		path = append(path, node.path)
+	}
+
+	leaves := []string{node.path}
+	for _, child := range leaf {
+		leaves = append(leaves, JoinPath(leaves[len(leaves)-1], child))
+	}
+	for i := len(leaves) - 1; i > 0; i-- {
+		err := zc.zkConn.Delete(leaves[i], -1)
+		if err == zk.ErrNotEmpty {
+			return nil
+		}
+		if err == zk.ErrNoNode {
+			// the leaf was never added or is already deleted, unless the node of word was pruned meanwhile
+			exists, _, err := zc.zkConn.Exists(leaves[i-1])
+			if err != nil {
+				return err
+			}
+			if !exists {
+				return zk.ErrNoNode
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// an edge nested below the one before it is a sibling of its znode, not a child, so its own parent is bumped
+	for i := len(path) - 1; i >= 0; i-- {
+		parent := path[i][:strings.LastIndex(path[i], "/")]
+		data, stat, err := zc.zkConn.Get(parent)
+		if err != nil {
+			return err
+		}
+		bump := &zk.SetDataRequest{Path: parent, Data: data, Version: stat.Version}
+		err = zc.multi(bump, &zk.DeleteRequest{Path: path[i], Version: -1})
+		if err == zk.ErrNotEmpty {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// radixEdge is an edge of the radix Trie as it is walked from the root. A split never moves the subtree of an edge:
+// the shorter edge is created beside the znode of the edge, and from then on the edge is nested below it. The edges
+// below a node are therefore the children of its znode together with the edges nested below the edge leading to it.
+type radixEdge struct {
+	// label is the part of the label of the znode below the node the edge leaves
+	label string
+	// path is the znode of the edge
+	path string
+	// version is the data version of the parent of path when the edge was read
+	version int32
+	// nested are the edges beside path whose labels extend label, relative to it
+	nested []radixEdge
+}
+
+// splitRadixEdge splits an edge after m characters. The shorter edge is created beside the znode of the edge in a
+// transaction that bumps their parent, and the edge is nested below it, so a split creates a single znode however
+// large the subtree of the edge is. It returns the new edge.
+func (zc *ZkClient) splitRadixEdge(edge radixEdge, m int) (radixEdge, error) {
+	i := strings.LastIndex(edge.path, "/")
+	parent, label := edge.path[:i], UnescapeZnodeName(edge.path[i+1+len(radixEdgePrefix):])
+	bump, err := zc.radixBump(parent, edge.version)
+	if err != nil {
+		return edge, err
+	}
+	split := radixEdge{
+		label:   edge.label[:m],
+		path:    JoinPath(parent, radixEdgeName(label[:len(label)-len(edge.label)+m])),
+		version: edge.version + 1,
+	}
+	err = zc.multi(bump, &zk.CreateRequest{Path: split.path, Acl: zc.acl.Trie})
+	if err != nil {
+		return edge, err
+	}
+
+	split.nested = append(split.nested, radixEdge{label: edge.label[m:], path: edge.path, version: split.version})
+	for _, nested := range edge.nested {
+		split.nested = append(split.nested, radixEdge{label: edge.label[m:] + nested.label, path: nested.path, version: split.version})
+	}
+	return split, nil
+}
+
+// radixBump returns the operation that bumps the data version of a node of the radix Trie, which fails the
+// transaction it is part of unless the version is still the one the edges below the node were read at
+func (zc *ZkClient) radixBump(path string, version int32) (*zk.SetDataRequest, error) {
+	data, stat, err := zc.zkConn.Get(path)
+	if err != nil {
+		return nil, err
+	}
+	if stat.Version != version {
+		return nil, zk.ErrBadVersion
+	}
+	return &zk.SetDataRequest{Path: path, Data: data, Version: version}, nil
+}
+
+// multi runs the operations in a single transaction and returns the error of the operation that failed it
+func (zc *ZkClient) multi(ops ...interface{}) error {
+	responses, err := zc.zkConn.Multi(ops...)
+	if err != nil {
+		return err
+	}
+	for _, response := range responses {
+		if response.Error != nil {
+			return response.Error
+		}
+	}
+	return nil
+}
+
+// searchRadixTrie returns the tag names below root that the matcher accepts, in lexicographical order
+func (zc *ZkClient) searchRadixTrie(root string, m matcher) (results []string, err error) {
+	err = zc.retryConflicts(root, func() error {
+		results, err = zc.searchRadixMatching(radixEdge{path: root}, "", m, m.start())
+		return err
+	})
+	return results, err
+}
+
+// A recursive function that walks the radix Trie together with a matcher, prefix is the tag name prefix of node
+// and state the matcher state after it
+func (zc *ZkClient) searchRadixMatching(node radixEdge, prefix string, m matcher, state matchState) (results []string, err error) {
+	edges, eow, _, err := zc.radixEdges(node)
+	if err != nil {
+		return results, err
+	}
+	if eow && m.accepts(state) {
+		results = append(results, prefix)
+	}
+
+	for _, edge := range edges {
+		next := state
+		for i := 0; i < len(edge.label) && next != nil; i++ {
+			next = m.step(next, edge.label[i])
+		}
+		if next == nil {
+			continue
+		}
+
+		childResults, err := zc.searchRadixMatching(edge, prefix+edge.label, m, next)
+		if err != nil {
+			return results, err
+		}
+		results = append(results, childResults...)
+	}
+	return results, nil
+}
+
+// searchRadixSuffix returns the tag names having chunk as their suffix (anchored) or a suffix starting with chunk,
+// read from the radix suffix Trie
+func (zc *ZkClient) searchRadixSuffix(chunk string, anchored bool) (tagNames []string, err error) {
+	err = zc.retryConflicts(zc.trieRoot(TagNameRadixSuffixTriePath), func() error {
+		tagNames = nil
+		node, rest := radixEdge{path: zc.trieRoot(TagNameRadixSuffixTriePath)}, suffixTrieChunk(chunk, anchored)
+		for len(rest) > 0 {
+			edges, _, _, err := zc.radixEdges(node)
+			if err != nil {
+				return err
+			}
+			ix := searchRadixEdges(edges, rest[0])
+			if ix == len(edges) || edges[ix].label[0] != rest[0] {
+				return nil
+			}
+
+			label := edges[ix].label
+			m := matchingChars(label, rest)
+			switch {
+			case m == len(rest) && m < len(label) && anchored:
+				// chunk ends inside the edge, so no suffix equals chunk
+				return nil
+			case m < len(rest) && m < len(label):
+				return nil
+			}
+			node, rest = edges[ix], rest[m:]
+		}
+
+		if anchored {
+			tagNames, err = zc.radixSuffixTagNames(node)
+		} else {
+			tagNames, err = zc.collectRadixTagNames(node)
+		}
+		return err
+	})
+	return tagNames, err
+}
+
+// radixSuffixTagNames returns the tag names whose suffix ends at a node of the radix suffix Trie. Unlike
+// suffixTagNames, it fails with zk.ErrNoNode if the node was pruned meanwhile.
+func (zc *ZkClient) radixSuffixTagNames(node radixEdge) (tagNames []string, err error) {
+	_, eow, _, err := zc.radixEdges(node)
+	if err != nil || !eow {
+		return tagNames, err
+	}
+	return zc.eowTagNames(JoinPath(node.path, endOfWordNode))
+}
+
+// collectRadixTagNames returns the tag names of all suffixes in the subtree of the radix suffix Trie
+func (zc *ZkClient) collectRadixTagNames(node radixEdge) (tagNames []string, err error) {
+	edges, eow, _, err := zc.radixEdges(node)
+	if err != nil {
+		return tagNames, err
+	}
+	if eow {
+		tagNames, err = zc.eowTagNames(JoinPath(node.path, endOfWordNode))
+		if err != nil {
+			return tagNames, err
+		}
+	}
+	for _, edge := range edges {
+		childTagNames, err := zc.collectRadixTagNames(edge)
+		if err != nil {
+			return tagNames, err
+		}
+		tagNames = append(tagNames, childTagNames...)
+	}
+	return tagNames, nil
+}
+
+// radixEdges returns the edges below the node an edge leads to, sorted by label, whether a tag name or suffix ends at
+// the node, and the data version of its znode at the time. An edge whose label extends the label of another edge
+// is nested below it.
+func (zc *ZkClient) radixEdges(node radixEdge) (edges []radixEdge, eow bool, version int32, err error) {
+	children, stat, err := zc.zkConn.Children(node.path)
+	if err != nil {
+		return edges, false, 0, err
+	}
+	all := append([]radixEdge(nil), node.nested...)
+	for _, child := range children {
+		if child == endOfWordNode {
+			eow = true
+		}
+		if !strings.HasPrefix(child, radixEdgePrefix) {
+			continue
+		}
+		label := UnescapeZnodeName(child[len(radixEdgePrefix):])
+		all = append(all, radixEdge{label: label, path: JoinPath(node.path, child), version: stat.Version})
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].label < all[j].label })
+
+	for _, edge := range all {
+		if n := len(edges); n > 0 && strings.HasPrefix(edge.label, edges[n-1].label) {
+			edge.label = edge.label[len(edges[n-1].label):]
+			edges[n-1].nested = append(edges[n-1].nested, edge)
+			continue
+		}
+		edges = append(edges, edge)
+	}
+	return edges, eow, stat.Version, nil
+}
+
+// searchRadixEdges returns the index of the first edge whose label starts with c or a later character
+func searchRadixEdges(edges []radixEdge, c byte) int {
+	return sort.Search(len(edges), func(i int) bool { return edges[i].label[0] >= c })
+}
+
+// radixEdgeName returns the znode name of an edge, escaping the label like the characters of the character Trie
+func radixEdgeName(label string) string {
+	return radixEdgePrefix + EscapeZnodeName(label)
+}
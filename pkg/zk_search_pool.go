@@ -0,0 +1,46 @@
+package pkg
+
+import "sync"
+
+// searchPool bounds the goroutines of a single Trie search, which all share the Zookeeper connection of the
+// ZkClient. A traversal runs on a new goroutine while a slot is free and in the calling goroutine otherwise, so a
+// traversal waiting for its children never starves them of workers.
+type searchPool struct {
+	slots chan struct{}
+}
+
+func newSearchPool(workers int) *searchPool {
+	return &searchPool{slots: make(chan struct{}, workers)}
+}
+
+// searchChildren runs search for every child and concatenates the results in the order of the children. It waits
+// for all traversals and returns the error of the first failed child.
+func (p *searchPool) searchChildren(children []string, search func(child string) ([]string, error)) ([]string, error) {
+	results := make([][]string, len(children))
+	errs := make([]error, len(children))
+
+	var wg sync.WaitGroup
+	for i, child := range children {
+		select {
+		case p.slots <- struct{}{}:
+			wg.Add(1)
+			go func(i int, child string) {
+				defer wg.Done()
+				results[i], errs[i] = search(child)
+				<-p.slots
+			}(i, child)
+		default:
+			results[i], errs[i] = search(child)
+		}
+	}
+	wg.Wait()
+
+	var merged []string
+	for i := range children {
+		if errs[i] != nil {
+			return nil, errs[i]
+		}
+		merged = append(merged, results[i]...)
+	}
+	return merged, nil
+}
@@ -0,0 +1,344 @@
+package pkg
+
+import (
+	"errors"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-zookeeper/zk"
+)
+
+// ErrTrieCacheMismatch is returned for a TrieCache that cannot answer the searches of a client
+var ErrTrieCacheMismatch = errors.New("trie cache does not mirror the namespace or layout of the client")
+
+// TrieCache mirrors the character Trie of a namespace in memory, so searches do not read Zookeeper at all.
+// It is populated once and kept current with a child watch on every znode of the Trie. Watch events are delivered
+// through the event callback of its own Zookeeper connection and applied by a single goroutine, so the mirror lags
+// behind Zookeeper by the delivery of a watch event.
+//
+// The mirror is dropped when the connection is lost, and read again from scratch once a session is established,
+// since the watches may have missed changes in between. ZkClients using the cache read Zookeeper itself while the
+// cache is not Ready.
+type TrieCache struct {
+	zkConn *zk.Conn
+	ns     Namespace
+	path   string // TagNameTriePath in the namespace
+	ready  int32  // 1 while the mirror is in sync with Zookeeper, accessed atomically
+
+	mu   sync.RWMutex
+	root *cacheNode
+
+	queueMu sync.Mutex
+	queue   []zk.Event
+	wake    chan struct{}
+	done    chan struct{}
+}
+
+// cacheNode is a mirrored znode of the character Trie
+type cacheNode struct {
+	character string                // the decoded character of the znode
+	eow       bool                  // whether a tag name ends at the znode
+	children  map[string]*cacheNode // by znode name
+}
+
+// NewTrieCache connects to the Zookeeper servers, or to ZkServers if none are given, and populates the mirror of
+// the DefaultNamespace. Close it when done.
+func NewTrieCache(zkAddrs ...string) (*TrieCache, error) {
+	return NewNamespaceTrieCache(DefaultNamespace, WorldZkACL(), zkAddrs...)
+}
+
+// NewNamespaceTrieCache is NewTrieCache for the Trie of a namespace and a cache that authenticates as the ACL says,
+// it only needs to read
+func NewNamespaceTrieCache(ns Namespace, acl *ZkACL, zkAddrs ...string) (*TrieCache, error) {
+	if len(zkAddrs) == 0 {
+		zkAddrs = ZkServers
+	}
+	c := &TrieCache{
+		ns:   ns,
+		path: ns.trieRoot(TagNameTriePath),
+		wake: make(chan struct{}, 1),
+		done: make(chan struct{}),
+	}
+	zkConn, _, err := zk.Connect(zkAddrs, 1*time.Second, zk.WithEventCallback(c.enqueue))
+	if err != nil {
+		return nil, err
+	}
+	c.zkConn = zkConn
+
+	err = acl.authenticate(zkConn)
+	if err == nil {
+		err = c.resync()
+	}
+	if err != nil {
+		zkConn.Close()
+		return nil, err
+	}
+	go c.run()
+	return c, nil
+}
+
+// Ready reports whether the mirror is in sync with Zookeeper
+func (c *TrieCache) Ready() bool {
+	return atomic.LoadInt32(&c.ready) == 1
+}
+
+// Close stops keeping the mirror current and closes the Zookeeper connection of the cache
+func (c *TrieCache) Close() {
+	atomic.StoreInt32(&c.ready, 0)
+	close(c.done)
+	c.zkConn.Close()
+}
+
+// UseTrieCache answers the searches of the client from the cache while it is Ready, or always from Zookeeper if
+// cache is nil. The cache mirrors the character Trie of its namespace, so it fails with ErrTrieCacheMismatch for a
+// client in another namespace or in the RadixTrieLayout. A client that switches its namespace or migrates to the
+// radix Trie afterwards stops using the cache. Several clients may share a cache.
+func (zc *ZkClient) UseTrieCache(cache *TrieCache) error {
+	if cache != nil && (cache.ns != zc.Namespace() || zc.Layout() != CharTrieLayout) {
+		return ErrTrieCacheMismatch
+	}
+	zc.cache.Store(cache)
+	return nil
+}
+
+////////////////////////////////////   Inner Functions   //////////////////////////////////////////////////
+
+// searchCache walks the cache together with a matcher, returning false if the cache cannot answer the search
+func (zc *ZkClient) searchCache(m matcher) (results []string, ok bool) {
+	cache, _ := zc.cache.Load().(*TrieCache)
+	if cache == nil || zc.Layout() != CharTrieLayout || zc.Namespace() != cache.ns || !cache.Ready() {
+		return results, false
+	}
+
+	cache.mu.RLock()
+	defer cache.mu.RUnlock()
+	return cache.root.search("", m, m.start(), results), true
+}
+
+// search appends the tag names below the node that the matcher accepts in lexicographical order, prefix is the tag
+// name of the node and state the matcher state after it
+func (n *cacheNode) search(prefix string, m matcher, state matchState, results []string) []string {
+	if n.eow && m.accepts(state) {
+		results = append(results, prefix)
+	}
+
+	children := make([]*cacheNode, 0, len(n.children))
+	for _, child := range n.children {
+		children = append(children, child)
+	}
+	sort.Slice(children, func(i, j int) bool { return children[i].character < children[j].character })
+
+	for _, child := range children {
+		next := state
+		for i := 0; i < len(child.character) && next != nil; i++ {
+			next = m.step(next, child.character[i])
+		}
+		if next != nil {
+			results = child.search(prefix+child.character, m, next, results)
+		}
+	}
+	return results
+}
+
+// enqueue is the event callback of the connection, which must not block
+func (c *TrieCache) enqueue(ev zk.Event) {
+	c.queueMu.Lock()
+	c.queue = append(c.queue, ev)
+	c.queueMu.Unlock()
+
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run applies the queued events in order until the cache is closed
+func (c *TrieCache) run() {
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-c.wake:
+		}
+
+		c.queueMu.Lock()
+		events := c.queue
+		c.queue = nil
+		c.queueMu.Unlock()
+
+		for _, ev := range events {
+			c.apply(ev)
+		}
+	}
+}
+
+func (c *TrieCache) apply(ev zk.Event) {
+	switch ev.Type {
+	case zk.EventSession:
+		switch ev.State {
+		case zk.StateDisconnected, zk.StateExpired:
+			atomic.StoreInt32(&c.ready, 0)
+		case zk.StateHasSession:
+			if !c.Ready() {
+				// a failed resync is retried on the next session
+				c.resync()
+			}
+		}
+	case zk.EventNotWatching:
+		atomic.StoreInt32(&c.ready, 0)
+	case zk.EventNodeChildrenChanged:
+		if c.Ready() {
+			c.refresh(ev.Path)
+		}
+	case zk.EventNodeCreated:
+		if ev.Path == c.path && !c.Ready() {
+			c.resync()
+		}
+	case zk.EventNodeDeleted:
+		if ev.Path == c.path {
+			// wait for the Trie to be created again
+			atomic.StoreInt32(&c.ready, 0)
+			exists, _, _, err := c.zkConn.ExistsW(c.path)
+			if err == nil && exists {
+				c.resync()
+			}
+			return
+		}
+		if c.Ready() {
+			// the znode may be created again before its parent is read, which would keep the mirror of the deleted
+			// znode without a watch, so it is dropped and read again with its parent
+			c.drop(ev.Path)
+			c.refresh(path.Dir(ev.Path))
+		}
+	}
+}
+
+// resync reads the whole Trie into a new mirror, arming a child watch on every znode
+func (c *TrieCache) resync() error {
+	root, err := c.load(c.path, "")
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.root = root
+	c.mu.Unlock()
+	atomic.StoreInt32(&c.ready, 1)
+	return nil
+}
+
+// load reads the subtree of a znode, arming a child watch on each of its znodes
+func (c *TrieCache) load(nodePath string, character string) (*cacheNode, error) {
+	children, _, _, err := c.zkConn.ChildrenW(nodePath)
+	if err != nil {
+		return nil, err
+	}
+
+	node := &cacheNode{character: character, children: make(map[string]*cacheNode)}
+	for _, child := range children {
+		switch child {
+		case endOfWordNode:
+			node.eow = true
+		case lockParentNode:
+		default:
+			childNode, err := c.load(JoinPath(nodePath, child), UnescapeZnodeName(child))
+			if err == zk.ErrNoNode {
+				// pruned meanwhile, the watch of nodePath reports it
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			node.children[child] = childNode
+		}
+	}
+	return node, nil
+}
+
+// refresh reads the children of a mirrored znode again after they changed, loading the subtrees of new children
+// and dropping removed ones
+func (c *TrieCache) refresh(nodePath string) {
+	c.mu.RLock()
+	node := c.lookup(nodePath)
+	c.mu.RUnlock()
+	if node == nil {
+		return
+	}
+
+	children, _, _, err := c.zkConn.ChildrenW(nodePath)
+	if err == zk.ErrNoNode {
+		// the parent of the znode is notified
+		return
+	}
+	if err != nil {
+		// the watch is lost, so is the sync
+		atomic.StoreInt32(&c.ready, 0)
+		return
+	}
+
+	// only this goroutine modifies the mirror, so reading the children of node without the lock is safe
+	eow := false
+	present := make(map[string]bool)
+	added := make(map[string]*cacheNode)
+	for _, child := range children {
+		switch child {
+		case endOfWordNode:
+			eow = true
+		case lockParentNode:
+		default:
+			present[child] = true
+			if node.children[child] != nil {
+				continue
+			}
+			childNode, err := c.load(JoinPath(nodePath, child), UnescapeZnodeName(child))
+			if err == zk.ErrNoNode {
+				continue
+			}
+			if err != nil {
+				atomic.StoreInt32(&c.ready, 0)
+				return
+			}
+			added[child] = childNode
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	node.eow = eow
+	for child := range node.children {
+		if !present[child] {
+			delete(node.children, child)
+		}
+	}
+	for child, childNode := range added {
+		node.children[child] = childNode
+	}
+}
+
+// drop removes a znode from the mirror
+func (c *TrieCache) drop(nodePath string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if parent := c.lookup(path.Dir(nodePath)); parent != nil {
+		delete(parent.children, path.Base(nodePath))
+	}
+}
+
+// lookup returns the mirror of a znode, or nil if it is not mirrored. The caller holds mu.
+func (c *TrieCache) lookup(nodePath string) *cacheNode {
+	if nodePath != c.path && !strings.HasPrefix(nodePath, c.path+"/") {
+		return nil
+	}
+	node := c.root
+	for _, name := range strings.Split(nodePath[len(c.path):], "/")[1:] {
+		if node == nil {
+			return nil
+		}
+		node = node.children[name]
+	}
+	return node
+}
@@ -2,6 +2,7 @@ package pkg
 
 import (
 	"fmt"
+	"net/url"
 	"strings"
 
 	"github.com/go-zookeeper/zk"
@@ -30,6 +31,33 @@ func JoinPath(parent string, childNames ...string) string {
 	return parent
 }
 
+// GetTagNameFromPath returns the tag name of a node of the character Trie, decoding the znode name of every
+// character below the root
 func GetTagNameFromPath(path string) string {
-	return strings.Join(strings.Split(path, "/")[2:], "")
+	names := strings.Split(path, "/")[2:]
+	for i, name := range names {
+		names[i] = UnescapeZnodeName(name)
+	}
+	return strings.Join(names, "")
+}
+
+// EscapeZnodeName encodes any string, like a character or a whole tag name, as a valid znode name. It path escapes
+// the string, so '/', '%' and every byte that is not printable ASCII becomes %XX, and escapes the names "." and "..",
+// which Zookeeper rejects, as well.
+func EscapeZnodeName(s string) string {
+	name := url.PathEscape(s)
+	if name == "." || name == ".." {
+		return strings.Repeat("%2E", len(name))
+	}
+	return name
+}
+
+// UnescapeZnodeName decodes a znode name written by EscapeZnodeName. A name that is not validly escaped, like a
+// character written to the Trie unescaped by an earlier version, is returned as is.
+func UnescapeZnodeName(name string) string {
+	s, err := url.PathUnescape(name)
+	if err != nil {
+		return name
+	}
+	return s
 }
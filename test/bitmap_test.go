@@ -0,0 +1,92 @@
+package test
+
+import (
+	dmi "distributed-metadata-index/pkg"
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+// randomNodes returns a Bitmap and the equivalent set; the IDs span several containers, some of them dense
+func randomNodes(r *rand.Rand, n int) (*dmi.Bitmap, map[uint32]bool) {
+	b := dmi.NewBitmap()
+	set := make(map[uint32]bool)
+	for i := 0; i < n; i++ {
+		id := uint32(r.Intn(3 << 16))
+		if i%2 == 0 {
+			id = uint32(r.Intn(6000))
+		}
+		b.Add(id)
+		set[id] = true
+	}
+	return b, set
+}
+
+func sortedSet(set map[uint32]bool) []uint32 {
+	ids := []uint32{}
+	for id := range set {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+func TestBitmapSetOperations(t *testing.T) {
+	r := rand.New(rand.NewSource(88))
+	for _, n := range []int{0, 10, 5000, 20000} {
+		a, setA := randomNodes(r, n)
+		b, setB := randomNodes(r, n/2)
+
+		and, or, andNot := map[uint32]bool{}, map[uint32]bool{}, map[uint32]bool{}
+		for id := range setA {
+			or[id] = true
+			if setB[id] {
+				and[id] = true
+			} else {
+				andNot[id] = true
+			}
+		}
+		for id := range setB {
+			or[id] = true
+		}
+
+		if fmt.Sprint(a.ToArray()) != fmt.Sprint(sortedSet(setA)) || a.Cardinality() != len(setA) {
+			t.Errorf("wrong bitmap content for %v random nodes\n", n)
+		}
+		if fmt.Sprint(a.And(b).ToArray()) != fmt.Sprint(sortedSet(and)) {
+			t.Errorf("wrong intersection for %v random nodes\n", n)
+		}
+		if fmt.Sprint(a.Or(b).ToArray()) != fmt.Sprint(sortedSet(or)) {
+			t.Errorf("wrong union for %v random nodes\n", n)
+		}
+		if fmt.Sprint(a.AndNot(b).ToArray()) != fmt.Sprint(sortedSet(andNot)) {
+			t.Errorf("wrong difference for %v random nodes\n", n)
+		}
+
+		// removing every second node must shrink dense containers back into sorted arrays
+		for i, id := range sortedSet(setA) {
+			if i%2 == 0 && !a.Remove(id) {
+				t.Errorf("should remove %v\n", id)
+			}
+		}
+		if a.Cardinality() != len(setA)/2 {
+			t.Errorf("wrong cardinality after remove, expect: %v, actual: %v\n", len(setA)/2, a.Cardinality())
+		}
+
+		data, err := a.MarshalBinary()
+		if err != nil {
+			t.Errorf("error while MarshalBinary, err: %v\n", err)
+		}
+		decoded := dmi.NewBitmap()
+		if err := decoded.UnmarshalBinary(data); err != nil {
+			t.Errorf("error while UnmarshalBinary, err: %v\n", err)
+		}
+		if fmt.Sprint(decoded.ToArray()) != fmt.Sprint(a.ToArray()) {
+			t.Errorf("wrong bitmap after marshal round trip for %v random nodes\n", n)
+		}
+		if len(data) > 1 && decoded.UnmarshalBinary(data[:len(data)-1]) == nil {
+			t.Errorf("should not unmarshal a truncated bitmap\n")
+		}
+	}
+}
@@ -1,7 +1,9 @@
 package test
 
 import (
+	"context"
 	dmi "distributed-metadata-index/pkg"
+	"fmt"
 	"testing"
 )
 
@@ -26,3 +28,403 @@ func TestDeleteAll(t *testing.T) {
 		t.Errorf("Should not find gpu")
 	}
 }
+
+func TestPostings(t *testing.T) {
+	tree := dmi.NewTagValueIndex()
+	tree.AddTagValue("EastUS1", 0)
+	tree.AddTagValue("EastUS2", 1)
+	tree.AddTagValue("WestUS1", 2)
+	err := dmi.PutIndexPostings("region", tree)
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	err = dmi.AddPosting("region", "EastUS1", 3)
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	err = dmi.RemovePosting("region", "WestUS1", 2)
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+
+	treed, err := dmi.GetPostings("region", "East")
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	data, _ := treed.FindAllMatchedNodes("*")
+	if len(data) != 2 || data[0].GetStr() != "EastUS1" || data[0].GetNodeList() != "0, 3" {
+		t.Errorf("wrong result, expect: [EastUS1: 0, 3, EastUS2: 1], actual: %v\n", data)
+	}
+
+	// the last node of WestUS1 is gone, so the key must be gone too
+	treed, err = dmi.GetPostings("region", "West")
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	if data, _ = treed.FindAllMatchedNodes("*"); len(data) != 0 {
+		t.Errorf("Should not find WestUS1")
+	}
+
+	err = dmi.DeleteAll()
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+}
+
+func TestNodeRegistry(t *testing.T) {
+	registry, err := dmi.CreateNodeRegistry()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer registry.Close()
+
+	ids := make(map[string]uint32)
+	for _, name := range []string{"host-b", "host-a", "host-b", "i-0abc"} {
+		id, err := registry.Register(name)
+		if err != nil {
+			t.Errorf("error while Register, err: %v\n", err)
+		}
+		if old, ok := ids[name]; ok && old != id {
+			t.Errorf("wrong result for %v, expect: %v, actual: %v\n", name, old, id)
+		}
+		ids[name] = id
+	}
+	if ids["host-a"] == ids["host-b"] || ids["host-a"] == ids["i-0abc"] {
+		t.Errorf("distinct nodes got the same ID: %v\n", ids)
+	}
+
+	// the IDs survive DeleteAllIndexes and are visible to another registry
+	err = dmi.DeleteAllIndexes()
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	other, err := dmi.CreateNodeRegistry()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer other.Close()
+	if id, found, err := other.Lookup("host-a"); err != nil || !found || id != ids["host-a"] {
+		t.Errorf("wrong result for host-a, expect: %v, actual: %v %v %v\n", ids["host-a"], id, found, err)
+	}
+	if _, found, _ := other.Lookup("host-c"); found {
+		t.Errorf("Should not find host-c")
+	}
+	names, err := other.FormatNodes(dmi.NewBitmap(ids["host-a"], ids["i-0abc"], 1<<31))
+	if err != nil {
+		t.Errorf("error while FormatNodes, err: %v\n", err)
+	}
+	if expected := "host-a, i-0abc, 2147483648"; names != expected {
+		t.Errorf("wrong result, expect: %v, actual: %v\n", expected, names)
+	}
+
+	err = dmi.DeleteAll()
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+}
+
+func TestNodeTags(t *testing.T) {
+	err := dmi.PutNodeTags(7, []dmi.Tag{{Name: "region", Value: "EastUS1"}, {Name: "cpu", Value: "AMD"}, {Name: "cpu", Value: "AMD"}})
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	// postings keep the reverse index up to date
+	err = dmi.AddPosting("level", "5", 7)
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	err = dmi.RemovePosting("region", "EastUS1", 7)
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	tags, err := dmi.GetNodeTags(7)
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	expected := []dmi.Tag{{Name: "cpu", Value: "AMD"}, {Name: "level", Value: "5"}}
+	if fmt.Sprint(tags) != fmt.Sprint(expected) {
+		t.Errorf("wrong result, expect: %v, actual: %v\n", expected, tags)
+	}
+
+	// removing the node cleans up every posting found in the reverse index
+	err = dmi.AddPosting("level", "5", 8)
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	err = dmi.RemoveNodePostings(7)
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	if tags, _ = dmi.GetNodeTags(7); len(tags) != 0 {
+		t.Errorf("Should not find the tags of node 7")
+	}
+	treed, err := dmi.GetPostings("level", "")
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	data, _ := treed.FindAllMatchedNodes("*")
+	if len(data) != 1 || data[0].GetNodeList() != "8" {
+		t.Errorf("wrong result, expect: [5: 8], actual: %v\n", data)
+	}
+
+	err = dmi.DeleteAll()
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+}
+
+func TestDeleteIndex(t *testing.T) {
+	tree := dmi.NewTagValueIndex()
+	tree.AddTagValue("EastUS1", 0)
+	err := dmi.PutIndex("region", dmi.EncodeTagValueIndexToBytes(tree))
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	err = dmi.AddPosting("region", "WestUS1", 1)
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	err = dmi.PutAllNodeTags(map[uint32][]dmi.Tag{
+		0: {{Name: "region", Value: "EastUS1"}, {Name: "cpu", Value: "AMD"}},
+		1: {{Name: "region", Value: "WestUS1"}},
+	})
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+
+	err = dmi.DeleteIndex("region")
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	if resp, _ := dmi.GetIndex("region"); resp != nil {
+		t.Errorf("Should not find region")
+	}
+	treed, err := dmi.GetPostings("region", "")
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	if data, _ := treed.FindAllMatchedNodes("*"); len(data) != 0 {
+		t.Errorf("Should not find the postings of region")
+	}
+	// the reverse index keeps the other tags of the nodes
+	tags, _ := dmi.GetNodeTags(0)
+	expected := []dmi.Tag{{Name: "cpu", Value: "AMD"}}
+	if fmt.Sprint(tags) != fmt.Sprint(expected) {
+		t.Errorf("wrong result, expect: %v, actual: %v\n", expected, tags)
+	}
+	if tags, _ = dmi.GetNodeTags(1); len(tags) != 0 {
+		t.Errorf("Should not find the tags of node 1")
+	}
+
+	err = dmi.DeleteAll()
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+}
+
+func TestNamespaceIndexes(t *testing.T) {
+	team := dmi.Namespace("team-a")
+	tree := dmi.NewTagValueIndex()
+	tree.AddTagValue("EastUS1", 0)
+	err := dmi.PutIndex("region", dmi.EncodeTagValueIndexToBytes(tree))
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	err = team.AddPosting("region", "WestUS1", 1)
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+
+	// the same tag name does not collide across namespaces
+	if resp, _ := team.GetIndex("region"); resp != nil {
+		t.Errorf("Should not find region of the default namespace in team-a")
+	}
+	treed, err := dmi.GetPostings("region", "")
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	if data, _ := treed.FindAllMatchedNodes("*"); len(data) != 0 {
+		t.Errorf("Should not find the postings of team-a in the default namespace")
+	}
+	if tags, _ := dmi.GetNodeTags(1); len(tags) != 0 {
+		t.Errorf("Should not find the tags of node 1 of team-a in the default namespace")
+	}
+
+	err = team.DeleteIndexes()
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	treed, _ = team.GetPostings("region", "")
+	if data, _ := treed.FindAllMatchedNodes("*"); len(data) != 0 {
+		t.Errorf("Should not find the postings of team-a")
+	}
+	if resp, _ := dmi.GetIndex("region"); resp == nil {
+		t.Errorf("Should find region of the default namespace")
+	}
+
+	err = dmi.DeleteAll()
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+}
+
+func TestIndexKey(t *testing.T) {
+	registry, err := dmi.CreateNodeRegistry()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer registry.Close()
+	first, err := registry.Register("host-a")
+	if err != nil {
+		t.Errorf("error while Register, err: %v\n", err)
+	}
+
+	// the index of a tag name like a key of the node registry or the per-value layout does not overwrite it
+	for _, tagName := range []string{"nodes/next", "postings/region/EastUS1"} {
+		err = dmi.PutIndex(tagName, []byte{1, 2, 3})
+		if err != nil {
+			t.Errorf(err.Error())
+		}
+	}
+	second, err := registry.Register("host-b")
+	if err != nil || second != first+1 {
+		t.Errorf("wrong result for host-b, expect: %v, actual: %v %v\n", first+1, second, err)
+	}
+	if resp, _ := dmi.GetIndex("nodes/next"); fmt.Sprint(resp) != "[1 2 3]" {
+		t.Errorf("wrong result for nodes/next, expect: [1 2 3], actual: %v\n", resp)
+	}
+	treed, err := dmi.GetPostings("region", "")
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	if data, _ := treed.FindAllMatchedNodes("*"); len(data) != 0 {
+		t.Errorf("Should not find the postings of region")
+	}
+
+	// an index stored at the bare tag name is read until it is moved to its IndexKey, unlike other values there
+	cli, err := dmi.CreateClient()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer cli.Close()
+	tree := dmi.NewTagValueIndex()
+	tree.AddTagValue("AMD", 1)
+	legacy := string(dmi.EncodeTagValueIndexToBytes(tree))
+	_, err = cli.Put(context.Background(), "cpu", legacy)
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	_, err = cli.Put(context.Background(), "cpu=AMD", "1")
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	if resp, _ := dmi.GetIndex("cpu"); string(resp) != legacy {
+		t.Errorf("wrong result for cpu, expect: %v, actual: %v\n", legacy, string(resp))
+	}
+	if resp, _ := dmi.GetIndex("cpu=AMD"); resp != nil {
+		t.Errorf("Should not read cpu=AMD as an index")
+	}
+	moved, err := dmi.MigrateIndexKeys()
+	if err != nil || moved != 1 {
+		t.Errorf("wrong result for MigrateIndexKeys, expect: 1, actual: %v %v\n", moved, err)
+	}
+	if resp, _ := dmi.GetIndex("cpu"); string(resp) != legacy {
+		t.Errorf("wrong result for cpu, expect: %v, actual: %v\n", legacy, string(resp))
+	}
+	if resp, _ := cli.Get(context.Background(), "cpu"); len(resp.Kvs) != 0 {
+		t.Errorf("Should not find the bare key cpu")
+	}
+	if resp, _ := cli.Get(context.Background(), "cpu=AMD"); len(resp.Kvs) != 1 {
+		t.Errorf("Should not move cpu=AMD")
+	}
+
+	// deleting an index not migrated yet does not bring it back through the bare tag name
+	_, err = cli.Put(context.Background(), "memory", legacy)
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	err = dmi.DeleteIndex("memory")
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	if resp, _ := dmi.GetIndex("memory"); resp != nil {
+		t.Errorf("Should not find the index of memory")
+	}
+	if id, found, err := registry.Lookup("host-b"); err != nil || !found || id != second {
+		t.Errorf("wrong result for host-b, expect: %v, actual: %v %v %v\n", second, id, found, err)
+	}
+
+	err = dmi.DeleteAll()
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+}
+
+func TestIndexSourceCache(t *testing.T) {
+	client, err := dmi.CreateZkClient()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer client.Close()
+
+	tree := dmi.NewTagValueIndex()
+	tree.AddTagValue("EastUS1", 0)
+	tree.AddTagValue("WestUS1", 1)
+	err = dmi.PutIndex("region", dmi.EncodeTagValueIndexToBytes(tree))
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	err = dmi.PutIndexPostings("region", tree)
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+
+	for _, tc := range []struct {
+		source dmi.IndexSource
+		change func() error
+	}{
+		{
+			source: dmi.NewEtcdIndexSource(client),
+			change: func() error {
+				tree.AddTagValue("EastUS2", 2)
+				return dmi.PutIndex("region", dmi.EncodeTagValueIndexToBytes(tree))
+			},
+		},
+		{
+			source: dmi.NewEtcdPostingSource(client),
+			change: func() error {
+				return dmi.AddPosting("region", "EastUS2", 2)
+			},
+		},
+	} {
+		// the suffix index built by the first search is kept with the index for the next one
+		first, err := tc.source.GetTagValueIndex("region", "")
+		if err != nil {
+			t.Errorf("error while GetTagValueIndex, err: %v\n", err)
+		}
+		if data, _ := first.FindAllMatchedNodes("*US1"); len(data) != 2 {
+			t.Errorf("wrong result for *US1, expect: 2 tag values, actual: %v\n", len(data))
+		}
+		second, err := tc.source.GetTagValueIndex("region", "")
+		if err != nil || second != first {
+			t.Errorf("wrong result for %T, expect: the cached index, actual: another one %v\n", tc.source, err)
+		}
+
+		// a change of the keys of the index loads it again
+		if err := tc.change(); err != nil {
+			t.Errorf(err.Error())
+		}
+		third, err := tc.source.GetTagValueIndex("region", "")
+		if err != nil || third == second {
+			t.Errorf("wrong result for %T after a change, expect: a new index, actual: the cached one %v\n", tc.source, err)
+		}
+		if data, _ := third.FindAllMatchedNodes("*US2"); len(data) != 1 {
+			t.Errorf("wrong result for *US2, expect: 1 tag value, actual: %v\n", len(data))
+		}
+	}
+
+	err = dmi.DeleteAll()
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+}
@@ -1,8 +1,12 @@
 package test
 
 import (
+	"bytes"
 	dmi "distributed-metadata-index/pkg"
+	"encoding/gob"
+	"errors"
 	"fmt"
+	"sync"
 	"testing"
 )
 
@@ -30,7 +34,10 @@ func TestIndexBasic(t *testing.T) {
 		t.Errorf(err.Error())
 	}
 	// convert bytes to TagValueIndex
-	treed := dmi.DecodeBytesToTagValueIndex(treeb)
+	treed, err := dmi.DecodeBytesToTagValueIndex(treeb)
+	if err != nil {
+		t.Errorf(err.Error())
+	}
 
 	fmt.Printf("%-18s %-8s %s\n", "prefix", "data", "error")
 	fmt.Printf("%-18s %-8s %s\n", "------", "----", "-----")
@@ -50,3 +57,540 @@ func TestIndexBasic(t *testing.T) {
 		fmt.Printf("%-18s %-8v %v\n", prefix, data, err)
 	}
 }
+
+func TestIndexRemove(t *testing.T) {
+	tree := dmi.NewTagValueIndex()
+	tree.AddTagValue("intel", 0)
+	tree.AddTagValue("intel-i7", 1)
+	tree.AddTagValue("intel-i7", 2)
+	tree.AddTagValue("intel-i9", 4)
+	tree.AddTagValue("amd", 3)
+	tree.AddTagValue("amd", 4)
+
+	if !tree.RemoveTagValue("intel-i7", 1) {
+		t.Errorf("should remove node 1 from intel-i7")
+	}
+	if tree.RemoveTagValue("intel-i7", 1) {
+		t.Errorf("should not remove node 1 from intel-i7 twice")
+	}
+	if tree.RemoveTagValue("intel-i", 2) {
+		t.Errorf("should not remove from a value that does not exist")
+	}
+	data, _ := tree.FindAllMatchedNodes("intel-i7")
+	if len(data) != 1 || data[0].GetNodeList() != "2" {
+		t.Errorf("wrong result, expect: [intel-i7: 2], actual: %v\n", data)
+	}
+
+	if removed := tree.RemoveNode(4); removed != 2 {
+		t.Errorf("wrong number of removed values, expect: 2, actual: %v\n", removed)
+	}
+	if !tree.DeleteTagValue("intel") {
+		t.Errorf("should delete intel")
+	}
+	data, _ = tree.FindAllMatchedNodes("*")
+	if len(data) != 2 {
+		t.Errorf("wrong result, expect: [amd, intel-i7], actual: %v\n", data)
+	}
+
+	// the pruned tree must encode to the same blob as a tree that never had the removed values
+	tree.RemoveTagValue("amd", 3)
+	expected := dmi.NewTagValueIndex()
+	expected.AddTagValue("intel-i7", 2)
+	if !bytes.Equal(dmi.EncodeTagValueIndexToBytes(tree), dmi.EncodeTagValueIndexToBytes(expected)) {
+		t.Errorf("pruned tree is not compacted")
+	}
+}
+
+func TestIndexSnapshot(t *testing.T) {
+	tree := dmi.NewTagValueIndex()
+	tree.AddTagValue("intel-i7", 1)
+	tree.AddTagValue("intel-i9", 2)
+	tree.AddTagValue("10", 3)
+	snapshot := tree.Snapshot()
+	before := dmi.EncodeTagValueIndexToBytes(snapshot)
+
+	// split the SubNode of snapshot, change a NodeList and drop a value
+	tree.AddTagValue("intel", 4)
+	tree.AddTagValue("intel-i7", 5)
+	tree.RemoveNode(2)
+	tree.DeleteTagValue("10")
+	tree.AddTagValue("20", 6)
+
+	if !bytes.Equal(dmi.EncodeTagValueIndexToBytes(snapshot), before) {
+		t.Errorf("snapshot changed after modifying the index")
+	}
+	check := func(tree *dmi.TagValueIndex, expected []string) {
+		data, _ := tree.FindAllMatchedNodes("*")
+		actual := []string{}
+		for _, nodePair := range data {
+			actual = append(actual, nodePair.GetStr()+": "+nodePair.GetNodeList())
+		}
+		if fmt.Sprint(actual) != fmt.Sprint(expected) {
+			t.Errorf("wrong result, expect: %v, actual: %v\n", expected, actual)
+		}
+	}
+	check(snapshot, []string{"10: 3", "intel-i7: 1", "intel-i9: 2"})
+	check(tree, []string{"20: 6", "intel: 4", "intel-i7: 1, 5"})
+	if data := snapshot.FindNodesInRange(dmi.NumericRange{}); len(data) != 1 || data[0].GetStr() != "10" {
+		t.Errorf("wrong result, expect: [10], actual: %v\n", data)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("modifying a snapshot should panic")
+		}
+	}()
+	snapshot.AddTagValue("amd", 7)
+}
+
+func TestIndexConcurrent(t *testing.T) {
+	const writers, values = 4, 200
+	tree := dmi.NewTagValueIndex()
+	done := make(chan struct{})
+
+	var readers sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				// every read of a snapshot has to see the same tag values
+				snapshot := tree.Snapshot()
+				data, _ := snapshot.FindAllMatchedNodes("*")
+				pairs := 0
+				for _, nodePair := range data {
+					pairs += nodePair.GetNodes().Cardinality()
+				}
+				if count, _ := snapshot.Count("*"); count != pairs {
+					t.Errorf("wrong count, expect: %v, actual: %v\n", pairs, count)
+					return
+				}
+				suffixed, _ := snapshot.FindAllMatchedNodes("*-1")
+				numeric := snapshot.FindNodesInRange(dmi.NumericRange{})
+				if len(suffixed) > len(data) || len(numeric) > len(data) {
+					t.Errorf("derived index holds more values than the index: %v, %v, %v\n", len(suffixed), len(numeric), len(data))
+					return
+				}
+			}
+		}()
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < values; i++ {
+				tree.AddTagValue(fmt.Sprintf("host-%d-%d", w, i%10), uint32(w*values+i))
+				tree.AddTagValue(fmt.Sprint(i), uint32(writers*values+w))
+				if i%3 == 0 {
+					tree.RemoveTagValue(fmt.Sprintf("host-%d-%d", w, i%10), uint32(w*values+i))
+				}
+			}
+			tree.RemoveNode(uint32(writers*values + w))
+		}(w)
+	}
+	wg.Wait()
+	close(done)
+	readers.Wait()
+
+	if count, _ := tree.Count("host-*"); count != writers*(values-(values+2)/3) {
+		t.Errorf("wrong count, expect: %v, actual: %v\n", writers*(values-(values+2)/3), count)
+	}
+	if data := tree.FindNodesInRange(dmi.NumericRange{}); len(data) != 0 {
+		t.Errorf("wrong result, expect: [], actual: %v\n", data)
+	}
+}
+
+func TestIndexWildcard(t *testing.T) {
+	tree := dmi.NewTagValueIndex()
+	for i, value := range []string{"intel", "intel-i7", "intel-i9", "amd", "EastUS1", "EastUS2", "WestUS1", "EastAsia", "CentralUS"} {
+		tree.AddTagValue(value, uint32(i))
+	}
+
+	for pattern, expected := range map[string][]string{
+		"intel":    {"intel"},
+		"int":      {},
+		"in?el*":   {"intel", "intel-i7", "intel-i9"},
+		"intel-i?": {"intel-i7", "intel-i9"},
+		"*US*":     {"CentralUS", "EastUS1", "EastUS2", "WestUS1"},
+		"*US":      {"CentralUS"},
+		"East*":    {"EastAsia", "EastUS1", "EastUS2"},
+		"*e*i*":    {"intel-i7", "intel-i9"},
+		"???":      {"amd"},
+		"*":        {"CentralUS", "EastAsia", "EastUS1", "EastUS2", "WestUS1", "amd", "intel", "intel-i7", "intel-i9"},
+	} {
+		data, err := tree.FindAllMatchedNodes(pattern)
+		if err != nil {
+			t.Errorf("error while FindAllMatchedNodes, err: %v\n", err)
+		}
+		actual := []string{}
+		for _, nodePair := range data {
+			actual = append(actual, nodePair.GetStr())
+		}
+		if fmt.Sprint(actual) != fmt.Sprint(expected) {
+			t.Errorf("wrong result for %v, expect: %v, actual: %v\n", pattern, expected, actual)
+		}
+	}
+}
+
+func TestIndexWildcardUTF8(t *testing.T) {
+	tree := dmi.NewTagValueIndex()
+	for i, value := range []string{"région", "region", "日本", "日本語", "a€b", "ab"} {
+		tree.AddTagValue(value, uint32(i))
+	}
+
+	// a ?-wildcard matches one character, however many bytes it takes
+	for pattern, expected := range map[string][]string{
+		"r?gion": {"region", "région"},
+		"??":     {"ab", "日本"},
+		"日?":     {"日本"},
+		"??語":    {"日本語"},
+		"a?b":    {"a€b"},
+		"*?本":    {"日本"},
+	} {
+		data, err := tree.FindAllMatchedNodes(pattern)
+		if err != nil {
+			t.Errorf("error while FindAllMatchedNodes, err: %v\n", err)
+		}
+		actual := []string{}
+		for _, nodePair := range data {
+			actual = append(actual, nodePair.GetStr())
+		}
+		if fmt.Sprint(actual) != fmt.Sprint(expected) {
+			t.Errorf("wrong result for %v, expect: %v, actual: %v\n", pattern, expected, actual)
+		}
+	}
+}
+
+// legacyIndex has the gob layout of a TagValueIndex with a plain []uint32 NodeList
+type legacyIndex struct {
+	SubNodes []legacyNode
+	NodeList []uint32
+	Data     string
+	IsEnd    bool
+}
+
+type legacyNode struct {
+	Str  string
+	Tree *legacyIndex
+}
+
+func TestIndexSuffixWildcard(t *testing.T) {
+	tree := dmi.NewTagValueIndex()
+	for i, value := range []string{"EastUS1", "EastUS2", "WestUS", "USWest", "EastAsia", "status", "USUS"} {
+		tree.AddTagValue(value, uint32(i))
+	}
+
+	check := func(pattern string, expected []string) {
+		data, err := tree.FindAllMatchedNodes(pattern)
+		if err != nil {
+			t.Errorf("error while FindAllMatchedNodes, err: %v\n", err)
+		}
+		actual := []string{}
+		for _, nodePair := range data {
+			actual = append(actual, nodePair.GetStr())
+		}
+		if fmt.Sprint(actual) != fmt.Sprint(expected) {
+			t.Errorf("wrong result for %v, expect: %v, actual: %v\n", pattern, expected, actual)
+		}
+	}
+
+	check("*US*", []string{"EastUS1", "EastUS2", "USUS", "USWest", "WestUS"})
+	check("*US", []string{"USUS", "WestUS"})
+	check("*US?", []string{"EastUS1", "EastUS2"})
+	check("?as*", []string{"EastAsia", "EastUS1", "EastUS2"})
+	check("*st*S", []string{"WestUS"})
+	check("*xyz*", []string{})
+
+	// the suffix index is kept up to date once it is built
+	tree.AddTagValue("CentralUS", 7)
+	tree.DeleteTagValue("USUS")
+	tree.RemoveNode(2)
+	check("*US", []string{"CentralUS"})
+	check("*US*", []string{"CentralUS", "EastUS1", "EastUS2", "USWest"})
+}
+
+func TestIndexCount(t *testing.T) {
+	tree := dmi.NewTagValueIndex()
+	tree.AddTagValue("EastUS1", 0)
+	tree.AddTagValue("EastUS1", 1)
+	tree.AddTagValue("EastUS2", 1)
+	tree.AddTagValue("EastAsia", 2)
+	tree.AddTagValue("WestUS1", 3)
+	tree.AddTagValue("WestUS1", 3)
+
+	check := func(tree *dmi.TagValueIndex, pattern string, expectedCount, expectedDistinct int) {
+		count, err := tree.Count(pattern)
+		if err != nil {
+			t.Errorf("error while Count, err: %v\n", err)
+		}
+		distinct, err := tree.CountDistinctNodes(pattern)
+		if err != nil {
+			t.Errorf("error while CountDistinctNodes, err: %v\n", err)
+		}
+		if count != expectedCount || distinct != expectedDistinct {
+			t.Errorf("wrong result for %v, expect: %v/%v, actual: %v/%v\n", pattern, expectedCount, expectedDistinct, count, distinct)
+		}
+	}
+
+	check(tree, "*", 5, 4)
+	check(tree, "East*", 4, 3)
+	check(tree, "EastUS?", 3, 2)
+	check(tree, "*US1", 3, 3)
+	check(tree, "North*", 0, 0)
+
+	// the counts of the subtrees follow removals and survive encoding
+	tree.RemoveTagValue("EastUS1", 0)
+	tree.DeleteTagValue("EastAsia")
+	check(tree, "East*", 2, 1)
+	tree.RemoveNode(1)
+	check(tree, "*", 1, 1)
+
+	tree.AddTagValue("EastAsia", 4)
+	decoded, err := dmi.DecodeBytesToTagValueIndex(dmi.EncodeTagValueIndexToBytes(tree))
+	if err != nil {
+		t.Errorf("error while DecodeBytesToTagValueIndex, err: %v\n", err)
+	}
+	check(decoded, "*", 2, 2)
+	check(decoded, "E*", 1, 1)
+}
+
+func TestIndexIterate(t *testing.T) {
+	tree := dmi.NewTagValueIndex()
+	for i, value := range []string{"", "a", "ab", "abc", "abd", "b", "ba", "bab", "c", "intel", "intel-i7"} {
+		tree.AddTagValue(value, uint32(i))
+	}
+
+	for _, pattern := range []string{"*", "a*", "*b*", "?", "intel*", "x*"} {
+		expected, err := tree.FindAllMatchedNodes(pattern)
+		if err != nil {
+			t.Errorf("error while FindAllMatchedNodes, err: %v\n", err)
+		}
+
+		for limit := 1; limit <= 4; limit++ {
+			var actual []dmi.TagNodePair
+			cursor := ""
+			for pages := 0; ; pages++ {
+				data, next, err := tree.FindMatchedNodesPage(pattern, cursor, limit)
+				if err != nil {
+					t.Errorf("error while FindMatchedNodesPage, err: %v\n", err)
+					break
+				}
+				if len(data) > limit || next != "" && len(data) != limit {
+					t.Errorf("wrong page size for %v, limit: %v, actual: %v\n", pattern, limit, len(data))
+				}
+				actual = append(actual, data...)
+				if next == "" || pages > len(expected) {
+					break
+				}
+				cursor = next
+			}
+			if fmt.Sprint(actual) != fmt.Sprint(expected) {
+				t.Errorf("wrong result for %v, limit: %v, expect: %v, actual: %v\n", pattern, limit, expected, actual)
+			}
+		}
+	}
+
+	// a cursor keeps working after the tag value it was taken at is deleted
+	it, _ := tree.Iterate("a*", "")
+	it.Next()
+	it.Next()
+	cursor := it.Cursor()
+	tree.DeleteTagValue("ab")
+	data, _, _ := tree.FindMatchedNodesPage("a*", cursor, 10)
+	if len(data) != 2 || data[0].GetStr() != "abc" {
+		t.Errorf("wrong result, expect: [abc abd], actual: %v\n", data)
+	}
+
+	if _, err := tree.Iterate("*", "not a cursor"); err != dmi.ErrInvalidCursor {
+		t.Errorf("wrong error, expect: %v, actual: %v\n", dmi.ErrInvalidCursor, err)
+	}
+}
+
+func TestIndexRegexp(t *testing.T) {
+	tree := dmi.NewTagValueIndex()
+	for i, value := range []string{"intel", "intel-i7", "intel-i9", "amd", "EastUS1", "EastUS2", "WestUS1", "EastAsia", "CentralUS", "Zürich"} {
+		tree.AddTagValue(value, uint32(i))
+	}
+
+	for expr, expected := range map[string][]string{
+		"intel":            {"intel"},
+		"int":              {},
+		"intel-i[0-8]":     {"intel-i7"},
+		"(East|West)US\\d": {"EastUS1", "EastUS2", "WestUS1"},
+		".*US":             {"CentralUS"},
+		"^amd$|intel":      {"amd", "intel"},
+		"(?i)EAST.*":       {"EastAsia", "EastUS1", "EastUS2"},
+		"Z.rich":           {"Zürich"},
+		"(|a)*m(|d)*":      {"amd"},
+		".*\\bi\\d":        {"intel-i7", "intel-i9"},
+	} {
+		data, err := tree.FindRegexpMatchedNodes(expr)
+		if err != nil {
+			t.Errorf("error while FindRegexpMatchedNodes, err: %v\n", err)
+		}
+		actual := []string{}
+		for _, nodePair := range data {
+			actual = append(actual, nodePair.GetStr())
+		}
+		if fmt.Sprint(actual) != fmt.Sprint(expected) {
+			t.Errorf("wrong result for %v, expect: %v, actual: %v\n", expr, expected, actual)
+		}
+	}
+
+	if _, err := tree.FindRegexpMatchedNodes("intel("); err == nil {
+		t.Errorf("invalid regular expression should fail\n")
+	}
+}
+
+func TestIndexFuzzy(t *testing.T) {
+	tree := dmi.NewTagValueIndex()
+	for i, value := range []string{"Intel", "intel", "AMD", "EastUS", "EastUS2", "WestUS", "Zürich"} {
+		tree.AddTagValue(value, uint32(i))
+	}
+
+	for _, c := range []struct {
+		tagValue    string
+		maxDistance int
+		expected    string
+	}{
+		{"Intle", 3, "[Intel:2 intel:3]"},
+		{"Intle", 1, "[]"},
+		{"intel", 0, "[intel:0]"},
+		{"EastUS", 1, "[EastUS:0 EastUS2:1]"},
+		{"EsatUS", 3, "[EastUS:2 EastUS2:3 WestUS:3]"},
+		{"Zurich", 1, "[Zürich:1]"},
+		{"", 3, "[AMD:3]"},
+	} {
+		data, err := tree.FindFuzzyMatchedNodes(c.tagValue, c.maxDistance)
+		if err != nil {
+			t.Errorf("error while FindFuzzyMatchedNodes, err: %v\n", err)
+		}
+		actual := []string{}
+		for _, nodePair := range data {
+			actual = append(actual, fmt.Sprintf("%v:%v", nodePair.GetStr(), nodePair.GetDistance()))
+		}
+		if fmt.Sprint(actual) != c.expected {
+			t.Errorf("wrong result for %v~%v, expect: %v, actual: %v\n", c.tagValue, c.maxDistance, c.expected, actual)
+		}
+	}
+
+	if _, err := tree.FindFuzzyMatchedNodes("Intel", -1); err == nil {
+		t.Errorf("negative distance should fail\n")
+	}
+}
+
+func TestIndexDecodeLegacyNodeList(t *testing.T) {
+	legacy := &legacyIndex{SubNodes: []legacyNode{
+		{"amd", &legacyIndex{NodeList: []uint32{3, 1, 3}, Data: "amd", IsEnd: true}},
+		{"intel", &legacyIndex{NodeList: []uint32{0}, Data: "intel", IsEnd: true, SubNodes: []legacyNode{
+			{"-i7", &legacyIndex{NodeList: []uint32{2, 5}, Data: "intel-i7", IsEnd: true}},
+		}}},
+	}}
+	buf := bytes.Buffer{}
+	if err := gob.NewEncoder(&buf).Encode(legacy); err != nil {
+		t.Errorf(err.Error())
+	}
+	treed, err := dmi.DecodeBytesToTagValueIndex(buf.Bytes())
+	if err != nil {
+		t.Errorf("error while decoding legacy blob, err: %v\n", err)
+	}
+
+	data, _ := treed.FindAllMatchedNodes("*")
+	actual := []string{}
+	for _, nodePair := range data {
+		actual = append(actual, nodePair.GetStr()+": "+nodePair.GetNodeList())
+	}
+	expected := []string{"amd: 1, 3", "intel: 0", "intel-i7: 2, 5"}
+	if fmt.Sprint(actual) != fmt.Sprint(expected) {
+		t.Errorf("wrong result, expect: %v, actual: %v\n", expected, actual)
+	}
+}
+
+func TestIndexNumericRange(t *testing.T) {
+	tree := dmi.NewTagValueIndex()
+	for i, value := range []string{"1", "9", "10", "-3", "2.5", "07", "7", "abc", "100", "1e3"} {
+		tree.AddTagValue(value, uint32(i))
+	}
+
+	for _, test := range []struct {
+		r        dmi.NumericRange
+		expected []string
+	}{
+		{dmi.NumericRange{Min: 5, HasMin: true}, []string{"07", "7", "9", "10", "100", "1e3"}},
+		{dmi.NumericRange{Max: 7, HasMax: true, MaxInclusive: true}, []string{"-3", "1", "2.5", "07", "7"}},
+		{dmi.NumericRange{Min: 7, Max: 100, HasMin: true, HasMax: true}, []string{"9", "10"}},
+		{dmi.NumericRange{Min: -5, Max: 1, HasMin: true, HasMax: true, MinInclusive: true, MaxInclusive: true}, []string{"-3", "1"}},
+		{dmi.NumericRange{}, []string{"-3", "1", "2.5", "07", "7", "9", "10", "100", "1e3"}},
+	} {
+		actual := []string{}
+		for _, nodePair := range tree.FindNodesInRange(test.r) {
+			actual = append(actual, nodePair.GetStr())
+		}
+		if fmt.Sprint(actual) != fmt.Sprint(test.expected) {
+			t.Errorf("wrong result for%v, expect: %v, actual: %v\n", test.r, test.expected, actual)
+		}
+	}
+
+	// the ordered index must follow later changes of the prefix Tree
+	tree.DeleteTagValue("9")
+	tree.RemoveNode(2)
+	tree.AddTagValue("8", 11)
+	actual := []string{}
+	for _, nodePair := range tree.FindNodesInRange(dmi.NumericRange{Min: 7, HasMin: true, MinInclusive: true}) {
+		actual = append(actual, nodePair.GetStr())
+	}
+	if expected := []string{"07", "7", "8", "100", "1e3"}; fmt.Sprint(actual) != fmt.Sprint(expected) {
+		t.Errorf("wrong result after update, expect: %v, actual: %v\n", expected, actual)
+	}
+}
+
+func TestIndexBinaryFormat(t *testing.T) {
+	tree := dmi.NewTagValueIndex()
+	for i, value := range []string{"", "intel", "intel-i7", "intel-i9", "amd", "EastUS1"} {
+		tree.AddTagValue(value, uint32(i))
+	}
+	for i := 0; i < 10000; i++ {
+		tree.AddTagValue("amd", uint32(i*3))
+	}
+	treeb := dmi.EncodeTagValueIndexToBytes(tree)
+
+	treed, err := dmi.DecodeBytesToTagValueIndex(treeb)
+	if err != nil {
+		t.Errorf("error while DecodeBytesToTagValueIndex, err: %v\n", err)
+	}
+	expected, _ := tree.FindAllMatchedNodes("*")
+	actual, _ := treed.FindAllMatchedNodes("*")
+	if len(actual) != len(expected) {
+		t.Errorf("wrong result, expect: %v, actual: %v\n", expected, actual)
+	}
+	for i := range expected {
+		if actual[i].GetStr() != expected[i].GetStr() || actual[i].GetNodeList() != expected[i].GetNodeList() {
+			t.Errorf("wrong result, expect: %v, actual: %v\n", expected[i].GetStr(), actual[i].GetStr())
+		}
+	}
+
+	// every flipped byte and every truncation must be reported as an error instead of crashing
+	for i := range treeb {
+		corrupt := append([]byte(nil), treeb...)
+		corrupt[i] ^= 0x20
+		if _, err := dmi.DecodeBytesToTagValueIndex(corrupt); err == nil {
+			t.Errorf("should not decode a blob with byte %v flipped\n", i)
+		}
+		if _, err := dmi.DecodeBytesToTagValueIndex(treeb[:i]); err == nil {
+			t.Errorf("should not decode a blob truncated to %v bytes\n", i)
+		}
+	}
+
+	unsupported := append([]byte(nil), treeb...)
+	unsupported[4] = 2
+	if _, err := dmi.DecodeBytesToTagValueIndex(unsupported); !errors.Is(err, dmi.ErrUnsupportedIndexVersion) {
+		t.Errorf("wrong error for a newer version, actual: %v\n", err)
+	}
+}
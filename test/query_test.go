@@ -0,0 +1,181 @@
+package test
+
+import (
+	dmi "distributed-metadata-index/pkg"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// buildSource indexes lines of comma separated tags, using the line number as node
+func buildSource(lines []string) dmi.MapIndexSource {
+	source := dmi.MapIndexSource{}
+	for node, line := range lines {
+		for _, tag := range strings.Split(line, ",") {
+			tmp := strings.Split(tag, "=")
+			if _, ok := source[tmp[0]]; !ok {
+				source[tmp[0]] = dmi.NewTagValueIndex()
+			}
+			source[tmp[0]].AddTagValue(tmp[1], uint32(node))
+		}
+	}
+	return source
+}
+
+var queryTestLines = []string{
+	"cpu=AMD,region=EastUS1,level=1",
+	"cpu=AMD,region=EastUS2,level=3",
+	"cpu=Intel,region=EastUS1,level=3",
+	"cpu=AMD,region=WestUS1,level=5",
+	"cpu=Intel,region=EastAsia,level=1",
+}
+
+func TestParseQuery(t *testing.T) {
+	for query, expected := range map[string]string{
+		"cpu=AMD": "cpu=AMD",
+		"cpu=AMD AND region=East* AND NOT level=1": "(cpu=AMD AND region=East* AND NOT level=1)",
+		"cpu=AMD or cpu=Intel and level=3":         "(cpu=AMD OR (cpu=Intel AND level=3))",
+		"(cpu=AMD OR cpu=Intel) AND level=3":       "((cpu=AMD OR cpu=Intel) AND level=3)",
+		`"cpu"="Intel Xeon"`:                       `cpu="Intel Xeon"`,
+		"NOT NOT cpu=AMD":                          "NOT NOT cpu=AMD",
+		"level>5 AND level <= 7":                   "(level>5 AND level<=7)",
+		"resourceId in [1000, 2000)":               "resourceId in [1000,2000)",
+		"resourceId IN (1e3,2e3]":                  "resourceId in (1000,2000]",
+		"/cpu|gpu/=/(AMD|Intel).*/":                "/cpu|gpu/=/(AMD|Intel).*/",
+		`path=/\/usr\/.* (bin)?/`:                  `path=/\/usr\/.* (bin)?/`,
+		`"/usr"=x`:                                 `"/usr"=x`,
+		"regoin~=EastUS~1":                         "regoin~2=EastUS~1",
+		`cpu="Intel~2"`:                            `cpu="Intel~2"`,
+		"levle~ > 5":                               "levle~2>5",
+	} {
+		q, err := dmi.ParseQuery(query)
+		if err != nil {
+			t.Errorf("error while ParseQuery %v, err: %v\n", query, err)
+			continue
+		}
+		if q.String() != expected {
+			t.Errorf("wrong result, expect: %v, actual: %v\n", expected, q)
+		}
+	}
+
+	for _, query := range []string{"", "cpu", "cpu=AMD AND", "(cpu=AMD", "cpu=AMD level=1", `cpu="AMD`, "level>five", "level in [1,2", "cpu=/AMD", "cpu=Intel~0", "cpu=/AMD/~1"} {
+		if _, err := dmi.ParseQuery(query); err == nil {
+			t.Errorf("should not parse %q\n", query)
+		}
+	}
+}
+
+func TestEvaluateQuery(t *testing.T) {
+	source := buildSource(queryTestLines)
+
+	for query, expected := range map[string][]uint32{
+		"cpu=AMD": {0, 1, 3},
+		"cpu=AMD AND region=East* AND NOT level=1":    {1},
+		"cpu=AMD AND region=East*":                    {0, 1},
+		"level=1 OR level=5":                          {0, 3, 4},
+		"NOT cpu=AMD":                                 {2, 4},
+		"NOT cpu=AMD OR level=5":                      {2, 3, 4},
+		"(cpu=Intel OR region=West*) AND level=3":     {2},
+		"c*=AMD AND NOT region=EastUS?":               {3},
+		"gpu=*":                                       {},
+		"level>=3":                                    {1, 2, 3},
+		"cpu=AMD AND level in (1,5]":                  {1, 3},
+		"NOT level<3":                                 {1, 2, 3},
+		"/c.u/=/AMD|Intel/ AND region=/East(US)?\\d/": {0, 1, 2},
+		"/(?i)REGION/=/.*[Aa]sia/":                    {4},
+		"cpu=/int.*/":                                 {},
+	} {
+		nodes, err := dmi.EvaluateQuery(source, query)
+		if err != nil {
+			t.Errorf("error while EvaluateQuery %v, err: %v\n", query, err)
+		}
+		if fmt.Sprint(nodes.ToArray()) != fmt.Sprint(expected) {
+			t.Errorf("wrong result for %v, expect: %v, actual: %v\n", query, expected, nodes)
+		}
+	}
+}
+
+func TestSuggestQuery(t *testing.T) {
+	source := buildSource(queryTestLines)
+
+	for query, expected := range map[string]string{
+		"regoin=EastUS":  "[region=EastUS1:3 region=EastUS2:3]",
+		"cpu=Intle":      "[cpu=Intel:2]",
+		"levle>3":        "[level=5:2]",
+		"cpu=/Intle|am/": "[]",
+	} {
+		q, err := dmi.ParseQuery(query)
+		if err != nil {
+			t.Errorf("error while ParseQuery %v, err: %v\n", query, err)
+			continue
+		}
+		matches, err := q.Term.Suggest(source)
+		if err != nil {
+			t.Errorf("error while Suggest %v, err: %v\n", query, err)
+		}
+		actual := []string{}
+		for _, match := range matches {
+			actual = append(actual, fmt.Sprintf("%v=%v:%v", match.TagName, match.GetStr(), match.Distance()))
+		}
+		if fmt.Sprint(actual) != expected {
+			t.Errorf("wrong result for %v, expect: %v, actual: %v\n", query, expected, actual)
+		}
+	}
+}
+
+func TestCountQuery(t *testing.T) {
+	source := buildSource(queryTestLines)
+
+	for query, expected := range map[string]string{
+		"region=East*":  "[{region 4 4}]",
+		"*=1":           "[{level 2 2}]",
+		"level>=3":      "[{level 3 3}]",
+		"cpu=/AMD|.*l/": "[{cpu 5 5}]",
+		"gpu=*":         "[]",
+	} {
+		q, err := dmi.ParseQuery(query)
+		if err != nil {
+			t.Errorf("error while ParseQuery %v, err: %v\n", query, err)
+			continue
+		}
+		counts, err := q.Term.Count(source)
+		if err != nil {
+			t.Errorf("error while Count %v, err: %v\n", query, err)
+		}
+		if fmt.Sprint(counts) != expected {
+			t.Errorf("wrong result for %v, expect: %v, actual: %v\n", query, expected, counts)
+		}
+	}
+}
+
+func TestFindFirstMatchedNodes(t *testing.T) {
+	source := buildSource(queryTestLines)
+
+	for _, c := range []struct {
+		query    string
+		limit    int
+		expected string
+	}{
+		{"region=East*", 2, "[region=EastAsia region=EastUS1]"},
+		{"*=*", 3, "[cpu=AMD cpu=Intel level=1]"},
+		{"region=/.*US.*/", 10, "[region=EastUS1 region=EastUS2 region=WestUS1]"},
+		{"level>1", 1, "[level=3]"},
+	} {
+		q, err := dmi.ParseQuery(c.query)
+		if err != nil {
+			t.Errorf("error while ParseQuery %v, err: %v\n", c.query, err)
+			continue
+		}
+		matches, err := q.Term.FindFirstMatchedNodes(source, c.limit)
+		if err != nil {
+			t.Errorf("error while FindFirstMatchedNodes %v, err: %v\n", c.query, err)
+		}
+		actual := []string{}
+		for _, match := range matches {
+			actual = append(actual, match.TagName+"="+match.GetStr())
+		}
+		if fmt.Sprint(actual) != c.expected {
+			t.Errorf("wrong result for %v, expect: %v, actual: %v\n", c.query, c.expected, actual)
+		}
+	}
+}
@@ -2,19 +2,26 @@ package test
 
 import (
 	"fmt"
+	"reflect"
+	"sort"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	dmi "distributed-metadata-index/pkg"
+	"github.com/go-zookeeper/zk"
 )
 
 // CleanupZk ensures that tests can be run one after another by clearing
 // the Zookeeper directory after each test.
 func CleanupZk() {
 	zkConn, _ := dmi.ConnectZk(dmi.ZkAddr)
-	err := dmi.DeleteZkRoot(dmi.TagNameTriePath, zkConn)
-	if err != nil {
-		fmt.Printf("error while deleting root, err: %v\n", err)
+	for _, root := range []string{dmi.TagNameTriePath, dmi.TagNameSuffixTriePath, dmi.TagNameRadixTriePath, dmi.TagNameRadixSuffixTriePath} {
+		err := dmi.DeleteZkRoot(root, zkConn)
+		if err != nil && err != zk.ErrNoNode {
+			fmt.Printf("error while deleting root, err: %v\n", err)
+		}
 	}
 }
 
@@ -155,6 +162,279 @@ func TestAdvancedWildcard(t *testing.T) {
 	t.Cleanup(CleanupZk)
 }
 
+func TestSuffixWildcard(t *testing.T) {
+	client, _ := dmi.CreateZkClient()
+
+	for _, tagName := range []string{"memorizing", "meowing", "meng", "region", "regionUS", "USregion", "status"} {
+		err := client.AddTagName(tagName)
+		if err != nil {
+			t.Errorf("error while AddTagName, err: %v\n", err)
+		}
+	}
+
+	for pattern, expected := range map[string][]string{
+		"*ing":   {"memorizing", "meowing"},
+		"*ng":    {"memorizing", "meng", "meowing"},
+		"*US*":   {"USregion", "regionUS"},
+		"*US":    {"regionUS"},
+		"*gion*": {"USregion", "region", "regionUS"},
+		"?eng":   {"meng"},
+		"*at?s":  {"status"},
+		"*o*i?g": {"memorizing", "meowing"},
+		"*xyz*":  {},
+	} {
+		results, err := client.SearchTagName(pattern)
+		if err != nil {
+			t.Errorf("error while SearchTagName, err: %v\n", err)
+		}
+		if fmt.Sprint(results) != fmt.Sprint(expected) {
+			t.Errorf("wrong result for %v, expect: %v, actual: %v\n", pattern, expected, results)
+		}
+	}
+
+	t.Cleanup(CleanupZk)
+}
+
+func TestRegexp(t *testing.T) {
+	client, _ := dmi.CreateZkClient()
+
+	for _, tagName := range []string{"cpu", "cpa", "gpu", "region", "regionId", "efg"} {
+		err := client.AddTagName(tagName)
+		if err != nil {
+			t.Errorf("error while AddTagName, err: %v\n", err)
+		}
+	}
+
+	for expr, expected := range map[string][]string{
+		"[cg]pu":       {"cpu", "gpu"},
+		"cp.":          {"cpa", "cpu"},
+		"region(Id)?":  {"region", "regionId"},
+		"(?i)REGION.+": {"regionId"},
+		".*[^u]":       {"cpa", "efg", "region", "regionId"},
+		"cpu|efg|xyz":  {"cpu", "efg"},
+		"re":           {},
+	} {
+		results, err := client.SearchTagNameRegexp(expr)
+		if err != nil {
+			t.Errorf("error while SearchTagNameRegexp, err: %v\n", err)
+		}
+		if fmt.Sprint(results) != fmt.Sprint(expected) {
+			t.Errorf("wrong result for %v, expect: %v, actual: %v\n", expr, expected, results)
+		}
+	}
+
+	_, err := client.SearchTagNameRegexp("cpu[")
+	if err == nil {
+		t.Errorf("invalid regular expression should fail\n")
+	}
+
+	t.Cleanup(CleanupZk)
+}
+
+func TestFuzzy(t *testing.T) {
+	client, _ := dmi.CreateZkClient()
+
+	for _, tagName := range []string{"region", "regionId", "cpu", "gpu", "level"} {
+		err := client.AddTagName(tagName)
+		if err != nil {
+			t.Errorf("error while AddTagName, err: %v\n", err)
+		}
+	}
+
+	results, err := client.SearchTagNameFuzzy("regoin", 2)
+	if err != nil {
+		t.Errorf("error while SearchTagNameFuzzy, err: %v\n", err)
+	}
+	if fmt.Sprint(results) != "[{region 2}]" {
+		t.Errorf("wrong result, expect: [{region 2}], actual: %v\n", results)
+	}
+
+	results, err = client.SearchTagNameFuzzy("cpu", 1)
+	if err != nil {
+		t.Errorf("error while SearchTagNameFuzzy, err: %v\n", err)
+	}
+	if fmt.Sprint(results) != "[{cpu 0} {gpu 1}]" {
+		t.Errorf("wrong result, expect: [{cpu 0} {gpu 1}], actual: %v\n", results)
+	}
+
+	t.Cleanup(CleanupZk)
+}
+
+func TestBuildSuffixTrie(t *testing.T) {
+	client, _ := dmi.CreateZkClient()
+	for _, tagName := range []string{"operationName", "region", "ration"} {
+		err := client.AddTagName(tagName)
+		if err != nil {
+			t.Errorf("error while AddTagName, err: %v\n", err)
+		}
+	}
+
+	// only the first SuffixTrieDepth characters of a suffix are kept
+	zkConn, _ := dmi.ConnectZk(dmi.ZkAddr)
+	for path, expected := range map[string]bool{
+		dmi.JoinPath(dmi.TagNameSuffixTriePath, "t", "i", "o"):      true,
+		dmi.JoinPath(dmi.TagNameSuffixTriePath, "t", "i", "o", "n"): false,
+	} {
+		exists, _, err := zkConn.Exists(path)
+		if err != nil || exists != expected {
+			t.Errorf("wrong result for %v, expect: %v, actual: %v %v\n", path, expected, exists, err)
+		}
+	}
+
+	// a suffix Trie of an earlier version lacks the tag names added before it existed and is not ready
+	err := dmi.DeleteZkRoot(dmi.TagNameSuffixTriePath, zkConn)
+	if err != nil {
+		t.Errorf("error while DeleteZkRoot, err: %v\n", err)
+	}
+	_, err = zkConn.Create(dmi.TagNameSuffixTriePath, nil, 0, zk.WorldACL(zk.PermAll))
+	if err != nil {
+		t.Errorf("error while Create, err: %v\n", err)
+	}
+
+	other, _ := dmi.CreateZkClient()
+	expect := map[string][]string{
+		"*ion":    {"ration", "region"},
+		"*tionN*": {"operationName"},
+		"*ation*": {"operationName", "ration"},
+		"*Name":   {"operationName"},
+	}
+	for _, build := range []bool{false, true} {
+		if build {
+			err := other.BuildSuffixTrie()
+			if err != nil {
+				t.Errorf("error while BuildSuffixTrie, err: %v\n", err)
+			}
+		}
+		for pattern, tagNames := range expect {
+			results, err := other.SearchTagName(pattern)
+			if err != nil {
+				t.Errorf("error while SearchTagName, err: %v\n", err)
+			}
+			if !reflect.DeepEqual(results, tagNames) {
+				t.Errorf("wrong result for %v after BuildSuffixTrie %v, expect: %v, actual: %v\n", pattern, build, tagNames, results)
+			}
+		}
+	}
+	data, _, err := zkConn.Get(dmi.TagNameSuffixTriePath)
+	if err != nil || string(data) != "ready" {
+		t.Errorf("wrong result for the data of %v, expect: ready, actual: %q %v\n", dmi.TagNameSuffixTriePath, data, err)
+	}
+
+	t.Cleanup(CleanupZk)
+}
+
+func TestRadixTrie(t *testing.T) {
+	client, _ := dmi.CreateZkClient()
+
+	for _, tagName := range []string{"operationName", "operationId", "region", "regionUS"} {
+		err := client.AddTagName(tagName)
+		if err != nil {
+			t.Errorf("error while AddTagName, err: %v\n", err)
+		}
+	}
+
+	err := client.MigrateToRadixTrie()
+	if err != nil {
+		t.Errorf("error while MigrateToRadixTrie, err: %v\n", err)
+	}
+	if client.Layout() != dmi.RadixTrieLayout {
+		t.Errorf("wrong layout, expect: %v, actual: %v\n", dmi.RadixTrieLayout, client.Layout())
+	}
+
+	// split the edges "operation" and "region"
+	for _, tagName := range []string{"op", "opera", "regio", "resultType", "region"} {
+		err := client.AddTagName(tagName)
+		if err != nil {
+			t.Errorf("error while AddTagName, err: %v\n", err)
+		}
+	}
+
+	// a new client finds the migrated Trie
+	other, _ := dmi.CreateZkClient()
+	if other.Layout() != dmi.RadixTrieLayout {
+		t.Errorf("wrong layout, expect: %v, actual: %v\n", dmi.RadixTrieLayout, other.Layout())
+	}
+	for pattern, expected := range map[string][]string{
+		"*":           {"op", "opera", "operationId", "operationName", "regio", "region", "regionUS", "resultType"},
+		"opera*":      {"opera", "operationId", "operationName"},
+		"op?ra":       {"opera"},
+		"re*":         {"regio", "region", "regionUS", "resultType"},
+		"*Name":       {"operationName"},
+		"*io*":        {"operationId", "operationName", "regio", "region", "regionUS"},
+		"operation":   {},
+		"regionUSA":   {},
+		"*tionNa*":    {"operationName"},
+		"*ionUS":      {"regionUS"},
+		"resultType":  {"resultType"},
+		"operationId": {"operationId"},
+	} {
+		results, err := other.SearchTagName(pattern)
+		if err != nil {
+			t.Errorf("error while SearchTagName, err: %v\n", err)
+		}
+		if fmt.Sprint(results) != fmt.Sprint(expected) {
+			t.Errorf("wrong result for %v, expect: %v, actual: %v\n", pattern, expected, results)
+		}
+	}
+
+	results, err := other.SearchTagNameRegexp("op(era)?")
+	if err != nil || fmt.Sprint(results) != "[op opera]" {
+		t.Errorf("wrong result, expect: [op opera], actual: %v %v\n", results, err)
+	}
+	fuzzy, err := other.SearchTagNameFuzzy("regoin", 2)
+	if err != nil || fmt.Sprint(fuzzy) != "[{region 2}]" {
+		t.Errorf("wrong result, expect: [{region 2}], actual: %v %v\n", fuzzy, err)
+	}
+
+	t.Cleanup(CleanupZk)
+}
+
+func TestParallelWildcard(t *testing.T) {
+	client, _ := dmi.CreateZkClient()
+
+	// a wide Trie, so the children of the wildcards are traversed in parallel
+	var tagNames []string
+	for _, first := range "zyxwvutsrqponmlkjihgfedcba" {
+		for _, second := range "cba" {
+			tagNames = append(tagNames, string(first)+string(second), string(first)+string(second)+"s")
+		}
+	}
+	for _, tagName := range tagNames {
+		err := client.AddTagName(tagName)
+		if err != nil {
+			t.Errorf("error while AddTagName, err: %v\n", err)
+		}
+	}
+	sort.Strings(tagNames)
+
+	// the results are merged in the order of the Trie, the lexicographical order of the tag names
+	for i := 0; i < 3; i++ {
+		results, err := client.SearchTagName("*")
+		if err != nil {
+			t.Errorf("error while SearchTagName, err: %v\n", err)
+		}
+		if !reflect.DeepEqual(results, tagNames) {
+			t.Errorf("wrong result for *, expect: %v, actual: %v\n", tagNames, results)
+		}
+	}
+
+	var expect []string
+	for _, tagName := range tagNames {
+		if len(tagName) == 2 {
+			expect = append(expect, tagName)
+		}
+	}
+	results, err := client.SearchTagName("??")
+	if err != nil {
+		t.Errorf("error while SearchTagName, err: %v\n", err)
+	}
+	if !reflect.DeepEqual(results, expect) {
+		t.Errorf("wrong result for ??, expect: %v, actual: %v\n", expect, results)
+	}
+
+	t.Cleanup(CleanupZk)
+}
+
 func TestConcurrentAdd(t *testing.T) {
 	numClients := 10
 	tagNames := [10]string{"abc", "acd", "bde", "bdf", "aba", "abc", "bac", "cef", "caf", "def"}
@@ -199,3 +479,795 @@ func TestConcurrentAdd(t *testing.T) {
 
 	t.Cleanup(CleanupZk)
 }
+
+func TestConcurrentAddSearch(t *testing.T) {
+	concurrentAddSearch(t, false)
+	t.Cleanup(CleanupZk)
+}
+
+func TestConcurrentAddSearchRadix(t *testing.T) {
+	concurrentAddSearch(t, true)
+	t.Cleanup(CleanupZk)
+}
+
+// concurrentAddSearch adds overlapping tag names from many clients, which splits the same edges of the radix Trie
+// concurrently, while other clients search. A search never loses a tag name it found before.
+func concurrentAddSearch(t *testing.T, radix bool) {
+	tagNames := []string{"o", "op", "ope", "opera", "operation", "operationId", "operationName", "opus", "or",
+		"region", "regio", "regionUS", "regionEU", "resultType", "result", "re", "r", "ion", "on"}
+	patterns := []string{"*", "op*", "*ion", "re?ion*"}
+	numWriters, numReaders := 8, 4
+
+	if radix {
+		client, _ := dmi.CreateZkClient()
+		err := client.MigrateToRadixTrie()
+		if err != nil {
+			t.Errorf("error while MigrateToRadixTrie, err: %v\n", err)
+		}
+	}
+
+	var writers, readers sync.WaitGroup
+	done := make(chan struct{})
+	for i := 0; i < numReaders; i++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			zc, err := dmi.CreateZkClient()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			found := make(map[string]int)
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				for _, pattern := range patterns {
+					results, err := zc.SearchTagName(pattern)
+					if err != nil {
+						t.Errorf("error while SearchTagName, err: %v\n", err)
+						return
+					}
+					if !sort.StringsAreSorted(results) || len(results) < found[pattern] {
+						t.Errorf("wrong result for %v, found %v before, actual: %v\n", pattern, found[pattern], results)
+					}
+					found[pattern] = len(results)
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < numWriters; i++ {
+		writers.Add(1)
+		go func(idx int) {
+			defer writers.Done()
+			zc, err := dmi.CreateZkClient()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			// every writer adds all tag names, starting at a different one
+			for j := range tagNames {
+				err = zc.AddTagName(tagNames[(idx+j)%len(tagNames)])
+				if err != nil {
+					t.Error(err)
+				}
+			}
+		}(i)
+	}
+	writers.Wait()
+	close(done)
+	readers.Wait()
+
+	zc, _ := dmi.CreateZkClient()
+	if radix && zc.Layout() != dmi.RadixTrieLayout {
+		t.Errorf("wrong layout, expect: %v, actual: %v\n", dmi.RadixTrieLayout, zc.Layout())
+	}
+	allTagNames, err := zc.SearchTagName("*")
+	if err != nil {
+		t.Error(err)
+	}
+	expect := append([]string(nil), tagNames...)
+	sort.Strings(expect)
+	if !reflect.DeepEqual(allTagNames, expect) {
+		t.Errorf("wrong result for *, expect: %v, actual: %v\n", expect, allTagNames)
+	}
+}
+
+func TestRemoveTagName(t *testing.T) {
+	removeTagName(t, false)
+	t.Cleanup(CleanupZk)
+}
+
+func TestRadixTrieSplitDeepEdge(t *testing.T) {
+	client, _ := dmi.CreateZkClient()
+	err := client.MigrateToRadixTrie()
+	if err != nil {
+		t.Errorf("error while MigrateToRadixTrie, err: %v\n", err)
+	}
+
+	// a chain of 100 edges below the edge "operation"
+	var tagNames []string
+	for i := 0; i <= 100; i++ {
+		tagName := "operation" + strings.Repeat("x", i)
+		tagNames = append(tagNames, tagName)
+		err := client.AddTagName(tagName)
+		if err != nil {
+			t.Errorf("error while AddTagName, err: %v\n", err)
+		}
+	}
+
+	zkConn, _ := dmi.ConnectZk(dmi.ZkAddr)
+	edge := dmi.JoinPath(dmi.TagNameRadixTriePath, "+operation")
+	_, before, err := zkConn.Exists(edge)
+	if err != nil {
+		t.Errorf("error while Exists, err: %v\n", err)
+	}
+
+	// splitting the edge creates the znode of "op" beside it, the subtree of the edge is not copied
+	err = client.AddTagName("op")
+	if err != nil {
+		t.Errorf("error while AddTagName, err: %v\n", err)
+	}
+	exists, after, err := zkConn.Exists(edge)
+	if err != nil || !exists || after.Czxid != before.Czxid {
+		t.Errorf("wrong result for %v, expect: the znode created at %v, actual: %v %v\n", edge, before, after, err)
+	}
+	children, _, err := zkConn.Children(dmi.TagNameRadixTriePath)
+	if err != nil {
+		t.Errorf("error while Children, err: %v\n", err)
+	}
+	sort.Strings(children)
+	if fmt.Sprint(children) != "[+op +operation]" {
+		t.Errorf("wrong result for the children of %v, expect: [+op +operation], actual: %v\n", dmi.TagNameRadixTriePath, children)
+	}
+
+	for pattern, expected := range map[string][]string{
+		"op*":               {"op"},
+		"op":                {"op"},
+		"operation":         {"operation"},
+		"operationxxx":      {"operationxxx"},
+		"*" + tagNames[100]: {tagNames[100]},
+	} {
+		if pattern == "op*" {
+			expected = append(expected, tagNames...)
+		}
+		results, err := client.SearchTagName(pattern)
+		if err != nil {
+			t.Errorf("error while SearchTagName, err: %v\n", err)
+		}
+		if fmt.Sprint(results) != fmt.Sprint(expected) {
+			t.Errorf("wrong result for %v, expect: %v, actual: %v\n", pattern, expected, results)
+		}
+	}
+
+	t.Cleanup(CleanupZk)
+}
+
+func TestRemoveTagNameRadix(t *testing.T) {
+	removeTagName(t, true)
+	t.Cleanup(CleanupZk)
+}
+
+// removeTagName removes tag names that are a prefix of others, have others as their prefix, or share a suffix
+func removeTagName(t *testing.T, radix bool) {
+	client, _ := dmi.CreateZkClient()
+	if radix {
+		err := client.MigrateToRadixTrie()
+		if err != nil {
+			t.Errorf("error while MigrateToRadixTrie, err: %v\n", err)
+		}
+	}
+	for _, tagName := range []string{"region", "regionUS", "resultType", "operation", "ration"} {
+		err := client.AddTagName(tagName)
+		if err != nil {
+			t.Errorf("error while AddTagName, err: %v\n", err)
+		}
+	}
+
+	for _, tagName := range []string{"region", "resultType", "operation", "unknown"} {
+		err := client.RemoveTagName(tagName)
+		if err != nil {
+			t.Errorf("error while RemoveTagName, err: %v\n", err)
+		}
+	}
+
+	expect := map[string][]string{
+		"*":      {"ration", "regionUS"},
+		"re*":    {"regionUS"},
+		"*ion":   {"ration"},
+		"*ation": {"ration"},
+		"*US":    {"regionUS"},
+		"*Type":  nil,
+	}
+	for pattern, tagNames := range expect {
+		results, err := client.SearchTagName(pattern)
+		if err != nil {
+			t.Errorf("error while SearchTagName, err: %v\n", err)
+		}
+		if !reflect.DeepEqual(results, tagNames) {
+			t.Errorf("wrong result for %v, expect: %v, actual: %v\n", pattern, tagNames, results)
+		}
+	}
+
+	// the branch of resultType is pruned up to the node shared with regionUS, in the radix Trie the edge of regionUS
+	// stays beside the edge "r" it is nested below
+	zkConn, _ := dmi.ConnectZk(dmi.ZkAddr)
+	root := dmi.TagNameTriePath
+	if radix {
+		root = dmi.TagNameRadixTriePath
+	}
+	children, _, err := zkConn.Children(root)
+	if err != nil {
+		t.Errorf("error while Children, err: %v\n", err)
+	}
+	sort.Strings(children)
+	expectChildren := []string{"r"}
+	if radix {
+		expectChildren = []string{"+r", "+region"}
+	}
+	if !reflect.DeepEqual(children, expectChildren) {
+		t.Errorf("wrong result for the children of %v, expect: %v, actual: %v\n", root, expectChildren, children)
+	}
+}
+
+func TestConcurrentAddRemove(t *testing.T) {
+	// one client adds and removes "ab" over and over, pruning the nodes the other clients add below
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		zc, _ := dmi.CreateZkClient()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if err := zc.AddTagName("ab"); err != nil {
+				t.Error(err)
+			}
+			if err := zc.RemoveTagName("ab"); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+
+	tagNames := []string{"abc", "abd", "abcd", "abe", "abcde", "abf"}
+	var writers sync.WaitGroup
+	for _, tagName := range tagNames {
+		writers.Add(1)
+		go func(tagName string) {
+			defer writers.Done()
+			zc, _ := dmi.CreateZkClient()
+			if err := zc.AddTagName(tagName); err != nil {
+				t.Error(err)
+			}
+		}(tagName)
+	}
+	writers.Wait()
+	close(done)
+	wg.Wait()
+
+	zc, _ := dmi.CreateZkClient()
+	results, err := zc.SearchTagName("ab?*")
+	if err != nil {
+		t.Error(err)
+	}
+	sort.Strings(tagNames)
+	if !reflect.DeepEqual(results, tagNames) {
+		t.Errorf("wrong result for ab?*, expect: %v, actual: %v\n", tagNames, results)
+	}
+
+	t.Cleanup(CleanupZk)
+}
+
+// specialTagNames contain characters that are not valid in a znode name, or are the names of reserved znodes
+var specialTagNames = []string{"a/b", "/", "région", "日本", "lock", "eow", ".", "..", "a.b", "50%", "%2F", "a b", "+x"}
+
+func TestEscapeZnodeName(t *testing.T) {
+	for _, tagName := range specialTagNames {
+		name := dmi.EscapeZnodeName(tagName)
+		if strings.Contains(name, "/") || name == "." || name == ".." {
+			t.Errorf("invalid znode name for %q: %q\n", tagName, name)
+		}
+		if actual := dmi.UnescapeZnodeName(name); actual != tagName {
+			t.Errorf("wrong result for %q, expect: %q, actual: %q\n", name, tagName, actual)
+		}
+
+		// one znode per byte, like the character Trie
+		path := dmi.TagNameTriePath
+		for i := 0; i < len(tagName); i++ {
+			path = dmi.JoinPath(path, dmi.EscapeZnodeName(tagName[i:i+1]))
+		}
+		if actual := dmi.GetTagNameFromPath(path); actual != tagName {
+			t.Errorf("wrong result for %q, expect: %q, actual: %q\n", path, tagName, actual)
+		}
+	}
+}
+
+func TestSpecialTagNames(t *testing.T) {
+	specialTagNamesLayout(t, false)
+	t.Cleanup(CleanupZk)
+}
+
+func TestSpecialTagNamesRadix(t *testing.T) {
+	specialTagNamesLayout(t, true)
+	t.Cleanup(CleanupZk)
+}
+
+func specialTagNamesLayout(t *testing.T, radix bool) {
+	client, _ := dmi.CreateZkClient()
+	if radix {
+		err := client.MigrateToRadixTrie()
+		if err != nil {
+			t.Errorf("error while MigrateToRadixTrie, err: %v\n", err)
+		}
+	}
+	for _, tagName := range specialTagNames {
+		err := client.AddTagName(tagName)
+		if err != nil {
+			t.Errorf("error while AddTagName %q, err: %v\n", tagName, err)
+		}
+	}
+
+	all := append([]string(nil), specialTagNames...)
+	sort.Strings(all)
+	expect := map[string][]string{
+		"*":      all,
+		"a/*":    {"a/b"},
+		"*b":     {"a b", "a.b", "a/b"},
+		"r*n":    {"région"},
+		"*本":     {"日本"},
+		"lo?k":   {"lock"},
+		"eow":    {"eow"},
+		"*%*":    {"%2F", "50%"},
+		"?":      {".", "/"},
+		"..":     {".."},
+		"*.":     {".", ".."},
+		"*ion*":  {"région"},
+		"r?gion": {"région"},
+		"日?":     {"日本"},
+		"??":     {"+x", "..", "日本"},
+	}
+	for pattern, tagNames := range expect {
+		results, err := client.SearchTagName(pattern)
+		if err != nil {
+			t.Errorf("error while SearchTagName, err: %v\n", err)
+		}
+		if !reflect.DeepEqual(results, tagNames) {
+			t.Errorf("wrong result for %q, expect: %q, actual: %q\n", pattern, tagNames, results)
+		}
+	}
+
+	regexpResults, err := client.SearchTagNameRegexp("(a|日).*")
+	if err != nil {
+		t.Errorf("error while SearchTagNameRegexp, err: %v\n", err)
+	}
+	expectRegexp := []string{"a b", "a.b", "a/b", "日本"}
+	if !reflect.DeepEqual(regexpResults, expectRegexp) {
+		t.Errorf("wrong result for (a|日).*, expect: %q, actual: %q\n", expectRegexp, regexpResults)
+	}
+
+	err = client.RemoveTagName("a/b")
+	if err != nil {
+		t.Errorf("error while RemoveTagName, err: %v\n", err)
+	}
+	results, err := client.SearchTagName("a*")
+	if err != nil {
+		t.Errorf("error while SearchTagName, err: %v\n", err)
+	}
+	if expectA := []string{"a b", "a.b"}; !reflect.DeepEqual(results, expectA) {
+		t.Errorf("wrong result for a*, expect: %q, actual: %q\n", expectA, results)
+	}
+}
+
+func TestTrieCache(t *testing.T) {
+	client, _ := dmi.CreateZkClient()
+	for _, tagName := range []string{"region", "regionUS", "cpu"} {
+		err := client.AddTagName(tagName)
+		if err != nil {
+			t.Errorf("error while AddTagName, err: %v\n", err)
+		}
+	}
+
+	cache, err := dmi.NewTrieCache(dmi.ZkAddr)
+	if err != nil {
+		t.Fatalf("error while NewTrieCache, err: %v\n", err)
+	}
+	defer cache.Close()
+	if !cache.Ready() {
+		t.Errorf("cache is not ready after NewTrieCache\n")
+	}
+	cached, _ := dmi.CreateZkClient()
+	err = cached.UseTrieCache(cache)
+	if err != nil {
+		t.Errorf("error while UseTrieCache, err: %v\n", err)
+	}
+
+	// the cache follows the changes of another client, once their watch events arrive
+	err = client.AddTagName("regio")
+	if err != nil {
+		t.Errorf("error while AddTagName, err: %v\n", err)
+	}
+	err = client.AddTagName("core")
+	if err != nil {
+		t.Errorf("error while AddTagName, err: %v\n", err)
+	}
+	err = client.RemoveTagName("regionUS")
+	if err != nil {
+		t.Errorf("error while RemoveTagName, err: %v\n", err)
+	}
+
+	expect := map[string][]string{
+		"*":    {"core", "cpu", "regio", "region"},
+		"reg*": {"regio", "region"},
+		"c?re": {"core"},
+		"*US":  nil,
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for pattern, tagNames := range expect {
+		var results []string
+		for {
+			results, err = cached.SearchTagName(pattern)
+			if err != nil {
+				t.Errorf("error while SearchTagName, err: %v\n", err)
+			}
+			if reflect.DeepEqual(results, tagNames) || time.Now().After(deadline) {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if !reflect.DeepEqual(results, tagNames) {
+			t.Errorf("wrong result for %v, expect: %v, actual: %v\n", pattern, tagNames, results)
+		}
+	}
+
+	fuzzy, err := cached.SearchTagNameFuzzy("regoin", 2)
+	if err != nil {
+		t.Errorf("error while SearchTagNameFuzzy, err: %v\n", err)
+	}
+	expectFuzzy := []dmi.FuzzyTagName{{TagName: "regio", Distance: 2}, {TagName: "region", Distance: 2}}
+	if !reflect.DeepEqual(fuzzy, expectFuzzy) {
+		t.Errorf("wrong result for regoin~2, expect: %v, actual: %v\n", expectFuzzy, fuzzy)
+	}
+
+	t.Cleanup(CleanupZk)
+}
+
+func TestTrieCacheNamespace(t *testing.T) {
+	team := dmi.Namespace("team-a")
+	client, _ := dmi.CreateZkClient()
+	t.Cleanup(func() {
+		client.DeleteNamespace(team)
+		CleanupZk()
+	})
+	err := client.Use(team)
+	if err != nil {
+		t.Fatalf("error while Use, err: %v\n", err)
+	}
+	err = client.AddTagName("gpu")
+	if err != nil {
+		t.Errorf("error while AddTagName, err: %v\n", err)
+	}
+
+	cache, err := dmi.NewNamespaceTrieCache(team, dmi.WorldZkACL(), dmi.ZkAddr)
+	if err != nil {
+		t.Fatalf("error while NewNamespaceTrieCache, err: %v\n", err)
+	}
+	defer cache.Close()
+
+	// a client in another namespace, or in the radix layout, cannot use the cache
+	other, _ := dmi.CreateZkClient()
+	if err := other.UseTrieCache(cache); err != dmi.ErrTrieCacheMismatch {
+		t.Errorf("wrong result for UseTrieCache in the default namespace, expect: %v, actual: %v\n", dmi.ErrTrieCacheMismatch, err)
+	}
+	err = client.UseTrieCache(cache)
+	if err != nil {
+		t.Errorf("error while UseTrieCache, err: %v\n", err)
+	}
+	results, err := client.SearchTagName("g*")
+	if err != nil {
+		t.Errorf("error while SearchTagName, err: %v\n", err)
+	}
+	if !reflect.DeepEqual(results, []string{"gpu"}) {
+		t.Errorf("wrong result for g* in %q, expect: [gpu], actual: %v\n", team, results)
+	}
+
+	radix, _ := dmi.CreateZkClient()
+	radix.Use(team)
+	err = radix.MigrateToRadixTrie()
+	if err != nil {
+		t.Errorf("error while MigrateToRadixTrie, err: %v\n", err)
+	}
+	if err := radix.UseTrieCache(cache); err != dmi.ErrTrieCacheMismatch {
+		t.Errorf("wrong result for UseTrieCache in the radix layout, expect: %v, actual: %v\n", dmi.ErrTrieCacheMismatch, err)
+	}
+}
+
+func TestZkServers(t *testing.T) {
+	// nothing listens on the first server, so the client connects to the second one
+	client, err := dmi.CreateZkClient("localhost:1", dmi.ZkAddr)
+	if err != nil {
+		t.Fatalf("error while CreateZkClient, err: %v\n", err)
+	}
+	defer client.Close()
+
+	err = client.AddTagName("cpu")
+	if err != nil {
+		t.Errorf("error while AddTagName, err: %v\n", err)
+	}
+	results, err := client.SearchTagName("c*")
+	if err != nil {
+		t.Errorf("error while SearchTagName, err: %v\n", err)
+	}
+	if !reflect.DeepEqual(results, []string{"cpu"}) {
+		t.Errorf("wrong result for c*, expect: [cpu], actual: %v\n", results)
+	}
+
+	t.Cleanup(CleanupZk)
+}
+
+func TestZkACL(t *testing.T) {
+	// the roots must be created by the writer to get its ACL
+	CleanupZk()
+	acl, err := dmi.DigestZkACL("writer:secret", []string{"writer:secret"}, []string{"reader:secret"})
+	if err != nil {
+		t.Fatalf("error while DigestZkACL, err: %v\n", err)
+	}
+	writer, err := dmi.CreateZkClientWithACL(acl, dmi.ZkAddr)
+	if err != nil {
+		t.Fatalf("error while CreateZkClientWithACL, err: %v\n", err)
+	}
+	defer writer.Close()
+	t.Cleanup(func() {
+		zkConn, _ := dmi.ConnectZk(dmi.ZkAddr)
+		defer zkConn.Close()
+		zkConn.AddAuth("digest", []byte("writer:secret"))
+		for _, root := range []string{dmi.TagNameTriePath, dmi.TagNameSuffixTriePath, dmi.NamespacesPath} {
+			err := dmi.DeleteZkRoot(root, zkConn)
+			if err != nil && err != zk.ErrNoNode {
+				fmt.Printf("error while deleting root, err: %v\n", err)
+			}
+		}
+	})
+
+	err = writer.AddTagName("cpu")
+	if err != nil {
+		t.Errorf("error while AddTagName, err: %v\n", err)
+	}
+
+	readerACL, _ := dmi.DigestZkACL("reader:secret", []string{"writer:secret"}, []string{"reader:secret"})
+	reader, err := dmi.CreateZkClientWithACL(readerACL, dmi.ZkAddr)
+	if err != nil {
+		t.Fatalf("error while CreateZkClientWithACL, err: %v\n", err)
+	}
+	defer reader.Close()
+	results, err := reader.SearchTagName("c*")
+	if err != nil {
+		t.Errorf("error while SearchTagName, err: %v\n", err)
+	}
+	if !reflect.DeepEqual(results, []string{"cpu"}) {
+		t.Errorf("wrong result for c*, expect: [cpu], actual: %v\n", results)
+	}
+	err = reader.AddTagName("mem")
+	if err != zk.ErrNoAuth {
+		t.Errorf("wrong result for AddTagName by a reader, expect: %v, actual: %v\n", zk.ErrNoAuth, err)
+	}
+
+	// a reader may use a namespace that a writer created
+	team := dmi.Namespace("team-a")
+	err = writer.Use(team)
+	if err != nil {
+		t.Errorf("error while Use by a writer, err: %v\n", err)
+	}
+	err = writer.AddTagName("gpu")
+	if err != nil {
+		t.Errorf("error while AddTagName, err: %v\n", err)
+	}
+	err = reader.Use(team)
+	if err != nil {
+		t.Errorf("error while Use by a reader, err: %v\n", err)
+	}
+	results, err = reader.SearchTagName("g*")
+	if err != nil {
+		t.Errorf("error while SearchTagName, err: %v\n", err)
+	}
+	if !reflect.DeepEqual(results, []string{"gpu"}) {
+		t.Errorf("wrong result for g* in %q, expect: [gpu], actual: %v\n", team, results)
+	}
+	err = reader.AddTagName("mem")
+	if err != zk.ErrNoAuth {
+		t.Errorf("wrong result for AddTagName by a reader in %q, expect: %v, actual: %v\n", team, zk.ErrNoAuth, err)
+	}
+	readerInTeam, err := dmi.CreateZkClientWithACL(readerACL, dmi.ZkAddr)
+	if err != nil {
+		t.Fatalf("error while CreateZkClientWithACL, err: %v\n", err)
+	}
+	defer readerInTeam.Close()
+	err = readerInTeam.Use(team)
+	if err != nil {
+		t.Errorf("error while Use by a new reader, err: %v\n", err)
+	}
+	reader.Use(dmi.DefaultNamespace)
+
+	anonymous, err := dmi.CreateZkClient(dmi.ZkAddr)
+	if err != nil {
+		t.Fatalf("error while CreateZkClient, err: %v\n", err)
+	}
+	defer anonymous.Close()
+	_, err = anonymous.SearchTagName("c*")
+	if err != zk.ErrNoAuth {
+		t.Errorf("wrong result for SearchTagName by anonymous, expect: %v, actual: %v\n", zk.ErrNoAuth, err)
+	}
+}
+
+func TestNamespaces(t *testing.T) {
+	client, err := dmi.CreateZkClient(dmi.ZkAddr)
+	if err != nil {
+		t.Fatalf("error while CreateZkClient, err: %v\n", err)
+	}
+	defer client.Close()
+	t.Cleanup(func() {
+		zkConn, _ := dmi.ConnectZk(dmi.ZkAddr)
+		defer zkConn.Close()
+		if err := dmi.DeleteZkRoot(dmi.NamespacesPath, zkConn); err != nil && err != zk.ErrNoNode {
+			fmt.Printf("error while deleting root, err: %v\n", err)
+		}
+		CleanupZk()
+	})
+
+	for _, tc := range []struct {
+		ns       dmi.Namespace
+		tagNames []string
+	}{
+		{ns: dmi.DefaultNamespace, tagNames: []string{"cpu"}},
+		{ns: "team-a", tagNames: []string{"cpu", "region"}},
+		{ns: "team/b", tagNames: []string{"core"}},
+	} {
+		if err := client.Use(tc.ns); err != nil {
+			t.Fatalf("error while Use, err: %v\n", err)
+		}
+		for _, tagName := range tc.tagNames {
+			if err := client.AddTagName(tagName); err != nil {
+				t.Errorf("error while AddTagName, err: %v\n", err)
+			}
+		}
+	}
+
+	namespaces, err := client.Namespaces()
+	if err != nil {
+		t.Errorf("error while Namespaces, err: %v\n", err)
+	}
+	if !reflect.DeepEqual(namespaces, []dmi.Namespace{"team-a", "team/b"}) {
+		t.Errorf("wrong result for Namespaces, expect: [team-a team/b], actual: %v\n", namespaces)
+	}
+
+	for _, tc := range []struct {
+		ns       dmi.Namespace
+		expected []string
+	}{
+		{ns: dmi.DefaultNamespace, expected: []string{"cpu"}},
+		{ns: "team-a", expected: []string{"cpu", "region"}},
+		{ns: "team/b", expected: []string{"core"}},
+	} {
+		client.Use(tc.ns)
+		results, err := client.ListTagNames()
+		if err != nil {
+			t.Errorf("error while ListTagNames, err: %v\n", err)
+		}
+		if !reflect.DeepEqual(results, tc.expected) {
+			t.Errorf("wrong result for %q, expect: %v, actual: %v\n", tc.ns, tc.expected, results)
+		}
+	}
+
+	err = client.DeleteNamespace("team-a")
+	if err != nil {
+		t.Errorf("error while DeleteNamespace, err: %v\n", err)
+	}
+	namespaces, _ = client.Namespaces()
+	if !reflect.DeepEqual(namespaces, []dmi.Namespace{"team/b"}) {
+		t.Errorf("wrong result for Namespaces, expect: [team/b], actual: %v\n", namespaces)
+	}
+	client.Use(dmi.DefaultNamespace)
+	results, _ := client.ListTagNames()
+	if !reflect.DeepEqual(results, []string{"cpu"}) {
+		t.Errorf("wrong result for the default namespace, expect: [cpu], actual: %v\n", results)
+	}
+}
+
+func TestTagNameMetadata(t *testing.T) {
+	client, _ := dmi.CreateZkClient()
+	err := client.AddTagName("region")
+	if err != nil {
+		t.Errorf("error while AddTagName, err: %v\n", err)
+	}
+	metadata, err := client.GetTagNameMetadata("region")
+	if err != nil {
+		t.Errorf("error while GetTagNameMetadata, err: %v\n", err)
+	}
+	firstSeen := metadata.FirstSeen
+	if firstSeen.IsZero() {
+		t.Errorf("wrong result for FirstSeen of region, expect: a time, actual: %v\n", firstSeen)
+	}
+
+	tree := dmi.NewTagValueIndex()
+	tree.AddTagValue("EastUS1", 0)
+	tree.AddTagValue("EastUS2", 0)
+	tree.AddTagValue("WestUS1", 1)
+	err = client.UpdateTagNameStats("region", tree)
+	if err != nil {
+		t.Errorf("error while UpdateTagNameStats, err: %v\n", err)
+	}
+	err = client.UpdateTagNameMetadata("region", func(metadata *dmi.TagNameMetadata) {
+		metadata.Description = "cloud region of the node"
+	})
+	if err != nil {
+		t.Errorf("error while UpdateTagNameMetadata, err: %v\n", err)
+	}
+	// adding the tag name again keeps its metadata
+	err = client.AddTagName("region")
+	if err != nil {
+		t.Errorf("error while AddTagName, err: %v\n", err)
+	}
+
+	expected := dmi.TagNameMetadata{
+		FirstSeen:      firstSeen,
+		Nodes:          2,
+		DistinctValues: 3,
+		ValueType:      dmi.TagValueTypeString,
+		Description:    "cloud region of the node",
+	}
+	metadata, _ = client.GetTagNameMetadata("region")
+	if !metadata.FirstSeen.Equal(expected.FirstSeen) || metadata.Nodes != expected.Nodes ||
+		metadata.DistinctValues != expected.DistinctValues || metadata.ValueType != expected.ValueType ||
+		metadata.Description != expected.Description {
+		t.Errorf("wrong result for region, expect: %v, actual: %v\n", expected, metadata)
+	}
+
+	_, err = client.GetTagNameMetadata("regio")
+	if err != dmi.ErrUnknownTagName {
+		t.Errorf("wrong result for regio, expect: %v, actual: %v\n", dmi.ErrUnknownTagName, err)
+	}
+
+	// the metadata is migrated, and stays with the tag name when an edge of the radix Trie is split
+	err = client.MigrateToRadixTrie()
+	if err != nil {
+		t.Errorf("error while MigrateToRadixTrie, err: %v\n", err)
+	}
+	err = client.AddTagName("result")
+	if err != nil {
+		t.Errorf("error while AddTagName, err: %v\n", err)
+	}
+	metadata, _ = client.GetTagNameMetadata("region")
+	if metadata.Description != expected.Description || metadata.Nodes != expected.Nodes {
+		t.Errorf("wrong result for region after the migration, expect: %v, actual: %v\n", expected, metadata)
+	}
+
+	for _, tc := range []struct {
+		tagValues []string
+		expected  dmi.TagValueType
+	}{
+		{tagValues: []string{"1", "2.5", "-3"}, expected: dmi.TagValueTypeNumeric},
+		{tagValues: []string{"1", "high"}, expected: dmi.TagValueTypeMixed},
+		{tagValues: nil, expected: dmi.TagValueTypeUnknown},
+	} {
+		tree := dmi.NewTagValueIndex()
+		for i, tagValue := range tc.tagValues {
+			tree.AddTagValue(tagValue, uint32(i))
+		}
+		err = client.UpdateTagNameStats("result", tree)
+		if err != nil {
+			t.Errorf("error while UpdateTagNameStats, err: %v\n", err)
+		}
+		metadata, _ = client.GetTagNameMetadata("result")
+		if metadata.ValueType != tc.expected {
+			t.Errorf("wrong result for %v, expect: %v, actual: %v\n", tc.tagValues, tc.expected, metadata.ValueType)
+		}
+	}
+
+	t.Cleanup(CleanupZk)
+}